@@ -0,0 +1,115 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+)
+
+// ErrClipBurned - Is returned, if a burn-after-read clip is (being) read by another client
+var ErrClipBurned = errors.New("Clip has already been read")
+
+// BeginBurn - Marks a burn-after-read clip as "read in progress"
+//
+// Only one client can hold the marker, so all other readers will receive ErrClipBurned,
+// also if the clip has been burned in the meantime. The data must not be opened before.
+func (c *ClipFile) BeginBurn() error {
+	unlock := LockClip(c.id)
+	defer unlock()
+
+	c.refreshKey()
+
+	// read completely by another client in the meantime
+	_, err := ClipStorage.Stat(c.file)
+	if err == nil {
+		_, err = c.ReadMeta()
+	}
+	if os.IsNotExist(err) {
+		return ErrClipBurned
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = ClipStorage.Stat(c.BurnMarkerFile())
+	if err == nil {
+		return ErrClipBurned
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	return WriteObject(c.BurnMarkerFile(), []byte{})
+}
+
+// BurnMarkerFile - Returns the key of the "read in progress" marker of the clip
+func (c ClipFile) BurnMarkerFile() string {
+	return c.file + ".burning"
+}
+
+// FinishBurn - Deletes a burn-after-read clip, if it has been read completely,
+// otherwise the clip becomes readable again
+func (c ClipFile) FinishBurn(completed bool) error {
+	if completed {
+		unlock := LockClip(c.id)
+		defer unlock()
+
+		return c.Delete()
+	}
+
+	return ClipStorage.Delete(c.BurnMarkerFile())
+}
+
+// RecoverBurnedClips - Deletes all burn-after-read clips,
+// which were read while the server crashed or stopped
+func RecoverBurnedClips() error {
+	objects, err := ListClipObjects(ClipStorage)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		id, suffix, ok := parseClipKey(o.Key)
+		if !ok || suffix != ".burning" {
+			continue
+		}
+
+		var clip ClipFile
+		clip.file = strings.TrimSuffix(o.Key, suffix)
+		clip.id = id
+
+		// we cannot know, if the client received all data, so burn it
+		err := clip.recoverBurn()
+		if err != nil {
+			return err
+		}
+
+		log.Println("Deleted burn-after-read clip", clip.id, "which was read during shutdown")
+	}
+
+	return nil
+}
+
+// recoverBurn - Deletes a burn-after-read clip, which was read while the server crashed or stopped
+func (c ClipFile) recoverBurn() error {
+	clipMeta, _ := c.ReadMeta()
+
+	return c.delete(clipMeta)
+}
@@ -0,0 +1,141 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestBurnAfterRead(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("secret", "X-Cclip-Burn", "true")
+
+	// HEAD and conditional requests do not send the data
+	resp, _ := server.do("HEAD", "/clips/"+clip.ID, "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("HEAD returned %d", resp.StatusCode)
+	}
+	server.expectStatus(304, "GET", "/clips/"+clip.ID, "", "If-None-Match", resp.Header.Get("ETag"))
+
+	// ranges are ignored, so the clip is read completely
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID, "", "Range", "bytes=0-1"); data != "secret" {
+		t.Errorf("first read returned %q", data)
+	}
+
+	server.expectStatus(404, "GET", "/clips/"+clip.ID, "")
+	if ClipIndex.Count() != 0 {
+		t.Error("burned clip is still in the index")
+	}
+}
+
+func TestBurnEmptyClip(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("", "X-Cclip-Burn", "true", "Content-Type", "text/plain")
+
+	resp, _ := server.do("HEAD", "/clips/"+clip.ID, "")
+	server.expectStatus(304, "GET", "/clips/"+clip.ID, "", "If-None-Match", resp.Header.Get("ETag"))
+	server.expectStatus(304, "GET", "/clips/"+clip.ID, "", "If-None-Match", resp.Header.Get("ETag"))
+
+	server.expectStatus(200, "GET", "/clips/"+clip.ID, "")
+	server.expectStatus(404, "GET", "/clips/"+clip.ID, "")
+}
+
+func TestRecoverBurnedClips(t *testing.T) {
+	server := newTestServer(t)
+
+	burning := server.upload("burning", "X-Cclip-Burn", "true")
+	other := server.upload("other")
+
+	clip, err := GetClipByID(burning.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clip.BeginBurn(); err != nil {
+		t.Fatal(err)
+	}
+
+	// read by another client in the meantime
+	server.expectStatus(410, "GET", "/clips/"+burning.ID, "")
+
+	// the server stopped while the clip was read
+	if err := RecoverBurnedClips(); err != nil {
+		t.Fatal(err)
+	}
+	ClipIndex.Load()
+
+	server.expectStatus(404, "GET", "/clips/"+burning.ID, "")
+	server.expectStatus(200, "GET", "/clips/"+other.ID, "")
+}
+
+func TestBurnByConcurrentReaders(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("secret", "X-Cclip-Burn", "true")
+
+	// found by a second reader, before the first one has read the clip completely
+	second, err := GetClipByID(clip.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID, ""); data != "secret" {
+		t.Errorf("first read returned %q", data)
+	}
+
+	if err := second.BeginBurn(); err != ErrClipBurned {
+		t.Errorf("second reader could begin to burn the clip: %v", err)
+	}
+	if _, err := ClipStorage.Stat(second.BurnMarkerFile()); !os.IsNotExist(err) {
+		t.Error("marker of burned clip has been left")
+	}
+
+	// only one of many readers receives the data
+	for i := 0; i < 5; i++ {
+		clip := server.upload("secret", "X-Cclip-Burn", "true")
+
+		var reads sync.WaitGroup
+		var lock sync.Mutex
+		received := 0
+		for r := 0; r < 4; r++ {
+			reads.Add(1)
+			go func() {
+				defer reads.Done()
+
+				resp, data := server.do("GET", "/clips/"+clip.ID, "")
+
+				lock.Lock()
+				defer lock.Unlock()
+
+				switch {
+				case resp.StatusCode == 200 && data == "secret":
+					received++
+				case resp.StatusCode != 404 && resp.StatusCode != 410:
+					t.Errorf("reader received %d %q", resp.StatusCode, data)
+				}
+			}()
+		}
+		reads.Wait()
+
+		if received != 1 {
+			t.Errorf("%d readers received the data of the clip", received)
+		}
+	}
+}
@@ -17,13 +17,11 @@
 package main
 
 import (
-	"errors"
 	"os"
-	"path"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 )
 
 // ByNewestClipFile - describes a ClipFile list, which can be sorted by newest item descending
@@ -32,30 +30,134 @@ type ByNewestClipFile []ClipFile
 func (a ByNewestClipFile) Len() int { return len(a) }
 func (a ByNewestClipFile) Less(i, j int) bool {
 	// order descending
-	return a[i].fileInfo.ModTime().Unix() > a[j].fileInfo.ModTime().Unix()
+	if !a[i].uploadTime.Equal(a[j].uploadTime) {
+		return a[i].uploadTime.After(a[j].uploadTime)
+	}
+	return a[i].id < a[j].id
 }
 func (a ByNewestClipFile) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 
 // ClipFile - A clip file
 type ClipFile struct {
-	file         string
-	fileInfo     os.FileInfo
-	id           string
-	metaFile     string
-	metaFileInfo os.FileInfo
+	// key of the data in ClipStorage
+	file       string
+	fileInfo   StorageInfo
+	id         string
+	uploadTime time.Time
+	version    int64
 }
 
 // Delete - Deletes the clip
+//
+// The caller has to hold the lock of the clip, s. LockClip().
 func (c ClipFile) Delete() error {
-	err := os.Remove(c.file)
+	c.refreshKey()
+
+	clipMeta, _ := c.ReadMeta()
+
+	return c.delete(clipMeta)
+}
+
+// delete - Deletes all objects of the clip, which still exist,
+// and releases the shared data object of its meta data
+func (c ClipFile) delete(clipMeta clipMetaData) error {
+	// hide from all other requests first
+	ClipIndex.Remove(c.id)
+
+	// a crash must not leave meta data without data
+	err := c.BeginOperation("delete", clipMeta, 0)
+	if err != nil {
+		return err
+	}
+
+	// versions can share data with the clip
+	versions, _ := c.GetVersions()
+	for _, v := range versions {
+		v.deleteVersion()
+	}
+
+	// incomplete versions
+	leftovers, err := ClipStorage.List(c.VersionsDirectory() + "/")
+	if err != nil {
+		return err
+	}
+	for _, o := range leftovers {
+		err = DeleteObjects(o.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = DeleteObjects(c.file)
+	if err == nil {
+		err = ClipMetaStore.Delete(c.id, c.version)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
 	if err == nil {
-		err = os.Remove(c.metaFile)
+		err = ReleaseBlob(clipMeta.BlobID())
+	}
+	if err == nil {
+		err = RemoveClipFromIndex(c.id)
+	}
+	if err == nil {
+		// optional objects
+		err = DeleteObjects(c.SharesFile(), c.BurnMarkerFile())
+	}
+	if err == nil {
+		err = c.FinishOperation()
+	}
+	if err == nil {
+		removeClipUser(c.id)
+	}
+
+	return err
+}
+
+// refreshKey - Uses the current key of the data of the clip, if it has been moved
+// by "cclip migrate-layout" in the meantime
+func (c *ClipFile) refreshKey() {
+	if c.version != 0 {
+		return
+	}
+
+	if key, ok := findClipKey(c.id); ok {
+		c.file = key
+	}
+}
+
+// UploadTime - Returns the time, the current data of the clip has been uploaded
+func (c ClipFile) UploadTime() time.Time {
+	if c.uploadTime.IsZero() {
+		return c.fileInfo.ModTime
+	}
+
+	return c.uploadTime
+}
+
+// ReadMeta - Reads the meta data of the clip
+func (c ClipFile) ReadMeta() (clipMetaData, error) {
+	return ClipMetaStore.Read(c.id, c.version)
+}
+
+// setUploadTime - Uses the upload time, which is stored in the meta data,
+// and the modification time of the data as fallback
+func (c *ClipFile) setUploadTime(clipMeta clipMetaData) {
+	c.uploadTime = clipMeta.GetUploadTime(c.fileInfo.ModTime)
+}
+
+// WriteMeta - Writes the meta data of the clip atomically
+func (c ClipFile) WriteMeta(clipMeta clipMetaData) error {
+	err := ClipMetaStore.Write(c.id, c.version, clipMeta)
+	if err == nil && c.version == 0 {
+		err = ClipIndex.Refresh(c.id)
 	}
 
 	return err
 }
 
-// ClipDirectory - The clip / output directory
+// ClipDirectory - The clip / output directory, if clips are stored in the file system
 var ClipDirectory string
 
 // MaxClipSize - Maximum size for a clip, in bytes
@@ -65,73 +167,100 @@ var MaxClipSize int64 = 0
 func GetClipByID(id string) (ClipFile, error) {
 	var clipFile ClipFile
 
-	clipFileName := path.Join(ClipDirectory, id)
-	clipFileStat, err := os.Stat(clipFileName)
-	if err == nil {
-		if !clipFileStat.IsDir() {
-			clipMetaFileName := path.Join(ClipDirectory, id+".meta")
-			clipMetaFileStat, err := os.Stat(clipMetaFileName)
-			if err == nil {
-				if !clipMetaFileStat.IsDir() {
-					clipFile.file = clipFileName
-					clipFile.fileInfo = clipFileStat
-					clipFile.id = id
-					clipFile.metaFile = clipFileName
-					clipFile.metaFileInfo = clipMetaFileStat
-
-					err = nil
-				} else {
-					err = errors.New("Clip meta is not file")
-				}
-			}
-		} else {
-			err = errors.New("Clip is not file")
-		}
+	key, ok := findClipKey(id)
+	if !ok {
+		return clipFile, notExistError("stat", id)
+	}
+
+	clipFileStat, err := ClipStorage.Stat(key)
+	if err != nil {
+		return clipFile, err
+	}
+
+	clipMeta, err := ClipMetaStore.Read(id, 0)
+	if err != nil {
+		return clipFile, err
+	}
+
+	clipFile.file = key
+	clipFile.fileInfo = clipFileStat
+	clipFile.id = id
+	clipFile.setUploadTime(clipMeta)
+
+	return clipFile, nil
+}
+
+// GetActiveClipByID - Returns a clip file by its ID from the index, if it has not been expired yet
+func GetActiveClipByID(id string) (ClipFile, error) {
+	entry, ok := ClipIndex.Get(id)
+	if !ok || entry.Meta.IsExpired(time.Now()) {
+		return ClipFile{}, os.ErrNotExist
 	}
 
-	return clipFile, err
+	entry.Clip.refreshKey()
+
+	return entry.Clip, nil
 }
 
-// ScanClipDirectory - Scans clip directory for clip files
-func ScanClipDirectory() ([]ClipFile, error) {
-	files := make([]ClipFile, 0)
-
-	// try scan directory for ".meta" files
-	err := filepath.Walk(ClipDirectory, func(metaFilePath string, metaFileStat os.FileInfo, err error) error {
-		if err == nil {
-			if !metaFileStat.IsDir() {
-				if strings.HasSuffix(metaFilePath, ".meta") {
-					metaFileName := path.Base(metaFilePath)
-
-					fileName := metaFileName
-					fileName = fileName[0 : len(fileName)-5]
-
-					doesMatch, _ := regexp.MatchString("^([0-9a-f]{32})$", fileName)
-					if doesMatch {
-						filePath := metaFilePath[0 : len(metaFilePath)-5]
-
-						fileStat, err := os.Stat(filePath)
-						if err == nil {
-							if !fileStat.IsDir() {
-								var newFileItem ClipFile
-								newFileItem.file = filePath
-								newFileItem.fileInfo = fileStat
-								newFileItem.id = fileName
-								newFileItem.metaFile = metaFilePath
-								newFileItem.metaFileInfo = metaFileStat
-
-								files = append(files, newFileItem)
-							}
-						}
-					}
-				}
-			}
+// ScanClips - Scans ClipStorage and ClipMetaStore for clips
+func ScanClips() ([]ClipFile, error) {
+	scan, err := scanClips()
+	return scan.clips, err
+}
+
+// clipScan - The result of scanClips()
+type clipScan struct {
+	clips []ClipFile
+	metas map[string]clipMetaData
+	// keys of the clips, which have a shares object
+	shared map[string]bool
+}
+
+// scanClips - Like ScanClips(), but also returns, what has been found about the clips
+// by the same scan, so it has not to be read again
+func scanClips() (clipScan, error) {
+	scan := clipScan{
+		clips:  make([]ClipFile, 0),
+		shared: map[string]bool{},
+	}
+
+	objects, err := ListClipObjects(ClipStorage)
+	if err != nil {
+		return scan, err
+	}
+
+	scan.metas, err = ClipMetaStore.List()
+	if err != nil {
+		return scan, err
+	}
+
+	// clips need data and meta data
+	for _, fileStat := range objects {
+		id, suffix, ok := parseClipKey(fileStat.Key)
+		if ok && suffix == ".shares" {
+			scan.shared[strings.TrimSuffix(fileStat.Key, suffix)] = true
+		}
+		if !ok || suffix != "" {
+			continue
 		}
 
-		return nil
-	})
+		clipMeta, ok := scan.metas[id]
+		if !ok {
+			continue
+		}
 
-	sort.Sort(ByNewestClipFile(files))
+		var newFileItem ClipFile
+		newFileItem.file = fileStat.Key
+		newFileItem.fileInfo = fileStat
+		newFileItem.id = id
+		newFileItem.setUploadTime(clipMeta)
 
-	return files, err
+		scan.clips = append(scan.clips, newFileItem)
+	}
+
+	sort.Sort(ByNewestClipFile(scan.clips))
+
+	return scan, nil
 }
+
+var clipIDRegex = regexp.MustCompile("^([0-9a-f]{32})$")
@@ -17,22 +17,719 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
 )
 
 // AppCommands - all known app commands
 var AppCommands = []*cli.Command{
+	{
+		Name:  "fsck",
+		Usage: "checks the clips in CCLIP_DIR for missing, broken and unexpected files, while the server is stopped",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "writes the report as JSON",
+			},
+			&cli.BoolFlag{
+				Name:  "repair",
+				Usage: "repairs all problems, moves broken and unexpected files into the quarantine directory",
+			},
+		},
+		Action: fsck,
+	},
+	{
+		Name:  "hash-password",
+		Usage: "asks for a password and prints its hash for CCLIP_PASSWORD_HASH",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "argon2",
+				Usage: "uses argon2id instead of bcrypt",
+			},
+		},
+		Action: hashPassword,
+	},
+	{
+		Name:  "meta",
+		Usage: "moves the meta data of all clips in CCLIP_DIR between .meta files and the SQLite database, while the server is stopped",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "export",
+				Usage:  "moves the meta data from the database into .meta files and deletes the database",
+				Action: exportMeta,
+			},
+			{
+				Name:   "import",
+				Usage:  "moves the meta data from .meta files into the database",
+				Action: importMeta,
+			},
+		},
+	},
+	{
+		Name:      "migrate-layout",
+		Usage:     "moves all clips in CCLIP_DIR into the flat or sharded layout, default: CCLIP_LAYOUT, while the server may keep running",
+		ArgsUsage: "[flat|sharded]",
+		Action:    migrateLayout,
+	},
+	{
+		Name:   "reencrypt",
+		Usage:  "encrypts all clips in CCLIP_DIR with CCLIP_ENCRYPTION_KEY, or decrypts them, while the server is stopped",
+		Action: reencrypt,
+	},
 	{
 		Name:    "test",
 		Aliases: []string{"t"},
 		Usage:   "a test command",
 		Action:  test,
 	},
+	{
+		Name:  "token",
+		Usage: "manages the API tokens in CCLIP_TOKENS_FILE, while the server may keep running",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     "creates an API token and prints it once",
+				ArgsUsage: "<label>",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "scope",
+						Usage: "the scopes of the token: read, write, delete and admin, default: read, write and delete",
+					},
+					&cli.DurationFlag{
+						Name:  "ttl",
+						Usage: "the time-to-live of the token, like 720h, default: no expiration",
+					},
+					&cli.StringFlag{
+						Name:  "user",
+						Usage: "the user of the token, default: the shared clips of CCLIP_PASSWORD",
+					},
+				},
+				Action: createToken,
+			},
+			{
+				Name:   "list",
+				Usage:  "lists all API tokens",
+				Action: listTokens,
+			},
+			{
+				Name:      "revoke",
+				Usage:     "revokes an API token",
+				ArgsUsage: "<id>",
+				Action:    revokeToken,
+			},
+		},
+	},
+	{
+		Name:  "user",
+		Usage: "manages the users in CCLIP_USERS_FILE, who have own clips, while the server may keep running",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "add",
+				Usage:     "adds a user and asks for the password",
+				ArgsUsage: "<name>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "admin",
+						Usage: "allows the user to access the clips of all users",
+					},
+				},
+				Action: addUser,
+			},
+			{
+				Name:   "list",
+				Usage:  "lists all users and their roles",
+				Action: listUsers,
+			},
+			{
+				Name:      "passwd",
+				Usage:     "changes the password of a user",
+				ArgsUsage: "<name>",
+				Action:    changeUserPassword,
+			},
+			{
+				Name:      "remove",
+				Usage:     "removes a user, whose clips are kept for admins",
+				ArgsUsage: "<name>",
+				Action:    removeUser,
+			},
+		},
+	},
 }
 
 func test(c *cli.Context) error {
 	fmt.Println("completed task: ", c.Args().First())
 	return nil
 }
+
+func fsck(c *cli.Context) error {
+	envStorage := strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_STORAGE")))
+	if envStorage != "" && envStorage != "fs" {
+		return errors.New("fsck requires the storage backend fs")
+	}
+
+	ClipDirectory = GetClipDirectoryFromEnv()
+
+	_, err := openClipDirectoryStorage()
+	if err != nil {
+		return err
+	}
+
+	clipDirStat, err := os.Stat(ClipDirectory)
+	if err == nil && !clipDirStat.IsDir() {
+		err = errors.New(ClipDirectory + " is no directory")
+	}
+	if err != nil {
+		return err
+	}
+
+	var metaDatabase *SQLiteMetaStore
+	if strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_META_STORE"))) == "sqlite" {
+		metaDatabase, err = OpenSQLiteMetaStore(path.Join(ClipDirectory, MetaDatabaseFileName))
+		if err != nil {
+			return err
+		}
+		defer metaDatabase.Close()
+
+		ClipMetaStore = metaDatabase
+	}
+
+	report, err := CheckClipDirectory(c.Bool("repair"), metaDatabase)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		bytes, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bytes))
+	} else {
+		for _, p := range report.Problems {
+			line := p.Type + " " + p.File + ": " + p.Message
+			if p.Action != "" {
+				line += " => " + p.Action
+			} else if p.Error != "" {
+				line += " => " + p.Error
+			}
+
+			fmt.Println(line)
+		}
+
+		fmt.Println("Checked", report.Clips, "clip(s),", report.Versions, "version(s) and", report.Blobs, "blob(s):",
+			len(report.Problems), "problem(s),", report.Unrepaired(), "unrepaired")
+	}
+
+	if report.Unrepaired() > 0 {
+		// for monitoring
+		return cli.Exit("", 1)
+	}
+
+	return nil
+}
+
+func hashPassword(c *cli.Context) error {
+	password, err := readNewPassword()
+	if err != nil {
+		return err
+	}
+
+	var passwordHash string
+	if c.Bool("argon2") {
+		passwordHash, err = HashPasswordArgon2(password)
+	} else {
+		passwordHash, err = HashPassword(password)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(passwordHash)
+	return nil
+}
+
+func exportMeta(c *cli.Context) error {
+	ClipDirectory = GetClipDirectoryFromEnv()
+
+	_, err := openClipDirectoryStorage()
+	if err != nil {
+		return err
+	}
+
+	metaDatabaseFile := path.Join(ClipDirectory, MetaDatabaseFileName)
+
+	_, err = os.Stat(metaDatabaseFile)
+	if err != nil {
+		return err
+	}
+
+	metaDatabase, err := OpenSQLiteMetaStore(metaDatabaseFile)
+	if err != nil {
+		return err
+	}
+
+	exported, err := ExportMetaDatabase(metaDatabase)
+	metaDatabase.Close()
+	if err != nil {
+		return err
+	}
+
+	// database and its journal files
+	for _, f := range []string{metaDatabaseFile, metaDatabaseFile + "-wal", metaDatabaseFile + "-shm"} {
+		err = os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	fmt.Println("Exported meta data of", exported, "clip(s) and version(s)")
+	return nil
+}
+
+func importMeta(c *cli.Context) error {
+	ClipDirectory = GetClipDirectoryFromEnv()
+
+	encryptedStorage, err := openClipDirectoryStorage()
+	if err != nil {
+		return err
+	}
+	if len(encryptedStorage.Keys) > 0 {
+		// the database would contain the meta data unencrypted
+		return errors.New("Encryption is not supported by the meta data store sqlite")
+	}
+
+	metaDatabase, err := OpenSQLiteMetaStore(path.Join(ClipDirectory, MetaDatabaseFileName))
+	if err != nil {
+		return err
+	}
+	defer metaDatabase.Close()
+
+	imported, err := ImportMetaFiles(metaDatabase)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Imported meta data of", imported, "clip(s)")
+	return nil
+}
+
+func migrateLayout(c *cli.Context) error {
+	envStorage := strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_STORAGE")))
+	if envStorage != "" && envStorage != "fs" {
+		return errors.New("migrate-layout requires the storage backend fs")
+	}
+
+	layout := strings.TrimSpace(strings.ToLower(c.Args().First()))
+	if layout == "" {
+		layout = strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_LAYOUT")))
+	}
+	if layout == "" {
+		layout = "flat"
+	}
+	if layout != "flat" && layout != "sharded" {
+		return errors.New("Invalid clip layout '" + layout + "', use flat or sharded")
+	}
+
+	ClipDirectory = GetClipDirectoryFromEnv()
+
+	_, err := openClipDirectoryStorage()
+	if err != nil {
+		return err
+	}
+
+	// prefer the new layout, if a clip exists in both
+	ClipLayout = layout
+
+	report, err := MigrateClipLayout(layout)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Moved", report.Migrated, "clip(s) into", layout, "layout,", report.Unchanged, "clip(s) unchanged,",
+		report.Skipped, "clip(s) skipped")
+
+	if report.Skipped > 0 {
+		// clips, which have been changed in the meantime
+		return cli.Exit("Run the command again to move the skipped clip(s)", 1)
+	}
+
+	return nil
+}
+
+func reencrypt(c *cli.Context) error {
+	envStorage := strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_STORAGE")))
+	if envStorage != "" && envStorage != "fs" {
+		return errors.New("reencrypt requires the storage backend fs")
+	}
+	if strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_META_STORE"))) == "sqlite" {
+		return errors.New("Encryption is not supported by the meta data store sqlite")
+	}
+
+	ClipDirectory = GetClipDirectoryFromEnv()
+
+	encryptedStorage, err := openClipDirectoryStorage()
+	if err != nil {
+		return err
+	}
+
+	if len(encryptedStorage.Keys) == 0 {
+		return errors.New("Neither CCLIP_ENCRYPTION_KEY nor CCLIP_ENCRYPTION_OLD_KEYS is set")
+	}
+
+	// existing clips are encrypted for the first time
+	encryptedStorage.AllowUnencrypted = true
+
+	report, err := ReencryptClipDirectory(ClipStorage)
+	if err != nil {
+		return err
+	}
+
+	if encryptedStorage.CurrentKey != nil {
+		fmt.Println("Encrypted", report.Rewritten, "object(s) with key", encryptedStorage.CurrentKey.ID()+",",
+			"relinked", report.Relinked, "clip(s) and version(s),", report.Unchanged, "object(s) unchanged")
+	} else {
+		fmt.Println("Decrypted", report.Rewritten, "object(s), relinked", report.Relinked, "clip(s) and version(s),",
+			report.Unchanged, "object(s) unchanged")
+	}
+
+	return nil
+}
+
+func createToken(c *cli.Context) error {
+	TokensFile = GetTokensFileFromEnv()
+	UsersFile = GetUsersFileFromEnv()
+
+	label := strings.TrimSpace(strings.Join(c.Args().Slice(), " "))
+	if label == "" {
+		return errors.New("Missing label of the token, like the name of the device")
+	}
+
+	scopes := make([]string, 0)
+	for _, s := range c.StringSlice("scope") {
+		for _, scope := range strings.Split(s, ",") {
+			scope = strings.TrimSpace(strings.ToLower(scope))
+			if !IsValidTokenScope(scope) {
+				return errors.New("Invalid scope '" + scope + "', use read, write, delete or admin")
+			}
+
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		// not the value of the flag, which keeps the parsed scopes after a run, like of a test
+		scopes = []string{"read", "write", "delete"}
+	}
+
+	var expiresAt int64
+	if c.Duration("ttl") < 0 {
+		return errors.New("Invalid value for ttl")
+	}
+	if c.Duration("ttl") > 0 {
+		expiresAt = time.Now().Add(c.Duration("ttl")).Unix()
+	}
+
+	// a shared token with the scope admin can manage bans, like CCLIP_PASSWORD
+	isAdmin := APIToken{Scopes: scopes}.HasScope("admin")
+
+	userName := strings.TrimSpace(c.String("user"))
+	if userName != "" {
+		users, err := ReadUsers()
+		if err != nil {
+			return err
+		}
+
+		var user *User
+		for i, u := range users {
+			if u.Name == userName {
+				user = &users[i]
+			}
+		}
+
+		if user == nil {
+			return errors.New("User " + userName + " does not exist")
+		}
+		if isAdmin && !user.IsAdmin() {
+			return errors.New("The scope admin requires an admin or the shared clips")
+		}
+	}
+
+	tokens, err := ReadAPITokens()
+	if err != nil {
+		return err
+	}
+
+	token, secret, err := CreateAPIToken(userName, label, scopes, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	err = WriteAPITokens(append(tokens, token))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Created token", token.ID, "with scopes", strings.Join(scopes, ",")+", it is not shown again:")
+	fmt.Println(secret)
+	return nil
+}
+
+func listTokens(c *cli.Context) error {
+	TokensFile = GetTokensFileFromEnv()
+
+	tokens, err := ReadAPITokens()
+	if err != nil {
+		return err
+	}
+
+	formatTime := func(t int64) string {
+		if t == 0 {
+			return "-"
+		}
+
+		return time.Unix(t, 0).Format(time.RFC3339)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tSCOPES\tEXPIRES\tLAST USED\tLABEL")
+	for _, t := range tokens {
+		userName := t.User
+		if userName == "" {
+			userName = "-"
+		}
+
+		fmt.Fprintln(w, strings.Join([]string{
+			t.ID, userName, strings.Join(t.Scopes, ","), formatTime(t.ExpiresAt), formatTime(t.LastUsed), t.Label,
+		}, "\t"))
+	}
+
+	return w.Flush()
+}
+
+func revokeToken(c *cli.Context) error {
+	TokensFile = GetTokensFileFromEnv()
+
+	id := strings.TrimSpace(c.Args().First())
+
+	tokens, err := ReadAPITokens()
+	if err != nil {
+		return err
+	}
+
+	for i, t := range tokens {
+		if t.ID != id {
+			continue
+		}
+
+		err = WriteAPITokens(append(tokens[:i], tokens[i+1:]...))
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Revoked token", id)
+		return nil
+	}
+
+	return errors.New("Token " + id + " does not exist")
+}
+
+func addUser(c *cli.Context) error {
+	UsersFile = GetUsersFileFromEnv()
+
+	name := strings.TrimSpace(c.Args().First())
+	if !IsValidUserName(name) {
+		return errors.New("Invalid user name '" + name + "', use lower case letters, digits, '-' and '_'")
+	}
+
+	users, err := ReadUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if u.Name == name {
+			return errors.New("User " + name + " already exists")
+		}
+	}
+
+	password, err := readNewPassword()
+	if err != nil {
+		return err
+	}
+
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	role := "user"
+	if c.Bool("admin") {
+		role = "admin"
+	}
+
+	err = WriteUsers(append(users, User{Name: name, PasswordHash: passwordHash, Role: role}))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Added", role, name, "to", UsersFile)
+	return nil
+}
+
+func listUsers(c *cli.Context) error {
+	UsersFile = GetUsersFileFromEnv()
+
+	users, err := ReadUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		fmt.Println(u.Name, u.Role)
+	}
+
+	return nil
+}
+
+func changeUserPassword(c *cli.Context) error {
+	UsersFile = GetUsersFileFromEnv()
+
+	name := strings.TrimSpace(c.Args().First())
+
+	users, err := ReadUsers()
+	if err != nil {
+		return err
+	}
+
+	for i, u := range users {
+		if u.Name != name {
+			continue
+		}
+
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+
+		passwordHash, err := HashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		users[i].PasswordHash = passwordHash
+
+		err = WriteUsers(users)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Changed password of user", name)
+		return nil
+	}
+
+	return errors.New("User " + name + " does not exist")
+}
+
+func removeUser(c *cli.Context) error {
+	UsersFile = GetUsersFileFromEnv()
+
+	name := strings.TrimSpace(c.Args().First())
+
+	users, err := ReadUsers()
+	if err != nil {
+		return err
+	}
+
+	for i, u := range users {
+		if u.Name != name {
+			continue
+		}
+
+		// the file is kept, so the server does not run without password
+		err = WriteUsers(append(users[:i], users[i+1:]...))
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Removed user", name)
+		return nil
+	}
+
+	return errors.New("User " + name + " does not exist")
+}
+
+// readNewPassword - Asks for a new password on the terminal, or reads it from the first line
+// of the standard input
+func readNewPassword() (string, error) {
+	var password string
+
+	stdin := int(os.Stdin.Fd())
+	if term.IsTerminal(stdin) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		passwordBytes, err := term.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprint(os.Stderr, "Repeat password: ")
+		repeatedBytes, err := term.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+
+		if string(passwordBytes) != string(repeatedBytes) {
+			return "", errors.New("Passwords do not match")
+		}
+
+		password = string(passwordBytes)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if password == "" {
+		return "", errors.New("The password must not be empty")
+	}
+
+	return password, nil
+}
+
+// openClipDirectoryStorage - Sets ClipStorage to the files inside ClipDirectory,
+// which are encrypted with the keys of the environment
+//
+// Without keys, encrypted files are still recognized, so they are not mistaken for broken ones.
+func openClipDirectoryStorage() (*EncryptedStorage, error) {
+	currentKey, oldKeys, err := LoadEncryptionKeysFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	allowUnencrypted, err := LoadAllowUnencryptedFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	ClipStorage = NewEncryptedStorage(NewFileStorage(ClipDirectory), currentKey, oldKeys)
+
+	encryptedStorage := GetEncryptedStorage(ClipStorage)
+	encryptedStorage.AllowUnencrypted = allowUnencrypted
+
+	return encryptedStorage, nil
+}
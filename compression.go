@@ -0,0 +1,273 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionCodec - The codec, compressible clips are stored with: "off", "gzip" or "zstd"
+var CompressionCodec = "off"
+
+// ErrUnknownEncoding - Is returned, if data has been stored with an unknown codec
+var ErrUnknownEncoding = errors.New("Unknown encoding")
+
+// AcceptsEncoding - Checks if a HTTP client accepts data, which is compressed with a codec
+func AcceptsEncoding(req *http.Request, encoding string) bool {
+	for _, header := range req.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			params := strings.Split(part, ";")
+
+			coding := strings.TrimSpace(strings.ToLower(params[0]))
+			if coding == "x-gzip" {
+				coding = "gzip"
+			}
+			if coding != encoding {
+				continue
+			}
+
+			for _, p := range params[1:] {
+				p = strings.TrimSpace(strings.ToLower(p))
+				if strings.HasPrefix(p, "q=") {
+					q, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64)
+					if err != nil || q <= 0 {
+						return false
+					}
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// CompressClipData - Compresses the temporary file of a clip with CompressionCodec,
+// if its MIME type is compressible, and returns the file, which should be stored
+//
+// Encoding and Size of the meta data are updated. If the returned file is not tmpFile,
+// the caller has to remove it.
+func CompressClipData(tmpFile string, clipMeta *clipMetaData) (string, error) {
+	clipMeta.Encoding = ""
+	clipMeta.Size = 0
+
+	if CompressionCodec == "off" || !IsCompressibleMIME(clipMeta.MIME) {
+		return tmpFile, nil
+	}
+
+	src, err := os.Open(tmpFile)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	srcStat, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// same device as the final file, s. ReceiveClipData()
+	dest, err := ioutil.TempFile(ClipDirectory, ".upload-")
+	if err != nil {
+		return "", err
+	}
+
+	encoder, err := newEncoder(CompressionCodec, dest)
+	if err == nil {
+		_, err = io.Copy(encoder, src)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = dest.Sync()
+	}
+
+	var destStat os.FileInfo
+	if err == nil {
+		destStat, err = dest.Stat()
+	}
+	dest.Close()
+
+	if err != nil || destStat.Size() >= srcStat.Size() {
+		// not worth it
+		os.Remove(dest.Name())
+
+		return tmpFile, err
+	}
+
+	clipMeta.Encoding = CompressionCodec
+	clipMeta.Size = srcStat.Size()
+
+	return dest.Name(), nil
+}
+
+// IsCompressibleMIME - Checks if data of a MIME type is worth to be compressed
+func IsCompressibleMIME(mime string) bool {
+	mime = strings.TrimSpace(strings.ToLower(strings.Split(mime, ";")[0]))
+
+	if strings.HasPrefix(mime, "text/") ||
+		strings.HasSuffix(mime, "+json") ||
+		strings.HasSuffix(mime, "+xml") {
+		return true
+	}
+
+	switch mime {
+	case "application/javascript",
+		"application/json",
+		"application/sql",
+		"application/x-ndjson",
+		"application/x-sh",
+		"application/x-www-form-urlencoded",
+		"application/x-yaml",
+		"application/xml",
+		"application/yaml":
+		return true
+	}
+
+	return false
+}
+
+// NewDecoder - Returns a reader, which decompresses data, that has been stored with a codec
+func NewDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.IOReadCloser(), nil
+	}
+
+	return nil, ErrUnknownEncoding
+}
+
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+
+	return nil, ErrUnknownEncoding
+}
+
+// decodingReadSeeker - Decompresses data and supports seeking by decompressing
+// it again from the beginning or skipping data, s. http.ServeContent()
+type decodingReadSeeker struct {
+	src      io.ReadSeeker
+	encoding string
+	// size of the decompressed data
+	size int64
+
+	decoder io.ReadCloser
+	// position of decoder
+	decoderPos int64
+	pos        int64
+}
+
+// NewDecodingReadSeeker - Returns a seekable reader of the decompressed data of a clip
+func NewDecodingReadSeeker(src io.ReadSeeker, encoding string, size int64) io.ReadSeekCloser {
+	return &decodingReadSeeker{
+		src:      src,
+		encoding: encoding,
+		size:     size,
+	}
+}
+
+func (d *decodingReadSeeker) Read(p []byte) (int, error) {
+	if d.decoder == nil || d.pos < d.decoderPos {
+		err := d.reset()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d.pos > d.decoderPos {
+		skipped, err := io.CopyN(ioutil.Discard, d.decoder, d.pos-d.decoderPos)
+		d.decoderPos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := d.decoder.Read(p)
+	d.decoderPos += int64(n)
+	d.pos = d.decoderPos
+
+	return n, err
+}
+
+func (d *decodingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += d.pos
+	case io.SeekEnd:
+		pos += d.size
+	}
+
+	if pos < 0 {
+		return d.pos, errors.New("Negative position")
+	}
+
+	// data is decompressed, not before it is read
+	d.pos = pos
+	return pos, nil
+}
+
+func (d *decodingReadSeeker) reset() error {
+	if d.decoder != nil {
+		d.decoder.Close()
+		d.decoder = nil
+	}
+
+	_, err := d.src.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	d.decoder, err = NewDecoder(d.encoding, d.src)
+	d.decoderPos = 0
+
+	return err
+}
+
+// Close - Releases the decoder, but not the source
+func (d *decodingReadSeeker) Close() error {
+	if d.decoder != nil {
+		return d.decoder.Close()
+	}
+
+	return nil
+}
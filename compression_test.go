@@ -0,0 +1,121 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompressedClips(t *testing.T) {
+	text := strings.Repeat("compressible text ", 1000)
+
+	for _, codec := range []string{"gzip", "zstd"} {
+		t.Run(codec, func(t *testing.T) {
+			server := newTestServer(t)
+			CompressionCodec = codec
+
+			clip := server.upload(text, "Content-Type", "text/plain")
+			if clip.Encoding != codec || clip.Size != int64(len(text)) || clip.StoredSize >= clip.Size {
+				t.Fatalf("unexpected clip %+v", clip)
+			}
+
+			resp, data := server.do("GET", "/clips/"+clip.ID, "", "Accept-Encoding", "identity")
+			if resp.StatusCode != 200 || data != text || resp.Header.Get("Content-Encoding") != "" {
+				t.Errorf("unexpected response %d %v", resp.StatusCode, resp.Header)
+			}
+			if resp.ContentLength != int64(len(text)) || resp.Header.Get("Vary") != "Accept-Encoding" {
+				t.Errorf("unexpected headers %v", resp.Header)
+			}
+			identityETag := resp.Header.Get("ETag")
+
+			// sent as it is stored
+			resp, data = server.do("GET", "/clips/"+clip.ID, "", "Accept-Encoding", codec+", br")
+			if resp.StatusCode != 200 || resp.Header.Get("Content-Encoding") != codec || int64(len(data)) != clip.StoredSize {
+				t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+			}
+			if resp.Header.Get("ETag") == identityETag {
+				t.Error("compressed data has the entity tag of the decompressed one")
+			}
+
+			decoder, err := NewDecoder(codec, strings.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := ioutil.ReadAll(decoder)
+			decoder.Close()
+			if err != nil || string(decoded) != text {
+				t.Errorf("decoded data differs (%v)", err)
+			}
+
+			// ranges of the decompressed data
+			resp, data = server.do("GET", "/clips/"+clip.ID, "", "Accept-Encoding", codec+";q=0", "Range", "bytes=9000-9011")
+			if resp.StatusCode != 206 || data != text[9000:9012] || resp.Header.Get("Content-Encoding") != "" {
+				t.Errorf("unexpected range %d %q", resp.StatusCode, data)
+			}
+
+			// replaced data is compressed as well
+			server.expectStatus(200, "PUT", "/clips/"+clip.ID, text+"v2", "Content-Type", "text/plain")
+			if data := server.expectStatus(200, "GET", "/clips/"+clip.ID, "", "Accept-Encoding", "identity"); data != text+"v2" {
+				t.Errorf("replaced clip contains %d bytes", len(data))
+			}
+			if data := server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions/1", "", "Accept-Encoding", "identity"); data != text {
+				t.Errorf("version contains %d bytes", len(data))
+			}
+
+			// not worth it
+			for _, c := range []uploadFileResponse{
+				server.upload(text, "Content-Type", "application/octet-stream"),
+				server.upload("short", "Content-Type", "text/plain"),
+			} {
+				if c.Encoding != "" || c.StoredSize != c.Size {
+					t.Errorf("unexpected clip %+v", c)
+				}
+			}
+		})
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		encoding string
+		accepts  bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"deflate, GZIP", "gzip", true},
+		{"x-gzip", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip; q=0.5", "gzip", true},
+		{"gzip", "zstd", false},
+		{"br, zstd", "zstd", true},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			req.Header.Set("Accept-Encoding", test.header)
+		}
+
+		if accepts := AcceptsEncoding(req, test.encoding); accepts != test.accepts {
+			t.Errorf("%q accepts %s: %v", test.header, test.encoding, accepts)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// DedupMode - The mode for deduplication of identical uploads:
+// "off", "link" (new clip, which shares the data with existing ones)
+// or "reuse" (return the existing clip)
+var DedupMode = "off"
+
+// BlobDirectoryName - The name of the "directory" inside ClipStorage, which stores shared data
+const BlobDirectoryName = "blobs"
+
+// FindClipByHash - Returns an active clip of a user, which has the data with a specific SHA-256 hash
+func FindClipByHash(hash string, userName string) (ClipFile, bool) {
+	if hash == "" {
+		return ClipFile{}, false
+	}
+
+	var clip ClipFile
+	var found bool
+
+	now := time.Now()
+	ClipIndex.Each(func(entry ClipIndexEntry) bool {
+		if entry.Meta.SHA256 == hash && !entry.Meta.Burn && !entry.Meta.IsExpired(now) && entry.Clip.User() == userName {
+			clip = entry.Clip
+			found = true
+		}
+
+		return !found
+	})
+
+	return clip, found
+}
+
+// GetBlobFile - Returns the key of the shared data object of a SHA-256 hash,
+// which is suffixed with the codec of compressed data, s. clipMetaData.BlobID()
+func GetBlobFile(hash string) string {
+	return path.Join(BlobDirectoryName, hash)
+}
+
+// NewBlobID - Returns the ID of the shared data object for data with a SHA-256 hash and codec,
+// if it is not derived from the hash, s. clipMetaData.BlobID()
+//
+// With encryption, it is a keyed hash, so the names of shared data objects
+// do not reveal the hashes of the data.
+func NewBlobID(hash string, encoding string) string {
+	s := GetEncryptedStorage(ClipStorage)
+	if s == nil || s.CurrentKey == nil || hash == "" {
+		return ""
+	}
+
+	return s.CurrentKey.BlobID(hash, encoding)
+}
+
+// HashFile - Returns the SHA-256 hash of a file as hex string
+func HashFile(file string) (string, error) {
+	return HashEncodedFile(file, "")
+}
+
+// HashEncodedFile - Returns the SHA-256 hash of the decompressed data of a file as hex string
+func HashEncodedFile(file string, encoding string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return hashEncodedData(f, encoding)
+}
+
+// HashObject - Returns the SHA-256 hash of the decrypted and decompressed data
+// of an object of ClipStorage as hex string
+func HashObject(key string, encoding string) (string, error) {
+	obj, err := ClipStorage.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+
+	return hashEncodedData(obj, encoding)
+}
+
+func hashEncodedData(r io.Reader, encoding string) (string, error) {
+	decoder, err := NewDecoder(encoding, r)
+	if err != nil {
+		return "", err
+	}
+	defer decoder.Close()
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, decoder)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ReleaseBlob - Deletes the shared data object of a SHA-256 hash,
+// if no clip or version references it anymore
+func ReleaseBlob(hash string) error {
+	if hash == "" {
+		return nil
+	}
+
+	unlock := LockBlob(hash)
+	defer unlock()
+
+	return releaseBlob(hash)
+}
+
+// releaseBlob - Implements ReleaseBlob(), the caller has to hold the lock of the blob
+func releaseBlob(hash string) error {
+	blobFile := GetBlobFile(hash)
+
+	blobStat, err := ClipStorage.Stat(blobFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	// 0 means unknown
+	if blobStat.Links != 1 {
+		return nil
+	}
+
+	return ClipStorage.Delete(blobFile)
+}
+
+// ReleaseUnusedBlobs - Deletes all shared data objects, which are not referenced anymore
+func ReleaseUnusedBlobs() error {
+	objects, err := ClipStorage.List(BlobDirectoryName + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		if o.Links == 1 {
+			err := ClipStorage.Delete(o.Key)
+			if err != nil {
+				return err
+			}
+
+			log.Println("Deleted unused blob", path.Base(o.Key))
+		}
+	}
+
+	return nil
+}
+
+// StoreClipData - Moves a temporary file with the data of a clip into ClipStorage
+//
+// If deduplication is enabled and supported by the storage, the clip becomes a link
+// to the shared data object of blobID, s. clipMetaData.BlobID(), so identical data is stored only once.
+func StoreClipData(tmpFile string, blobID string, clipFile string) error {
+	linker, ok := ClipStorage.(StorageLinker)
+	if !ok || DedupMode == "off" || blobID == "" {
+		return ClipStorage.PutFile(clipFile, tmpFile)
+	}
+
+	unlock := LockBlob(blobID)
+	defer unlock()
+
+	blobFile := GetBlobFile(blobID)
+
+	_, err := ClipStorage.Stat(blobFile)
+	if os.IsNotExist(err) {
+		err = ClipStorage.PutFile(blobFile, tmpFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the number of links is the reference counter
+	err = linker.Link(blobFile, clipFile)
+	if err != nil {
+		log.Println("[WARN] Could not link blob", blobID, err.Error())
+
+		// fallback: store a copy
+		err = CopyObject(blobFile, clipFile)
+		releaseBlob(blobID)
+	}
+
+	return err
+}
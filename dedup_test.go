@@ -0,0 +1,144 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// dedupTestStorages - Storages with links, as reference counters of shared data
+var dedupTestStorages = map[string]func(t *testing.T) Storage{
+	"fs": func(t *testing.T) Storage {
+		return NewFileStorage(ClipDirectory)
+	},
+	"memory": func(t *testing.T) Storage {
+		return NewMemoryStorage()
+	},
+}
+
+// blobLinks - Returns the number of links of the shared data of a hash, or 0, if it does not exist
+func blobLinks(t *testing.T, hash string) int {
+	t.Helper()
+
+	info, err := ClipStorage.Stat(GetBlobFile(hash))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info.Links
+}
+
+func TestDedupLinks(t *testing.T) {
+	for name, newStorage := range dedupTestStorages {
+		t.Run(name, func(t *testing.T) {
+			server := newTestServer(t)
+			ClipStorage = newStorage(t)
+			DedupMode = "link"
+
+			first := server.upload("shared", "Content-Type", "text/plain")
+			second := server.upload("shared", "Content-Type", "text/plain")
+			if first.ID == second.ID || first.SHA256 != second.SHA256 {
+				t.Fatalf("unexpected clips %+v and %+v", first, second)
+			}
+
+			// blob and 2 clips
+			if links := blobLinks(t, first.SHA256); links != 3 {
+				t.Fatalf("blob has %d links", links)
+			}
+
+			// the old data is kept as version
+			replaced := server.upload("other", "Content-Type", "text/plain")
+			server.expectStatus(200, "PUT", "/clips/"+second.ID, "other", "Content-Type", "text/plain")
+			if links := blobLinks(t, first.SHA256); links != 3 {
+				t.Errorf("blob has %d links after replacement", links)
+			}
+			if links := blobLinks(t, replaced.SHA256); links != 3 {
+				t.Errorf("new blob has %d links after replacement", links)
+			}
+
+			server.expectStatus(204, "DELETE", "/clips/"+first.ID, "")
+			if links := blobLinks(t, first.SHA256); links != 2 {
+				t.Errorf("blob has %d links after deletion", links)
+			}
+			if data := server.expectStatus(200, "GET", "/clips/"+second.ID+"/versions/1", ""); data != "shared" {
+				t.Errorf("version contains %q", data)
+			}
+
+			// the last reference releases the blob
+			server.expectStatus(204, "DELETE", "/clips/"+second.ID, "")
+			if links := blobLinks(t, first.SHA256); links != 0 {
+				t.Errorf("blob has %d links after deletion of all clips", links)
+			}
+			if links := blobLinks(t, replaced.SHA256); links != 2 {
+				t.Errorf("new blob has %d links after deletion", links)
+			}
+		})
+	}
+}
+
+func TestDedupReuse(t *testing.T) {
+	server := newTestServer(t)
+	DedupMode = "reuse"
+
+	first := server.upload("same", "Content-Type", "text/plain")
+
+	var existing uploadFileResponse
+	json.Unmarshal([]byte(server.expectStatus(200, "POST", "/clips", "same", "Content-Type", "text/plain")), &existing)
+	if existing.ID != first.ID || ClipIndex.Count() != 1 {
+		t.Errorf("clip %+v has been uploaded again", existing)
+	}
+
+	// burned clips are never reused
+	burned := server.upload("same", "Content-Type", "text/plain", "X-Cclip-Burn", "true")
+	if burned.ID == first.ID {
+		t.Error("clip has been reused for a burn clip")
+	}
+}
+
+func TestReleaseUnusedBlobs(t *testing.T) {
+	for name, newStorage := range dedupTestStorages {
+		t.Run(name, func(t *testing.T) {
+			server := newTestServer(t)
+			ClipStorage = newStorage(t)
+			DedupMode = "link"
+
+			used := server.upload("used", "Content-Type", "text/plain")
+
+			// left by a crash between storing the blob and linking the clip
+			unused := "0000000000000000000000000000000000000000000000000000000000000000"
+			if err := WriteObject(GetBlobFile(unused), []byte("unused")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ReleaseUnusedBlobs(); err != nil {
+				t.Fatal(err)
+			}
+
+			if links := blobLinks(t, unused); links != 0 {
+				t.Errorf("unused blob has %d links", links)
+			}
+			if links := blobLinks(t, used.SHA256); links != 2 {
+				t.Errorf("used blob has %d links", links)
+			}
+		})
+	}
+}
@@ -0,0 +1,463 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Encrypted objects start with a header, followed by chunks of at most encryptionChunkSize bytes,
+// which are sealed with AES-256-GCM:
+//
+//	"CCLIPENC" | version (1 byte) | key ID (8 bytes) | salt (32 bytes) | chunk | chunk | ...
+//
+// Each object has its own key, which is derived from the master key and the random salt.
+// The nonce of a chunk is its index, and a flag for the last chunk, so chunks can neither be
+// reordered nor truncated. The header is authenticated with every chunk.
+const (
+	encryptionChunkSize  = 64 * 1024
+	encryptionHeaderSize = 8 + 1 + 8 + 32
+	encryptionMagic      = "CCLIPENC"
+	encryptionVersion    = 1
+	encryptionTagSize    = 16
+)
+
+// ErrDecryptionFailed - Is returned, if encrypted data has been modified or is incomplete
+var ErrDecryptionFailed = errors.New("Decryption failed")
+
+// ErrUnknownEncryptionKey - Is returned, if data has been encrypted with a key, which is not known
+var ErrUnknownEncryptionKey = errors.New("Data has been encrypted with an unknown key")
+
+// ErrNotEncrypted - Is returned, if data, which should be encrypted, has been stored unencrypted,
+// s. EncryptedStorage.AllowUnencrypted
+var ErrNotEncrypted = errors.New("Data is not encrypted")
+
+// EncryptionKey - A master key for the encryption at rest
+type EncryptionKey struct {
+	id  []byte
+	key []byte
+}
+
+// ParseEncryptionKey - Parses a 256 bit key, which is encoded as hex or base64 string
+func ParseEncryptionKey(s string) (*EncryptionKey, error) {
+	s = strings.TrimSpace(s)
+
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("Encryption key must be 32 bytes, encoded as hex or base64 string")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("cclip key id"))
+
+	return &EncryptionKey{id: mac.Sum(nil)[:8], key: key}, nil
+}
+
+// BlobID - Returns a keyed hash of the SHA-256 hash and codec of data, which is used
+// as the ID of its shared data object, s. NewBlobID()
+func (k *EncryptionKey) BlobID(hash string, encoding string) string {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write([]byte("cclip blob id\n" + hash + "\n" + encoding))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ID - Returns the ID of the key, which is stored in the header of encrypted objects
+func (k *EncryptionKey) ID() string {
+	return hex.EncodeToString(k.id)
+}
+
+// LoadAllowUnencryptedFromEnv - Returns, if unencrypted objects can still be read with
+// an encryption key, from CCLIP_ENCRYPTION_ALLOW_UNENCRYPTED
+func LoadAllowUnencryptedFromEnv() (bool, error) {
+	value := strings.TrimSpace(os.Getenv("CCLIP_ENCRYPTION_ALLOW_UNENCRYPTED"))
+	if value == "" {
+		return false, nil
+	}
+
+	allow, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("Invalid value for CCLIP_ENCRYPTION_ALLOW_UNENCRYPTED")
+	}
+
+	return allow, nil
+}
+
+// LoadEncryptionKeysFromEnv - Returns the current key from CCLIP_ENCRYPTION_KEY or
+// CCLIP_ENCRYPTION_KEY_FILE, and old keys from CCLIP_ENCRYPTION_OLD_KEYS or
+// CCLIP_ENCRYPTION_OLD_KEYS_FILE, which are only used for decryption
+func LoadEncryptionKeysFromEnv() (*EncryptionKey, []*EncryptionKey, error) {
+	currentKeys, err := loadEncryptionKeysFromEnv("CCLIP_ENCRYPTION_KEY", ",")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(currentKeys) > 1 {
+		return nil, nil, errors.New("CCLIP_ENCRYPTION_KEY must contain one key only")
+	}
+
+	oldKeys, err := loadEncryptionKeysFromEnv("CCLIP_ENCRYPTION_OLD_KEYS", ",")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var currentKey *EncryptionKey
+	if len(currentKeys) > 0 {
+		currentKey = currentKeys[0]
+	}
+
+	return currentKey, oldKeys, nil
+}
+
+func loadEncryptionKeysFromEnv(name string, separator string) ([]*EncryptionKey, error) {
+	keys := make([]*EncryptionKey, 0)
+
+	value := os.Getenv(name)
+	if file := strings.TrimSpace(os.Getenv(name + "_FILE")); file != "" {
+		if strings.TrimSpace(value) != "" {
+			return keys, errors.New(name + " and " + name + "_FILE cannot be used together")
+		}
+
+		fileBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return keys, err
+		}
+
+		// one key per line
+		value = strings.ReplaceAll(string(fileBytes), "\n", separator)
+	}
+
+	for _, s := range strings.Split(value, separator) {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		key, err := ParseEncryptionKey(s)
+		if err != nil {
+			return keys, errors.New("Invalid value for " + name + ": " + err.Error())
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// encryptedSize - Returns the size of the encrypted object of plain data
+func encryptedSize(size int64) int64 {
+	chunks := (size + encryptionChunkSize - 1) / encryptionChunkSize
+	if chunks == 0 {
+		// the last chunk is always written
+		chunks = 1
+	}
+
+	return encryptionHeaderSize + size + chunks*encryptionTagSize
+}
+
+// decryptedSize - Returns the size of the plain data of an encrypted object
+func decryptedSize(size int64) (int64, bool) {
+	body := size - encryptionHeaderSize
+	if body < encryptionTagSize {
+		return 0, false
+	}
+
+	chunks := (body + encryptionChunkSize + encryptionTagSize - 1) / (encryptionChunkSize + encryptionTagSize)
+	plainSize := body - chunks*encryptionTagSize
+
+	return plainSize, encryptedSize(plainSize) == size
+}
+
+func newObjectCipher(key *EncryptionKey, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key.key)
+	mac.Write([]byte("cclip object key"))
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// encryptingWriter - Encrypts all written data and writes it to another writer
+type encryptingWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	// plain data of the current chunk, which is not known to be the last one yet
+	chunk []byte
+	index int64
+}
+
+// newEncryptingWriter - Writes the header of an encrypted object and returns a writer
+// for its data, which has to be closed to write the last chunk
+func newEncryptingWriter(w io.Writer, key *EncryptionKey) (io.WriteCloser, error) {
+	salt := make([]byte, 32)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newObjectCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionVersion)
+	header = append(header, key.id...)
+	header = append(header, salt...)
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.chunk) == encryptionChunkSize {
+			// there is more data, so the chunk is not the last one
+			err := e.writeChunk(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.chunk[len(e.chunk):encryptionChunkSize], p)
+		e.chunk = e.chunk[:len(e.chunk)+n]
+
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close - Writes the last chunk, but does not close the underlying writer
+func (e *encryptingWriter) Close() error {
+	return e.writeChunk(true)
+}
+
+func (e *encryptingWriter) writeChunk(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.index, last), e.chunk, e.header)
+
+	_, err := e.w.Write(sealed)
+	if err != nil {
+		return err
+	}
+
+	e.chunk = e.chunk[:0]
+	e.index++
+
+	return nil
+}
+
+// decryptingReader - Decrypts an encrypted object and supports seeking,
+// by decrypting only the chunk at the new position
+type decryptingReader struct {
+	src    io.ReadSeeker
+	aead   cipher.AEAD
+	header []byte
+	size   int64
+
+	// position of src
+	srcPos int64
+	pos    int64
+
+	chunk      []byte
+	chunkIndex int64
+}
+
+// readEncryptionHeader - Reads the header of an object, and returns nil, if it is not encrypted
+func readEncryptionHeader(src io.ReadSeeker) ([]byte, error) {
+	header := make([]byte, encryptionHeaderSize)
+
+	n, err := io.ReadFull(src, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && !bytes.HasPrefix(header, []byte(encryptionMagic))) {
+		// plain data, like of clips, which have been stored before encryption has been enabled
+		_, err = src.Seek(int64(-n), io.SeekCurrent)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if header[len(encryptionMagic)] != encryptionVersion {
+		return nil, ErrDecryptionFailed
+	}
+
+	return header, nil
+}
+
+// newDecryptingReader - Returns a reader of the plain data of an encrypted object,
+// after its header has been read
+func newDecryptingReader(src io.ReadSeeker, header []byte, encryptedSize int64, keys []*EncryptionKey) (*decryptingReader, error) {
+	size, ok := decryptedSize(encryptedSize)
+	if !ok {
+		return nil, ErrDecryptionFailed
+	}
+
+	keyID := header[len(encryptionMagic)+1 : len(encryptionMagic)+9]
+	salt := header[len(encryptionMagic)+9:]
+
+	for _, k := range keys {
+		if !bytes.Equal(k.id, keyID) {
+			continue
+		}
+
+		aead, err := newObjectCipher(k, salt)
+		if err != nil {
+			return nil, err
+		}
+
+		return &decryptingReader{
+			src:        src,
+			aead:       aead,
+			header:     header,
+			size:       size,
+			srcPos:     encryptionHeaderSize,
+			chunkIndex: -1,
+		}, nil
+	}
+
+	return nil, ErrUnknownEncryptionKey
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+
+	index := d.pos / encryptionChunkSize
+	if index != d.chunkIndex {
+		err := d.readChunk(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.chunk[d.pos-index*encryptionChunkSize:])
+	d.pos += int64(n)
+
+	return n, nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += d.pos
+	case io.SeekEnd:
+		pos += d.size
+	}
+
+	if pos < 0 {
+		return d.pos, errors.New("Negative position")
+	}
+
+	// decrypted, not before it is read
+	d.pos = pos
+	return pos, nil
+}
+
+func (d *decryptingReader) readChunk(index int64) error {
+	chunkPos := encryptionHeaderSize + index*(encryptionChunkSize+encryptionTagSize)
+	if chunkPos != d.srcPos {
+		_, err := d.src.Seek(chunkPos, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		d.srcPos = chunkPos
+	}
+
+	lastIndex := (d.size - 1) / encryptionChunkSize
+	if d.size == 0 {
+		lastIndex = 0
+	}
+
+	sealedSize := int64(encryptionChunkSize + encryptionTagSize)
+	if index == lastIndex {
+		sealedSize = d.size - index*encryptionChunkSize + encryptionTagSize
+	}
+
+	sealed := make([]byte, sealedSize)
+
+	n, err := io.ReadFull(d.src, sealed)
+	d.srcPos += int64(n)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrDecryptionFailed
+		}
+
+		return err
+	}
+
+	d.chunk, err = d.aead.Open(d.chunk[:0], chunkNonce(index, index == lastIndex), sealed, d.header)
+	if err != nil {
+		d.chunkIndex = -1
+		return ErrDecryptionFailed
+	}
+
+	d.chunkIndex = index
+	return nil
+}
+
+// IsEncryptionError - Checks if data could not be decrypted
+func IsEncryptionError(err error) bool {
+	return errors.Is(err, ErrDecryptionFailed) || errors.Is(err, ErrUnknownEncryptionKey) || errors.Is(err, ErrNotEncrypted)
+}
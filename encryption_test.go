@@ -0,0 +1,252 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testEncryptionKey = "5d2c0c7e8f0b4a1e9d3f6a7b8c9d0e1f2a3b4c5d6e7f8091a2b3c4d5e6f70812"
+const otherTestEncryptionKey = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+
+func parseTestEncryptionKey(t *testing.T, s string) *EncryptionKey {
+	t.Helper()
+
+	key, err := ParseEncryptionKey(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// readRawFile - Reads a file of ClipDirectory, as it is stored
+func readRawFile(t *testing.T, file string) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join(ClipDirectory, filepath.FromSlash(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestEncryptedClips(t *testing.T) {
+	text := strings.Repeat("secret text ", 10000)
+
+	for _, codec := range []string{"off", "gzip"} {
+		t.Run(codec, func(t *testing.T) {
+			server := newTestServer(t)
+			ClipStorage = NewEncryptedStorage(ClipStorage, parseTestEncryptionKey(t, testEncryptionKey), nil)
+			CompressionCodec = codec
+
+			clip := server.upload(text, "Content-Type", "text/plain", "X-Cclip-Name", "secret name")
+			if clip.Size != int64(len(text)) {
+				t.Errorf("unexpected clip %+v", clip)
+			}
+
+			for _, file := range []string{clip.ID, clip.ID + ".meta"} {
+				raw := readRawFile(t, file)
+				if !bytes.HasPrefix(raw, []byte(encryptionMagic)) || bytes.Contains(raw, []byte("secret")) {
+					t.Errorf("%s is not encrypted", file)
+				}
+			}
+
+			if data := server.expectStatus(200, "GET", "/clips/"+clip.ID, "", "Accept-Encoding", "identity"); data != text {
+				t.Errorf("clip contains %d bytes", len(data))
+			}
+
+			// across chunks
+			resp, data := server.do("GET", "/clips/"+clip.ID, "", "Accept-Encoding", "identity", "Range", "bytes=65530-65549")
+			if resp.StatusCode != 206 || data != text[65530:65550] {
+				t.Errorf("unexpected range %d %q", resp.StatusCode, data)
+			}
+
+			server.expectStatus(200, "PUT", "/clips/"+clip.ID, "replaced secret", "Content-Type", "text/plain")
+			if data := server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions/1", "", "Accept-Encoding", "identity"); data != text {
+				t.Errorf("version contains %d bytes", len(data))
+			}
+			if raw := readRawFile(t, clip.ID+".versions/1.meta"); bytes.Contains(raw, []byte("secret")) {
+				t.Error("meta data of version is not encrypted")
+			}
+		})
+	}
+}
+
+func TestEncryptedBlobIDs(t *testing.T) {
+	server := newTestServer(t)
+	key := parseTestEncryptionKey(t, testEncryptionKey)
+	ClipStorage = NewEncryptedStorage(ClipStorage, key, nil)
+	DedupMode = "link"
+
+	// encrypted as well
+	if err := SaveSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	first := server.upload("shared secret", "Content-Type", "text/plain")
+	second := server.upload("shared secret", "Content-Type", "text/plain")
+
+	// the hash of the data is not revealed
+	if _, err := os.Stat(filepath.Join(ClipDirectory, BlobDirectoryName, first.SHA256)); !os.IsNotExist(err) {
+		t.Errorf("blob is named by the hash of its data (%v)", err)
+	}
+
+	blobID := key.BlobID(first.SHA256, "")
+	if links := blobLinks(t, blobID); links != 3 {
+		t.Fatalf("blob has %d links", links)
+	}
+	if blobID == key.BlobID(first.SHA256, "gzip") || blobID == parseTestEncryptionKey(t, otherTestEncryptionKey).BlobID(first.SHA256, "") {
+		t.Error("blob IDs do not depend on codec and key")
+	}
+
+	report, err := CheckClipDirectory(false, nil)
+	if err != nil || len(report.Problems) != 0 || report.Blobs != 1 {
+		t.Errorf("unexpected report %+v (%v)", report, err)
+	}
+
+	server.expectStatus(204, "DELETE", "/clips/"+first.ID, "")
+	server.expectStatus(204, "DELETE", "/clips/"+second.ID, "")
+	if links := blobLinks(t, blobID); links != 0 {
+		t.Errorf("blob has %d links after deletion", links)
+	}
+}
+
+func TestUnencryptedObjects(t *testing.T) {
+	resetTestSettings(t)
+
+	plain := NewFileStorage(ClipDirectory)
+	if err := plain.Put("plain", strings.NewReader("unencrypted")); err != nil {
+		t.Fatal(err)
+	}
+
+	key := parseTestEncryptionKey(t, testEncryptionKey)
+
+	read := func(storage Storage) (string, error) {
+		obj, err := storage.Get("plain")
+		if err != nil {
+			return "", err
+		}
+		defer obj.Close()
+
+		data, err := ioutil.ReadAll(obj)
+		return string(data), err
+	}
+
+	if _, err := read(NewEncryptedStorage(plain, key, nil)); !IsEncryptionError(err) {
+		t.Errorf("unencrypted object has been read (%v)", err)
+	}
+	if _, err := NewEncryptedStorage(plain, key, nil).Stat("plain"); !IsEncryptionError(err) {
+		t.Errorf("unencrypted object has been found (%v)", err)
+	}
+
+	// while clips are migrated
+	allowing := NewEncryptedStorage(plain, key, nil)
+	GetEncryptedStorage(allowing).AllowUnencrypted = true
+	if data, err := read(allowing); err != nil || data != "unencrypted" {
+		t.Errorf("read %q (%v)", data, err)
+	}
+
+	// without current key, new objects are unencrypted as well
+	if data, err := read(NewEncryptedStorage(plain, nil, []*EncryptionKey{key})); err != nil || data != "unencrypted" {
+		t.Errorf("read %q (%v)", data, err)
+	}
+}
+
+func TestEncryptionKeys(t *testing.T) {
+	resetTestSettings(t)
+
+	plain := NewFileStorage(ClipDirectory)
+	oldKey := parseTestEncryptionKey(t, testEncryptionKey)
+	newKey := parseTestEncryptionKey(t, otherTestEncryptionKey)
+
+	if err := NewEncryptedStorage(plain, oldKey, nil).Put("object", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := NewEncryptedStorage(plain, newKey, []*EncryptionKey{oldKey})
+	if keyID, err := GetEncryptedStorage(rotated).KeyID("object"); err != nil || keyID != oldKey.ID() {
+		t.Errorf("object has been encrypted with key %q (%v)", keyID, err)
+	}
+
+	ClipStorage = rotated
+	if data, err := ReadObject("object"); err != nil || string(data) != "data" {
+		t.Errorf("read %q (%v)", data, err)
+	}
+
+	ClipStorage = NewEncryptedStorage(plain, newKey, nil)
+	if _, err := ReadObject("object"); !IsEncryptionError(err) {
+		t.Errorf("object has been read with a wrong key (%v)", err)
+	}
+
+	// modified
+	raw := readRawFile(t, "object")
+	raw[len(raw)-1] ^= 1
+	if err := ioutil.WriteFile(filepath.Join(ClipDirectory, "object"), raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ClipStorage = NewEncryptedStorage(plain, oldKey, nil)
+	if _, err := ReadObject("object"); !IsEncryptionError(err) {
+		t.Errorf("modified object has been read (%v)", err)
+	}
+}
+
+func TestReencryptClipDirectory(t *testing.T) {
+	server := newTestServer(t)
+	DedupMode = "link"
+
+	// stored before encryption has been enabled
+	first := server.upload("old secret", "Content-Type", "text/plain")
+	second := server.upload("old secret", "Content-Type", "text/plain")
+
+	key := parseTestEncryptionKey(t, testEncryptionKey)
+	storage := NewEncryptedStorage(NewFileStorage(ClipDirectory), key, nil)
+	GetEncryptedStorage(storage).AllowUnencrypted = true
+	ClipStorage = storage
+
+	report, err := ReencryptClipDirectory(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rewritten == 0 || report.Relinked != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	// unencrypted objects are not accepted anymore
+	GetEncryptedStorage(storage).AllowUnencrypted = false
+	if err := ClipIndex.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []uploadFileResponse{first, second} {
+		if raw := readRawFile(t, c.ID); !bytes.HasPrefix(raw, []byte(encryptionMagic)) {
+			t.Errorf("clip %s has not been encrypted", c.ID)
+		}
+		if data := server.expectStatus(200, "GET", "/clips/"+c.ID, ""); data != "old secret" {
+			t.Errorf("clip contains %q", data)
+		}
+	}
+	if links := blobLinks(t, first.SHA256); links != 3 {
+		t.Errorf("blob has %d links", links)
+	}
+}
@@ -0,0 +1,84 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// ReapExpiredClips - Deletes all clips, which have been expired
+func ReapExpiredClips() (int, error) {
+	now := time.Now()
+
+	expiredClips := make([]ClipFile, 0)
+	ClipIndex.Each(func(entry ClipIndexEntry) bool {
+		if entry.Meta.IsExpired(now) {
+			expiredClips = append(expiredClips, entry.Clip)
+		}
+
+		return true
+	})
+
+	deleted := 0
+	for _, c := range expiredClips {
+		unlock := LockClip(c.id)
+
+		// extended by another request in the meantime
+		clipMeta, err := c.ReadMeta()
+		if err == nil && !clipMeta.IsExpired(time.Now()) {
+			err = ClipIndex.Refresh(c.id)
+			unlock()
+
+			if err != nil {
+				log.Println("[WARN] Could not refresh extended clip", c.id, err.Error())
+			}
+			continue
+		}
+
+		err = c.Delete()
+		unlock()
+
+		if os.IsNotExist(err) {
+			// already deleted by another request
+			continue
+		}
+		if err != nil {
+			log.Println("[WARN] Could not delete expired clip", c.id, err.Error())
+			continue
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// StartExpiryReaper - Starts a background goroutine, which deletes expired clips periodically
+func StartExpiryReaper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			deleted, err := ReapExpiredClips()
+			if err != nil {
+				log.Println("[WARN] Reaping expired clips failed", err.Error())
+			} else if deleted > 0 {
+				log.Println("Deleted", deleted, "expired clip(s)")
+			}
+		}
+	}()
+}
@@ -0,0 +1,113 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestClipTTL(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("ttl", "X-Cclip-TTL", "3600")
+	if expected := time.Now().Unix() + 3600; clip.ExpiresAt < expected-5 || clip.ExpiresAt > expected {
+		t.Errorf("clip expires at %d, expected %d", clip.ExpiresAt, expected)
+	}
+
+	server.expectStatus(400, "POST", "/clips", "ttl", "X-Cclip-TTL", "-1")
+
+	DefaultClipTTL = 60
+	clip = server.upload("default ttl")
+	if clip.ExpiresAt == 0 {
+		t.Error("default TTL has not been used")
+	}
+
+	clip = server.upload("no ttl", "X-Cclip-TTL", "0")
+	if clip.ExpiresAt != 0 {
+		t.Errorf("clip expires at %d, expected no expiration", clip.ExpiresAt)
+	}
+}
+
+func TestExpiredClips(t *testing.T) {
+	server := newTestServer(t)
+
+	expired := server.upload("expired")
+	active := server.upload("active", "X-Cclip-TTL", "3600")
+
+	server.expectStatus(200, "PATCH", "/clips/"+expired.ID, `{"expires":1}`)
+
+	// expired clips are hidden, before they are deleted
+	server.expectStatus(404, "GET", "/clips/"+expired.ID, "")
+	server.expectStatus(200, "GET", "/clips/"+active.ID, "")
+
+	var items []clipItem
+	json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips", "")), &items)
+	if len(items) != 1 || items[0].ID != active.ID {
+		t.Errorf("unexpected clips %+v", items)
+	}
+
+	deleted, err := ReapExpiredClips()
+	if err != nil || deleted != 1 {
+		t.Fatalf("reaped %d clip(s): %v", deleted, err)
+	}
+
+	if _, err := os.Stat(path.Join(ClipDirectory, expired.ID)); !os.IsNotExist(err) {
+		t.Error("data of expired clip has not been deleted")
+	}
+	if _, err := os.Stat(path.Join(ClipDirectory, expired.ID+".meta")); !os.IsNotExist(err) {
+		t.Error("meta data of expired clip has not been deleted")
+	}
+	if _, err := os.Stat(path.Join(ClipDirectory, active.ID)); err != nil {
+		t.Error("active clip has been deleted")
+	}
+
+	deleted, _ = ReapExpiredClips()
+	if deleted != 0 {
+		t.Errorf("reaped %d clip(s) again", deleted)
+	}
+}
+
+func TestReapExtendedClips(t *testing.T) {
+	server := newTestServer(t)
+	clip := server.upload("extended")
+
+	server.expectStatus(200, "PATCH", "/clips/"+clip.ID, `{"expires":1}`)
+
+	// extended, after the reaper has found the clip
+	clipMeta, err := ClipMetaStore.Read(clip.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clipMeta.ExpiresAt = time.Now().Unix() + 3600
+	if err := ClipMetaStore.Write(clip.ID, 0, clipMeta); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := ReapExpiredClips()
+	if err != nil || deleted != 0 {
+		t.Fatalf("reaped %d clip(s): %v", deleted, err)
+	}
+	if _, err := ClipStorage.Stat(clip.ID); err != nil {
+		t.Error("extended clip has been deleted")
+	}
+
+	server.expectStatus(200, "GET", "/clips/"+clip.ID, "")
+}
@@ -0,0 +1,843 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuarantineDirectoryName - The name of the directory inside ClipDirectory,
+// where "cclip fsck --repair" moves broken and unexpected files to
+const QuarantineDirectoryName = "quarantine"
+
+// FsckProblem - A problem, which has been found by CheckClipDirectory()
+type FsckProblem struct {
+	Type string `json:"type"`
+	// slash separated path, relative to ClipDirectory
+	File    string `json:"file"`
+	Message string `json:"message"`
+	// what has been done to repair the problem
+	Action string `json:"action,omitempty"`
+	// why repairing the problem failed
+	Error string `json:"error,omitempty"`
+}
+
+// FsckReport - The result of CheckClipDirectory()
+type FsckReport struct {
+	Directory string        `json:"directory"`
+	MetaStore string        `json:"meta_store"`
+	Clips     int           `json:"clips"`
+	Versions  int           `json:"versions"`
+	Blobs     int           `json:"blobs"`
+	Problems  []FsckProblem `json:"problems"`
+}
+
+// Unrepaired - Returns the number of problems, which have not been repaired
+func (r FsckReport) Unrepaired() int {
+	count := 0
+	for _, p := range r.Problems {
+		if p.Action == "" {
+			count++
+		}
+	}
+
+	return count
+}
+
+type fsckRun struct {
+	db         *SQLiteMetaStore
+	quarantine string
+	repair     bool
+	report     FsckReport
+
+	// clips, which have data and meta data
+	clips map[string]bool
+	// meta data by data key
+	metas map[string]clipMetaData
+	// data keys with unparsable meta data
+	invalidMetas map[string]bool
+	// data keys with meta data, which cannot be decrypted
+	undecryptableMetas map[string]bool
+	// IDs of clips, which exist in both layouts
+	duplicates map[string]bool
+}
+
+var blobNameRegex = regexp.MustCompile("^([0-9a-f]{64})(\\.(gzip|zstd))?$")
+
+// CheckClipDirectory - Checks all files inside ClipDirectory and, if requested,
+// repairs the problems, which have been found
+//
+// If db is nil, the meta data is stored in ".meta" files. The server must not run
+// in the meantime.
+func CheckClipDirectory(repair bool, db *SQLiteMetaStore) (FsckReport, error) {
+	f := &fsckRun{
+		db:                 db,
+		quarantine:         filepath.Join(ClipDirectory, QuarantineDirectoryName, time.Now().Format("20060102-150405")),
+		repair:             repair,
+		clips:              map[string]bool{},
+		metas:              map[string]clipMetaData{},
+		invalidMetas:       map[string]bool{},
+		undecryptableMetas: map[string]bool{},
+		duplicates:         map[string]bool{},
+	}
+
+	f.report.Directory = ClipDirectory
+	f.report.MetaStore = "files"
+	if db != nil {
+		f.report.MetaStore = "sqlite"
+	}
+	f.report.Problems = make([]FsckProblem, 0)
+
+	// interrupted operations change the other files, so handle them first
+	err := f.checkMarkers()
+	if err != nil {
+		return f.report, err
+	}
+
+	// before the files of clips are checked one by one
+	err = f.checkLayouts()
+	if err != nil {
+		return f.report, err
+	}
+
+	err = f.checkMetaStore()
+	if err != nil {
+		return f.report, err
+	}
+
+	dataFiles, extraFiles, err := f.checkClipFiles()
+	if err != nil {
+		return f.report, err
+	}
+
+	f.checkClips(dataFiles)
+	f.checkExtraFiles(extraFiles)
+
+	err = f.checkBlobs()
+	if err != nil {
+		return f.report, err
+	}
+
+	f.checkSearchIndex()
+
+	return f.report, nil
+}
+
+// addProblem - Reports a problem and repairs it, if requested
+func (f *fsckRun) addProblem(problemType string, file string, message string, repair func() (string, error)) bool {
+	problem := FsckProblem{
+		Type:    problemType,
+		File:    file,
+		Message: message,
+	}
+
+	repaired := false
+	if f.repair {
+		if repair == nil {
+			problem.Error = "Cannot be repaired automatically"
+		} else {
+			action, err := repair()
+			if err == nil {
+				problem.Action = action
+				repaired = true
+			} else {
+				problem.Error = err.Error()
+			}
+		}
+	}
+
+	f.report.Problems = append(f.report.Problems, problem)
+	return repaired
+}
+
+// addUndecryptable - Reports a file, which cannot be decrypted with the configured keys
+//
+// A wrong or missing key must not destroy any data, so the problem is never repaired.
+func (f *fsckRun) addUndecryptable(file string, err error) {
+	f.addProblem("undecryptable-file", file, err.Error()+", check the encryption keys", nil)
+}
+
+// checkBlobs - Checks the shared data objects of deduplicated clips
+func (f *fsckRun) checkBlobs() error {
+	entries, err := ioutil.ReadDir(filepath.Join(ClipDirectory, BlobDirectoryName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	// the IDs of keyed blobs, s. NewBlobID(), do not contain the hash
+	blobMetas := map[string]clipMetaData{}
+	for _, clipMeta := range f.metas {
+		blobMetas[clipMeta.BlobID()] = clipMeta
+	}
+
+	for _, e := range entries {
+		file := path.Join(BlobDirectoryName, e.Name())
+
+		if isTempFileName(e.Name()) && e.Mode().IsRegular() {
+			f.addProblem("temporary-file", file, "Stale temporary file", f.deleteFile(file))
+			continue
+		}
+		if !blobNameRegex.MatchString(e.Name()) || !e.Mode().IsRegular() {
+			f.addProblem("unexpected-file", file, describeUnexpectedFile(e), f.quarantineFile(file))
+			continue
+		}
+
+		if links, ok := getLinkCount(filepath.Join(ClipDirectory, filepath.FromSlash(file)), e); ok && links == 1 {
+			f.addProblem("unused-blob", file, "Shared data is not used by any clip", f.deleteFile(file))
+			continue
+		}
+
+		clipMeta, ok := blobMetas[e.Name()]
+		if !ok {
+			// used by clips, whose meta data cannot be read, which are reported already
+			f.report.Blobs++
+			continue
+		}
+		blobHash, encoding := clipMeta.SHA256, clipMeta.Encoding
+
+		hash, err := HashObject(file, encoding)
+		if IsEncryptionError(err) {
+			f.addUndecryptable(file, err)
+			continue
+		}
+		if err != nil {
+			f.addProblem("unreadable-file", file, err.Error(), f.quarantineFile(file))
+			continue
+		}
+		if hash != blobHash {
+			f.addProblem("checksum-mismatch", file, "Shared data has SHA-256 hash "+hash, f.quarantineFile(file))
+			continue
+		}
+
+		f.report.Blobs++
+	}
+
+	return nil
+}
+
+// checkClips - Checks the data and meta data of all clips and their old versions
+func (f *fsckRun) checkClips(dataFiles map[string]bool) {
+	keys := make([]string, 0, len(dataFiles)+len(f.metas))
+	for key := range dataFiles {
+		keys = append(keys, key)
+	}
+	for key := range f.metas {
+		if !dataFiles[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	// clips before their versions
+	sortDataKeys(keys)
+
+	for _, key := range keys {
+		id, version := parseDataKey(key)
+		clipMeta, hasMeta := f.metas[key]
+		hasData := dataFiles[key]
+
+		if f.duplicates[id] {
+			// already reported
+			f.keepClip(id, version)
+			continue
+		}
+
+		if version > 0 && !f.clips[id] {
+			f.addProblem("orphaned-object", key, "Version of a clip, which does not exist", f.quarantineVersion(key, hasData, hasMeta))
+			continue
+		}
+
+		if f.invalidMetas[key] {
+			// already reported
+			continue
+		}
+
+		if f.undecryptableMetas[key] {
+			// already reported, but the versions and shares still belong to the clip
+			f.keepClip(id, version)
+			continue
+		}
+
+		if !hasMeta {
+			f.addProblem("data-without-meta", key, "Data has no meta data", f.quarantineFile(key))
+			continue
+		}
+		if !hasData {
+			f.addProblem("meta-without-data", key+".meta", "Meta data has no data", f.quarantineMeta(key))
+			continue
+		}
+
+		if clipMeta.SHA256 != "" {
+			hash, err := HashObject(key, clipMeta.Encoding)
+			if IsEncryptionError(err) {
+				f.addUndecryptable(key, err)
+				f.keepClip(id, version)
+				continue
+			}
+			if err != nil {
+				// like broken compressed data
+				f.addProblem("unreadable-file", key, err.Error(), f.quarantineVersion(key, true, true))
+				continue
+			}
+
+			if hash != clipMeta.SHA256 {
+				message := "Data has SHA-256 hash " + hash + " instead of " + clipMeta.SHA256
+				f.addProblem("checksum-mismatch", key, message, f.quarantineVersion(key, true, true))
+				continue
+			}
+		}
+
+		if version == 0 {
+			f.clips[id] = true
+			f.report.Clips++
+		} else {
+			f.report.Versions++
+		}
+	}
+}
+
+// checkClipFiles - Checks the names and types of all files of clips and their old versions,
+// reads ".meta" files and returns the keys of all data files and all shares files by clip ID
+func (f *fsckRun) checkClipFiles() (map[string]bool, map[string][]string, error) {
+	dataFiles := map[string]bool{}
+	extraFiles := map[string][]string{}
+
+	err := f.checkClipDirectory("", dataFiles, extraFiles)
+
+	return dataFiles, extraFiles, err
+}
+
+// checkClipDirectory - Checks the files of clips in a directory of the flat layout ("")
+// or the sharded layout (like "ab/cd/"), s. ClipLayout, also inside the namespace of a user
+// (like "users/alice/ab/cd/"), s. GetUserPrefix()
+func (f *fsckRun) checkClipDirectory(dir string, dataFiles map[string]bool, extraFiles map[string][]string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(ClipDirectory, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+
+	// "", "ab/" or "ab/cd/" inside the namespace
+	prefix, layoutDir := splitUserKey(dir)
+	depth := strings.Count(layoutDir, "/")
+	isRoot := prefix == "" && depth == 0
+
+	for _, e := range entries {
+		name := e.Name()
+		file := dir + name
+
+		if isRoot && e.IsDir() && (name == QuarantineDirectoryName || name == BlobDirectoryName) {
+			continue
+		}
+		if isRoot && e.IsDir() && name == UserDirectoryName {
+			err := f.checkUserDirectories(dataFiles, extraFiles)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+		if depth < 2 && e.IsDir() && shardNameRegex.MatchString(name) {
+			err := f.checkClipDirectory(file+"/", dataFiles, extraFiles)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+		if depth == 1 {
+			f.addProblem("unexpected-file", file, describeUnexpectedFile(e), f.quarantineFile(file))
+			continue
+		}
+
+		if e.Mode().IsRegular() {
+			if isRoot && (name == SearchIndexFileName || name == MigrationsFileName || isAccountFile(name) || strings.HasPrefix(name, MetaDatabaseFileName)) {
+				continue
+			}
+			if isTempFileName(name) {
+				f.addProblem("temporary-file", file, "Stale temporary file", f.deleteFile(file))
+				continue
+			}
+		}
+
+		id, suffix, expected := parseClipKey(file)
+		base := strings.TrimSuffix(file, suffix)
+
+		if expected {
+			switch suffix {
+			case "":
+				expected = e.Mode().IsRegular()
+				if expected {
+					dataFiles[base] = true
+				}
+			case ".meta":
+				expected = e.Mode().IsRegular()
+				if expected {
+					f.readMetaFile(base)
+				}
+			case ".burning", ".pending":
+				// s. checkMarkers()
+				expected = e.Mode().IsRegular()
+			case ".migrating", ".writing":
+				// s. LockClip() and MigrateClipLayout()
+				expected = e.Mode().IsRegular()
+			case ".shares":
+				expected = e.Mode().IsRegular()
+				if expected {
+					extraFiles[id] = append(extraFiles[id], file)
+				}
+			case ".versions":
+				expected = e.IsDir()
+				if expected {
+					err := f.checkVersionFiles(base, dataFiles)
+					if err != nil {
+						return err
+					}
+				}
+			default:
+				expected = false
+			}
+		}
+
+		if !expected {
+			f.addProblem("unexpected-file", file, describeUnexpectedFile(e), f.quarantineFile(file))
+		}
+	}
+
+	return nil
+}
+
+// checkUserDirectories - Checks the files of the clips of all users, s. UserDirectoryName
+func (f *fsckRun) checkUserDirectories(dataFiles map[string]bool, extraFiles map[string][]string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(ClipDirectory, UserDirectoryName))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		file := UserDirectoryName + "/" + e.Name()
+
+		if !e.IsDir() || !IsValidUserName(e.Name()) {
+			f.addProblem("unexpected-file", file, describeUnexpectedFile(e), f.quarantineFile(file))
+			continue
+		}
+
+		err := f.checkClipDirectory(file+"/", dataFiles, extraFiles)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkExtraFiles - Checks the shares of all clips
+func (f *fsckRun) checkExtraFiles(extraFiles map[string][]string) {
+	for id, files := range extraFiles {
+		for _, file := range files {
+			if !f.clips[id] && !f.duplicates[id] {
+				f.addProblem("orphaned-object", file, "File of a clip, which does not exist", f.quarantineFile(file))
+				continue
+			}
+
+			var shares []ClipShare
+
+			sharesBytes, err := ReadObject(file)
+			if err == nil {
+				err = json.Unmarshal(sharesBytes, &shares)
+			}
+			if IsEncryptionError(err) {
+				f.addUndecryptable(file, err)
+			} else if err != nil {
+				f.addProblem("invalid-shares", file, err.Error(), f.quarantineFile(file))
+			}
+		}
+	}
+}
+
+// checkLayouts - Checks for clips, which exist in the flat and the sharded layout,
+// because "cclip migrate-layout" has been interrupted
+func (f *fsckRun) checkLayouts() error {
+	clips, err := scanClipLayouts()
+	if err != nil {
+		return err
+	}
+
+	for id, layouts := range clips {
+		if len(layouts) < 2 {
+			continue
+		}
+
+		var prefix string
+		for _, l := range layouts {
+			prefix, _ = splitUserKey(l.base)
+		}
+
+		message := "Clip exists in the flat and the sharded layout"
+		repaired := f.addProblem("interrupted-migration", prefix+GetLayoutKey(id, ClipLayout), message, func() (string, error) {
+			kept, err := recoverClipLayout(layouts)
+			if err == nil && kept == "" {
+				err = errors.New("No layout has data")
+			}
+
+			return "kept " + kept + " layout", err
+		})
+		if !repaired {
+			// the other checks would mix up both layouts
+			f.duplicates[id] = true
+		}
+	}
+
+	return nil
+}
+
+// checkMarkers - Checks for interrupted operations and burn-after-read clips,
+// which the server completes or rolls back on startup
+func (f *fsckRun) checkMarkers() error {
+	objects, err := ListClipObjects(ClipStorage)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		id, suffix, ok := parseClipKey(o.Key)
+		if !ok || (suffix != ".pending" && suffix != ".burning") {
+			continue
+		}
+
+		var clip ClipFile
+		clip.file = strings.TrimSuffix(o.Key, suffix)
+		clip.id = id
+
+		if suffix == ".burning" {
+			f.addProblem("interrupted-burn", o.Key, "Burn-after-read clip was read during shutdown", func() (string, error) {
+				return "deleted clip", clip.recoverBurn()
+			})
+			continue
+		}
+
+		var op clipOperation
+
+		opBytes, err := ReadObject(o.Key)
+		if err == nil {
+			err = json.Unmarshal(opBytes, &op)
+		}
+		if IsEncryptionError(err) {
+			f.addUndecryptable(o.Key, err)
+			continue
+		}
+		if err != nil {
+			op.Type = "unknown"
+		}
+
+		f.addProblem("interrupted-operation", o.Key, "Interrupted "+op.Type+" of clip", func() (string, error) {
+			result, err := recoverClipOperation(clip, op)
+			return result + " clip", err
+		})
+	}
+
+	return nil
+}
+
+// checkMetaStore - Checks the database and reads all rows, if meta data is stored in SQLite
+func (f *fsckRun) checkMetaStore() error {
+	metaDatabaseFile := filepath.Join(ClipDirectory, MetaDatabaseFileName)
+
+	if f.db == nil {
+		if _, err := os.Stat(metaDatabaseFile); err == nil {
+			f.addProblem("unused-meta-database", MetaDatabaseFileName, "Database is not used, run 'cclip meta export' to move its meta data into .meta files", nil)
+		}
+
+		return nil
+	}
+
+	err := f.db.CheckIntegrity()
+	if err != nil {
+		f.addProblem("invalid-meta-database", MetaDatabaseFileName, err.Error(), nil)
+	}
+
+	return f.db.Each(func(id string, version int64, clipMeta clipMetaData) error {
+		f.metas[GetClipDataFile(id, version)] = clipMeta
+		return nil
+	})
+}
+
+// checkSearchIndex - Checks, if the search index can be parsed
+func (f *fsckRun) checkSearchIndex() {
+	indexBytes, err := ReadObject(SearchIndexFileName)
+	if IsEncryptionError(err) {
+		f.addUndecryptable(SearchIndexFileName, err)
+		return
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			f.addProblem("unreadable-file", SearchIndexFileName, err.Error(), nil)
+		}
+
+		return
+	}
+
+	var index searchIndex
+
+	err = json.Unmarshal(indexBytes, &index)
+	if err == nil && (index.Terms == nil || index.Clips == nil) {
+		err = errors.New("Missing terms or clips")
+	}
+	if err != nil {
+		message := err.Error() + ", it is rebuilt on startup"
+		f.addProblem("invalid-search-index", SearchIndexFileName, message, f.deleteFile(SearchIndexFileName))
+	}
+}
+
+// checkVersionFiles - Checks the names and types of all files of the old versions of a clip,
+// whose data has a key
+func (f *fsckRun) checkVersionFiles(base string, dataFiles map[string]bool) error {
+	versionsDir := base + ".versions"
+
+	entries, err := ioutil.ReadDir(filepath.Join(ClipDirectory, versionsDir))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		file := path.Join(versionsDir, name)
+
+		if isTempFileName(name) && e.Mode().IsRegular() {
+			f.addProblem("temporary-file", file, "Stale temporary file", f.deleteFile(file))
+			continue
+		}
+
+		version, err := strconv.ParseInt(strings.TrimSuffix(name, ".meta"), 10, 64)
+		if err != nil || version < 1 || path.Join(versionsDir, strconv.FormatInt(version, 10)) != strings.TrimSuffix(file, ".meta") || !e.Mode().IsRegular() {
+			f.addProblem("unexpected-file", file, describeUnexpectedFile(e), f.quarantineFile(file))
+			continue
+		}
+
+		if strings.HasSuffix(name, ".meta") {
+			f.readMetaFile(strings.TrimSuffix(file, ".meta"))
+		} else {
+			dataFiles[file] = true
+		}
+	}
+
+	return nil
+}
+
+// deleteFile - Returns a function, which deletes a file
+func (f *fsckRun) deleteFile(file string) func() (string, error) {
+	return func() (string, error) {
+		return "deleted", os.Remove(filepath.Join(ClipDirectory, filepath.FromSlash(file)))
+	}
+}
+
+// quarantineFile - Returns a function, which moves a file or directory into the quarantine directory
+func (f *fsckRun) quarantineFile(file string) func() (string, error) {
+	return func() (string, error) {
+		return "quarantined", f.moveToQuarantine(file)
+	}
+}
+
+// quarantineMeta - Returns a function, which moves the meta data of the data file of a clip version
+// into the quarantine directory
+func (f *fsckRun) quarantineMeta(dataFile string) func() (string, error) {
+	return func() (string, error) {
+		metaFile := dataFile + ".meta"
+
+		if f.db == nil {
+			return "quarantined", f.moveToQuarantine(metaFile)
+		}
+
+		// export the row as ".meta" file
+		metaBytes, err := json.Marshal(f.metas[dataFile])
+		if err != nil {
+			return "", err
+		}
+
+		dest := filepath.Join(f.quarantine, filepath.FromSlash(metaFile))
+
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(dest, metaBytes, 0644)
+		}
+		if err == nil {
+			id, version := parseDataKey(dataFile)
+			err = f.db.Delete(id, version)
+		}
+
+		return "quarantined", err
+	}
+}
+
+// quarantineVersion - Returns a function, which moves the data and meta data of a clip version,
+// and all other files of a clip, into the quarantine directory
+func (f *fsckRun) quarantineVersion(dataFile string, hasData bool, hasMeta bool) func() (string, error) {
+	return func() (string, error) {
+		id, version := parseDataKey(dataFile)
+
+		if hasData {
+			err := f.moveToQuarantine(dataFile)
+			if err != nil {
+				return "", err
+			}
+		}
+		if hasMeta {
+			_, err := f.quarantineMeta(dataFile)()
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if version == 0 {
+			// versions and shares are checked later
+			delete(f.clips, id)
+		}
+
+		return "quarantined", nil
+	}
+}
+
+// keepClip - Marks a clip as existing, whose data or meta data cannot be checked
+func (f *fsckRun) keepClip(id string, version int64) {
+	if version == 0 {
+		f.clips[id] = true
+	}
+}
+
+func (f *fsckRun) moveToQuarantine(file string) error {
+	dest := filepath.Join(f.quarantine, filepath.FromSlash(file))
+
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err == nil {
+		err = os.Rename(filepath.Join(ClipDirectory, filepath.FromSlash(file)), dest)
+	}
+
+	return err
+}
+
+// readMetaFile - Reads the ".meta" file of a data file or, if the meta data is stored in SQLite,
+// reports it as not imported
+func (f *fsckRun) readMetaFile(dataFile string) {
+	metaFile := dataFile + ".meta"
+	id, version := parseDataKey(dataFile)
+
+	clipMeta, err := readMetaObject(metaFile)
+	if IsEncryptionError(err) {
+		if f.db == nil {
+			f.undecryptableMetas[dataFile] = true
+		}
+
+		f.addUndecryptable(metaFile, err)
+		return
+	}
+	if err != nil && f.db != nil {
+		// the row of the database is used
+		f.addProblem("invalid-meta", metaFile, err.Error(), f.quarantineFile(metaFile))
+		return
+	}
+	if err != nil {
+		f.invalidMetas[dataFile] = true
+
+		f.addProblem("invalid-meta", metaFile, err.Error(), func() (string, error) {
+			err := f.moveToQuarantine(metaFile)
+			if err == nil {
+				err = f.moveToQuarantine(dataFile)
+				if os.IsNotExist(err) {
+					err = nil
+				}
+			}
+
+			return "quarantined", err
+		})
+
+		return
+	}
+
+	if f.db != nil {
+		message := "Meta data has not been imported into the database yet"
+		repaired := f.addProblem("unimported-meta", metaFile, message, func() (string, error) {
+			return "imported", importMetaFile(f.db, &FileMetaStore{}, id, version, clipMeta)
+		})
+		if !repaired {
+			if _, ok := f.metas[dataFile]; ok {
+				// the row is used, until the file has been imported
+				return
+			}
+		}
+	}
+
+	f.metas[dataFile] = clipMeta
+}
+
+// describeUnexpectedFile - Returns, why a file is not expected inside ClipDirectory
+func describeUnexpectedFile(fileStat os.FileInfo) string {
+	mode := fileStat.Mode()
+
+	switch {
+	case mode.IsDir():
+		return "Unexpected directory"
+	case mode&os.ModeSymlink != 0:
+		return "Unexpected symbolic link"
+	case !mode.IsRegular():
+		return "Unexpected special file (" + mode.String() + ")"
+	}
+
+	return "Unexpected file name"
+}
+
+// parseDataKey - Returns the clip ID and version of the key of a data file in any layout
+func parseDataKey(key string) (string, int64) {
+	base, version := key, int64(0)
+	if i := strings.Index(key, ".versions/"); i > -1 {
+		base = key[:i]
+		version, _ = strconv.ParseInt(key[i+len(".versions/"):], 10, 64)
+	}
+
+	return path.Base(base), version
+}
+
+// sortDataKeys - Sorts keys of data files by clip ID and version
+func sortDataKeys(keys []string) {
+	sort.Slice(keys, func(i, j int) bool {
+		idI, versionI := parseDataKey(keys[i])
+		idJ, versionJ := parseDataKey(keys[j])
+
+		if versionI == 0 || versionJ == 0 {
+			// clips first
+			if versionI != versionJ {
+				return versionI == 0
+			}
+		}
+		if idI != idJ {
+			return idI < idJ
+		}
+
+		return versionI < versionJ
+	})
+}
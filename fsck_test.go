@@ -0,0 +1,158 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fsckProblemList - Returns the sorted "<type> <file>" of all problems of a report
+func fsckProblemList(report FsckReport) []string {
+	problems := []string{}
+	for _, p := range report.Problems {
+		problems = append(problems, p.Type+" "+p.File)
+	}
+	sort.Strings(problems)
+
+	return problems
+}
+
+func TestCheckClipDirectory(t *testing.T) {
+	server := newTestServer(t)
+
+	writeFile := func(file string, data string) {
+		t.Helper()
+
+		if err := ioutil.WriteFile(filepath.Join(ClipDirectory, filepath.FromSlash(file)), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removeFile := func(file string) {
+		t.Helper()
+
+		if err := os.Remove(filepath.Join(ClipDirectory, filepath.FromSlash(file))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kept := server.upload("kept", "Content-Type", "text/plain")
+	server.expectStatus(200, "PUT", "/clips/"+kept.ID, "kept v2", "Content-Type", "text/plain")
+
+	report, err := CheckClipDirectory(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.Clips != 1 || report.Versions != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	changed := server.upload("changed", "Content-Type", "text/plain")
+	writeFile(changed.ID, "CHANGED")
+
+	withoutMeta := server.upload("without meta data", "Content-Type", "text/plain")
+	removeFile(withoutMeta.ID + ".meta")
+
+	withoutData := server.upload("without data", "Content-Type", "text/plain")
+	removeFile(withoutData.ID)
+
+	invalidMeta := server.upload("invalid meta data", "Content-Type", "text/plain")
+	writeFile(invalidMeta.ID+".meta", "{")
+
+	shared := server.upload("shared", "Content-Type", "text/plain")
+	writeFile(shared.ID+".shares", "[")
+
+	writeFile(".upload-123", "partial")
+	writeFile("notes.txt", "unexpected")
+	if err := os.MkdirAll(filepath.Join(ClipDirectory, BlobDirectoryName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(BlobDirectoryName+"/0000000000000000000000000000000000000000000000000000000000000000", "unused")
+
+	// without pending changes, which would replace it
+	if err := SaveSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(SearchIndexFileName, "{")
+
+	expected := []string{
+		"checksum-mismatch " + changed.ID,
+		"data-without-meta " + withoutMeta.ID,
+		"invalid-meta " + invalidMeta.ID + ".meta",
+		"invalid-search-index " + SearchIndexFileName,
+		"invalid-shares " + shared.ID + ".shares",
+		"meta-without-data " + withoutData.ID + ".meta",
+		"temporary-file .upload-123",
+		"unexpected-file notes.txt",
+		"unused-blob " + BlobDirectoryName + "/0000000000000000000000000000000000000000000000000000000000000000",
+	}
+	sort.Strings(expected)
+
+	// only reported
+	report, err = CheckClipDirectory(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := fsckProblemList(report); !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+	if report.Unrepaired() != len(expected) {
+		t.Errorf("%d problems have been repaired", len(expected)-report.Unrepaired())
+	}
+	if _, err := os.Stat(filepath.Join(ClipDirectory, "notes.txt")); err != nil {
+		t.Errorf("file has been changed without repair: %v", err)
+	}
+
+	report, err = CheckClipDirectory(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := fsckProblemList(report); !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+	if report.Unrepaired() != 0 {
+		t.Errorf("unrepaired problems %+v", report.Problems)
+	}
+
+	// moved instead of deleted
+	quarantined, err := filepath.Glob(filepath.Join(ClipDirectory, QuarantineDirectoryName, "*", "notes.txt"))
+	if err != nil || len(quarantined) != 1 {
+		t.Errorf("file has not been quarantined %v (%v)", quarantined, err)
+	}
+
+	report, err = CheckClipDirectory(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.Clips != 2 || report.Versions != 1 {
+		t.Errorf("unexpected report after repair %+v", report)
+	}
+
+	if err := ClipIndex.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if data := server.expectStatus(200, "GET", "/clips/"+kept.ID, ""); data != "kept v2" {
+		t.Errorf("clip contains %q", data)
+	}
+	if data := server.expectStatus(200, "GET", "/clips/"+shared.ID, ""); data != "shared" {
+		t.Errorf("clip contains %q", data)
+	}
+}
@@ -1,10 +1,20 @@
 module github.com/cloud-clip/cclip
 
-go 1.14
+go 1.22
 
 require (
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/mux v1.7.4
-	github.com/urfave/cli v1.22.4
+	github.com/klauspost/compress v1.18.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/urfave/cli/v2 v2.2.0
+	golang.org/x/crypto v0.33.0
+	golang.org/x/term v0.29.0
+)
+
+require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
@@ -17,10 +17,38 @@
 package main
 
 import (
+	"net/http"
+
 	"github.com/gorilla/mux"
 )
 
-// AddHTTPAction - Adds a HTTP action to a router
-func AddHTTPAction(r *mux.Router, p string, a HTTPAction, m ...string) {
-	r.HandleFunc("/api/v1"+p, AsThreadSafeHTTPAction(a)).Methods(m...)
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+
+	return n, err
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// AddHTTPAction - Adds a HTTP action to a router, which needs a scope of TokenScopes,
+// or an empty string for public actions
+func AddHTTPAction(r *mux.Router, p string, scope string, a HTTPAction, m ...string) {
+	r.HandleFunc("/api/v1"+p, requireScope(scope, a)).Methods(m...)
 }
@@ -0,0 +1,339 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClipIndexEntry - An entry of the in-memory clip index
+type ClipIndexEntry struct {
+	Clip ClipFile
+	Meta clipMetaData
+	// tokens of the shares of the clip
+	ShareTokens []string
+}
+
+// ClipIndexType - An in-memory index of all clips and their meta data,
+// sorted by newest first
+type ClipIndexType struct {
+	// clip ID => number of the last change, since the last Load()
+	changes    map[string]uint64
+	entries    map[string]*ClipIndexEntry
+	lastChange uint64
+	lock       sync.RWMutex
+	shares     map[string]string
+	sorted     []*ClipIndexEntry
+	usage      ClipUsage
+	// user name => usage of the clips of the user
+	userUsage map[string]ClipUsage
+}
+
+// ClipIndex - The in-memory index of ClipStorage
+var ClipIndex = &ClipIndexType{
+	changes:   map[string]uint64{},
+	entries:   map[string]*ClipIndexEntry{},
+	shares:    map[string]string{},
+	sorted:    []*ClipIndexEntry{},
+	userUsage: map[string]ClipUsage{},
+}
+
+// Count - Returns the number of clips
+func (index *ClipIndexType) Count() int {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	return len(index.sorted)
+}
+
+// Each - Calls a function for each clip, newest first, until it returns false
+func (index *ClipIndexType) Each(f func(entry ClipIndexEntry) bool) {
+	index.lock.RLock()
+	sorted := index.sorted
+	index.lock.RUnlock()
+
+	for _, e := range sorted {
+		if !f(*e) {
+			break
+		}
+	}
+}
+
+// FindShare - Returns the ID of the clip, which has a share with a specific token
+func (index *ClipIndexType) FindShare(token string) (string, bool) {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	id, ok := index.shares[token]
+	return id, ok
+}
+
+// Usage - Returns the number and total size of all stored clips
+func (index *ClipIndexType) Usage() ClipUsage {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	return index.usage
+}
+
+// UserUsage - Returns the number and total size of the clips of a user, s. ClipFile.User()
+func (index *ClipIndexType) UserUsage(name string) ClipUsage {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	return index.userUsage[name]
+}
+
+// Get - Returns a clip and its meta data by ID
+func (index *ClipIndexType) Get(id string) (ClipIndexEntry, bool) {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	entry, ok := index.entries[id]
+	if !ok {
+		return ClipIndexEntry{}, false
+	}
+
+	return *entry, true
+}
+
+// List - Returns all clips, newest first
+func (index *ClipIndexType) List() []ClipFile {
+	clips := make([]ClipFile, 0, index.Count())
+	index.Each(func(entry ClipIndexEntry) bool {
+		clips = append(clips, entry.Clip)
+		return true
+	})
+
+	return clips
+}
+
+// Load - (Re)loads the index from ClipStorage
+func (index *ClipIndexType) Load() error {
+	index.lock.RLock()
+	firstChange := index.lastChange
+	index.lock.RUnlock()
+
+	scan, err := scanClips()
+	if err != nil {
+		return err
+	}
+
+	// the meta data of the scan, and only existing shares are read
+	entries := map[string]*ClipIndexEntry{}
+	for _, c := range scan.clips {
+		entries[c.id] = newClipIndexEntry(c, scan.metas[c.id], scan.shared[c.file])
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	// keep clips, which have been changed while scanning
+	for id, change := range index.changes {
+		if change <= firstChange {
+			continue
+		}
+
+		if entry, ok := index.entries[id]; ok {
+			entries[id] = entry
+		} else {
+			delete(entries, id)
+		}
+	}
+
+	index.changes = map[string]uint64{}
+	index.entries = entries
+	index.rebuild()
+
+	return nil
+}
+
+// Refresh - Reloads a clip from ClipStorage, and removes it, if it does not exist anymore
+func (index *ClipIndexType) Refresh(id string) error {
+	clip, err := GetClipByID(id)
+	if err != nil {
+		index.Remove(id)
+		return err
+	}
+
+	clipMeta, err := clip.ReadMeta()
+	if err != nil {
+		index.Remove(id)
+		return err
+	}
+
+	entry := newClipIndexEntry(clip, clipMeta, true)
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	index.changed(id)
+	index.remove(id)
+	index.insert(entry)
+
+	return nil
+}
+
+// Remove - Removes a clip from the index
+func (index *ClipIndexType) Remove(id string) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	index.changed(id)
+	index.remove(id)
+}
+
+// StartClipIndexRescan - Starts a background goroutine, which reloads the index
+// periodically, to reflect changes of ClipStorage made outside the server
+func StartClipIndexRescan(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			err := ClipIndex.Load()
+
+			if err != nil {
+				log.Println("[WARN] Rescanning clip storage failed", err.Error())
+			}
+		}
+	}()
+}
+
+// newClipIndexEntry - Creates the entry of a clip, and reads its shares, if it has any
+func newClipIndexEntry(clip ClipFile, clipMeta clipMetaData, hasShares bool) *ClipIndexEntry {
+	entry := &ClipIndexEntry{
+		Clip:        clip,
+		Meta:        clipMeta,
+		ShareTokens: []string{},
+	}
+	if !hasShares {
+		return entry
+	}
+
+	shares, err := clip.ReadShares()
+	if err == nil {
+		for _, s := range shares {
+			entry.ShareTokens = append(entry.ShareTokens, s.Token)
+		}
+	}
+
+	return entry
+}
+
+// changed - Remembers a change of a clip, must be called with write lock
+func (index *ClipIndexType) changed(id string) {
+	index.lastChange++
+	index.changes[id] = index.lastChange
+}
+
+// insert - Adds an entry to the sorted list, share lookup and usage, must be called with write lock
+func (index *ClipIndexType) insert(entry *ClipIndexEntry) {
+	i := index.search(entry)
+
+	// new slice, so running Each() calls are not affected
+	sorted := make([]*ClipIndexEntry, 0, len(index.sorted)+1)
+	sorted = append(sorted, index.sorted[:i]...)
+	sorted = append(sorted, entry)
+	sorted = append(sorted, index.sorted[i:]...)
+
+	index.entries[entry.Clip.id] = entry
+	index.sorted = sorted
+	for _, t := range entry.ShareTokens {
+		index.shares[t] = entry.Clip.id
+	}
+	index.addUsage(entry.Clip, 1)
+}
+
+// remove - Removes an entry from the sorted list, share lookup and usage, must be called with write lock
+func (index *ClipIndexType) remove(id string) {
+	entry, ok := index.entries[id]
+	if !ok {
+		return
+	}
+
+	i := index.search(entry)
+	if i < len(index.sorted) && index.sorted[i] == entry {
+		// new slice, so running Each() calls are not affected
+		sorted := make([]*ClipIndexEntry, 0, len(index.sorted)-1)
+		sorted = append(sorted, index.sorted[:i]...)
+		sorted = append(sorted, index.sorted[i+1:]...)
+
+		index.sorted = sorted
+	}
+
+	delete(index.entries, id)
+	for _, t := range entry.ShareTokens {
+		if index.shares[t] == id {
+			delete(index.shares, t)
+		}
+	}
+	index.addUsage(entry.Clip, -1)
+}
+
+// search - Returns the position of an entry in the sorted list, or the one to insert it at
+func (index *ClipIndexType) search(entry *ClipIndexEntry) int {
+	return sort.Search(len(index.sorted), func(i int) bool {
+		return !ByNewestClipFile([]ClipFile{index.sorted[i].Clip, entry.Clip}).Less(0, 1)
+	})
+}
+
+// addUsage - Adds (delta = 1) or subtracts (delta = -1) a clip to / from the usage, must be called with write lock
+func (index *ClipIndexType) addUsage(c ClipFile, delta int64) {
+	index.usage.Count += delta
+	index.usage.TotalSize += delta * c.fileInfo.Size
+
+	userUsage := index.userUsage[c.User()]
+	userUsage.Count += delta
+	userUsage.TotalSize += delta * c.fileInfo.Size
+	if userUsage.Count > 0 {
+		index.userUsage[c.User()] = userUsage
+	} else {
+		delete(index.userUsage, c.User())
+	}
+}
+
+// rebuild - Rebuilds sorted list and share lookup of all entries, must be called with write lock
+func (index *ClipIndexType) rebuild() {
+	clips := make([]ClipFile, 0, len(index.entries))
+	for _, e := range index.entries {
+		clips = append(clips, e.Clip)
+	}
+	sort.Sort(ByNewestClipFile(clips))
+
+	// new slices, so running Each() calls are not affected
+	sorted := make([]*ClipIndexEntry, 0, len(clips))
+	shares := map[string]string{}
+	userClips := map[string][]ClipFile{}
+	for _, c := range clips {
+		entry := index.entries[c.id]
+		userClips[c.User()] = append(userClips[c.User()], c)
+
+		sorted = append(sorted, entry)
+		for _, t := range entry.ShareTokens {
+			shares[t] = c.id
+		}
+	}
+
+	index.sorted = sorted
+	index.shares = shares
+	index.usage = GetClipUsage(clips)
+	index.userUsage = map[string]ClipUsage{}
+	for name, c := range userClips {
+		index.userUsage[name] = GetClipUsage(c)
+	}
+}
@@ -0,0 +1,116 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// readCountingStorage - A storage, which counts the reads of clip objects by their suffix
+type readCountingStorage struct {
+	Storage
+	lock  sync.Mutex
+	reads map[string]int
+}
+
+func (s *readCountingStorage) Get(key string) (StorageObject, error) {
+	if _, suffix, ok := parseClipKey(key); ok {
+		s.lock.Lock()
+		s.reads[suffix]++
+		s.lock.Unlock()
+	}
+
+	return s.Storage.Get(key)
+}
+
+func TestClipIndexUpdates(t *testing.T) {
+	server := newTestServer(t)
+
+	clips := []uploadFileResponse{}
+	for _, data := range []string{"a", "bb", "ccc", "dddd", "eeeee"} {
+		clips = append(clips, server.upload(data, "Content-Type", "text/plain"))
+	}
+
+	// moves the clip to the top
+	server.expectStatus(200, "PUT", "/clips/"+clips[1].ID, "replaced", "Content-Type", "text/plain")
+	server.expectStatus(201, "POST", "/clips/"+clips[2].ID+"/shares", "")
+	server.expectStatus(204, "DELETE", "/clips/"+clips[3].ID, "")
+	server.expectStatus(200, "PATCH", "/clips/"+clips[0].ID, `{"name":"renamed"}`)
+
+	ids := []string{}
+	for _, c := range ClipIndex.List() {
+		ids = append(ids, c.id)
+	}
+	expectedIDs := []string{clips[1].ID, clips[4].ID, clips[2].ID, clips[0].ID}
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("clips are sorted as %v, expected %v", ids, expectedIDs)
+	}
+
+	// the same as a complete rebuild
+	ClipIndex.lock.Lock()
+	rebuilt := &ClipIndexType{entries: ClipIndex.entries}
+	rebuilt.rebuild()
+	sorted, shares, usage, userUsage := ClipIndex.sorted, ClipIndex.shares, ClipIndex.usage, ClipIndex.userUsage
+	ClipIndex.lock.Unlock()
+
+	if !reflect.DeepEqual(sorted, rebuilt.sorted) {
+		t.Error("sorted clips differ from rebuilt index")
+	}
+	if !reflect.DeepEqual(shares, rebuilt.shares) || len(shares) != 1 {
+		t.Errorf("shares %v differ from rebuilt index %v", shares, rebuilt.shares)
+	}
+	if usage != rebuilt.usage || usage.Count != 4 || usage.TotalSize != 1+8+3+5 {
+		t.Errorf("usage %+v differs from rebuilt index %+v", usage, rebuilt.usage)
+	}
+	if !reflect.DeepEqual(userUsage, rebuilt.userUsage) {
+		t.Errorf("user usage %v differs from rebuilt index %v", userUsage, rebuilt.userUsage)
+	}
+}
+
+func TestClipIndexLoadReadsOnce(t *testing.T) {
+	server := newTestServer(t)
+
+	shared := server.upload("shared")
+	server.expectStatus(201, "POST", "/clips/"+shared.ID+"/shares", "")
+	server.upload("a")
+	server.upload("b")
+
+	storage := &readCountingStorage{Storage: ClipStorage, reads: map[string]int{}}
+	ClipStorage = storage
+	defer func() { ClipStorage = storage.Storage }()
+
+	if err := ClipIndex.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// meta data is read by the scan only, and shares only, if they exist
+	if storage.reads[".meta"] != 3 || storage.reads[".shares"] != 1 || storage.reads[""] != 0 {
+		t.Errorf("unexpected reads %v", storage.reads)
+	}
+	entry, _ := ClipIndex.Get(shared.ID)
+	if len(entry.ShareTokens) != 1 {
+		t.Fatalf("unexpected share tokens %v", entry.ShareTokens)
+	}
+	if id, ok := ClipIndex.FindShare(entry.ShareTokens[0]); !ok || id != shared.ID {
+		t.Error("share has not been loaded")
+	}
+	if ClipIndex.Count() != 3 {
+		t.Errorf("%d clips have been loaded", ClipIndex.Count())
+	}
+}
@@ -0,0 +1,678 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClipLayout - The layout of the keys of new clips in ClipStorage: "flat" ("<id>")
+// or "sharded" ("ab/cd/<id>", by the first characters of the ID)
+//
+// Clips are found in both layouts, so a storage can be migrated by MigrateClipLayout(),
+// while the server is running.
+var ClipLayout = "flat"
+
+// MigrationMarkerTimeout - The time, after which the marker of a clip, which is moved by
+// MigrateClipLayout(), is ignored, because the migration has been interrupted
+var MigrationMarkerTimeout = time.Minute
+
+// migrationWaitInterval - The time, the server waits for the end of the migration of a clip,
+// before it checks again, s. beginClipWrite()
+var migrationWaitInterval = 50 * time.Millisecond
+
+// MigrateLayoutReport - The result of MigrateClipLayout()
+type MigrateLayoutReport struct {
+	// clips, which have been moved into the new layout
+	Migrated int
+	// clips, which have been changed in the meantime, and have to be migrated again
+	Skipped int
+	// clips, which already use the new layout
+	Unchanged int
+}
+
+// clipLayoutObjects - The objects of a clip in one layout
+type clipLayoutObjects struct {
+	base    string
+	hasData bool
+}
+
+var shardNameRegex = regexp.MustCompile("^[0-9a-f]{2}$")
+
+// GetLayoutKey - Returns the key of the data of a clip in a layout
+func GetLayoutKey(id string, layout string) string {
+	if layout == "sharded" {
+		return path.Join(id[0:2], id[2:4], id)
+	}
+
+	return id
+}
+
+// GetClipKey - Returns the key of the data of a clip in the layout and namespace of its user,
+// where it is stored, ClipLayout for new clips
+//
+// Without data, like while a clip is replaced or deleted, the ".meta" object decides.
+func GetClipKey(id string) string {
+	if key, ok := findClipKey(id); ok {
+		return key
+	}
+
+	prefixes, _ := clipUserPrefixes(id)
+	for _, prefix := range prefixes {
+		for _, layout := range clipLayouts() {
+			key := prefix + GetLayoutKey(id, layout)
+			if _, err := ClipStorage.Stat(key + ".meta"); err == nil {
+				return key
+			}
+		}
+	}
+
+	name, _ := getClipUser(id)
+	return GetUserPrefix(name) + GetLayoutKey(id, ClipLayout)
+}
+
+// ListClipDirectories - Returns the keys of all directories of a storage, which can contain
+// the objects of clips, "" for the flat layout of the shared namespace
+func ListClipDirectories(storage Storage) ([]string, error) {
+	dirs := []string{}
+
+	prefixes, err := ListUserPrefixes(storage)
+	if err != nil {
+		return dirs, err
+	}
+
+	for _, prefix := range prefixes {
+		dirs = append(dirs, prefix)
+
+		shards, err := storage.ListDirectories(prefix)
+		if err != nil {
+			return dirs, err
+		}
+
+		for _, shard := range shards {
+			if !shardNameRegex.MatchString(path.Base(shard)) {
+				continue
+			}
+
+			subShards, err := storage.ListDirectories(shard)
+			if err != nil {
+				return dirs, err
+			}
+
+			for _, subShard := range subShards {
+				if shardNameRegex.MatchString(path.Base(subShard)) {
+					dirs = append(dirs, subShard)
+				}
+			}
+		}
+	}
+
+	return dirs, nil
+}
+
+// ListClipObjects - Returns the objects of clips in all layouts, like data, meta data,
+// shares and markers, but not their old versions
+func ListClipObjects(storage Storage) ([]StorageInfo, error) {
+	objects := make([]StorageInfo, 0)
+
+	dirs, err := ListClipDirectories(storage)
+	if err != nil {
+		return objects, err
+	}
+
+	for _, dir := range dirs {
+		dirObjects, err := storage.List(dir)
+		if err != nil {
+			return objects, err
+		}
+
+		objects = append(objects, dirObjects...)
+	}
+
+	return objects, nil
+}
+
+// MigrateClipLayout - Moves all clips into a layout, s. ClipLayout
+//
+// A clip is marked as "migrating" first, so the server waits with changing it, s. LockClip(),
+// copied, its data last, and deleted in the old layout, after it has been checked, that it has
+// not been changed in the meantime, so the server can keep running.
+// Clips, which are changed by the server at the moment, or have running operations, are skipped.
+func MigrateClipLayout(layout string) (MigrateLayoutReport, error) {
+	var report MigrateLayoutReport
+
+	// like after a crash of a previous migration
+	_, err := RecoverClipLayouts()
+	if err == nil {
+		_, err = RemoveClipMarkers(".migrating")
+	}
+	if err != nil {
+		return report, err
+	}
+
+	objects, err := ListClipObjects(ClipStorage)
+	if err != nil {
+		return report, err
+	}
+
+	for _, o := range objects {
+		id, suffix, ok := parseClipKey(o.Key)
+		if !ok || suffix != "" {
+			continue
+		}
+
+		prefix, _ := splitUserKey(o.Key)
+
+		dest := prefix + GetLayoutKey(id, layout)
+		if o.Key == dest {
+			report.Unchanged++
+			continue
+		}
+
+		migrated, err := migrateClip(o.Key, dest)
+		if err != nil {
+			return report, err
+		}
+
+		if migrated {
+			report.Migrated++
+		} else {
+			report.Skipped++
+		}
+	}
+
+	return report, nil
+}
+
+// RecoverClipLayouts - Removes the objects of clips, which exist in both layouts,
+// because their migration has been interrupted, and returns the number of clips
+//
+// The layout with data is kept, ClipLayout, if both have data.
+func RecoverClipLayouts() (int, error) {
+	clips, err := scanClipLayouts()
+	if err != nil {
+		return 0, err
+	}
+
+	recovered := 0
+	for id, layouts := range clips {
+		if len(layouts) < 2 {
+			continue
+		}
+
+		kept, err := recoverClipLayout(layouts)
+		if err != nil {
+			return recovered, err
+		}
+		if kept == "" {
+			// neither has data, s. RecoverOrphanedClips()
+			continue
+		}
+
+		log.Println("Completed interrupted migration of clip", id, "into", kept, "layout")
+		recovered++
+	}
+
+	return recovered, nil
+}
+
+// RemoveClipMarkers - Deletes all objects of clips with a suffix, like the ".writing" markers,
+// which have been left by a crash of the server, and returns their number
+func RemoveClipMarkers(suffix string) (int, error) {
+	objects, err := ListClipObjects(ClipStorage)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, o := range objects {
+		if _, s, ok := parseClipKey(o.Key); !ok || s != suffix {
+			continue
+		}
+
+		err := DeleteObjects(o.Key)
+		if err != nil {
+			return removed, err
+		}
+
+		removed++
+	}
+
+	return removed, nil
+}
+
+// beginClipWrite - Marks a clip as "writing", before the server changes it, and returns
+// the key of the marker, or an empty string, if the clip does not exist
+//
+// If the clip is moved by MigrateClipLayout() at the moment, it waits for the end of
+// the migration, and marks the clip in its new layout. A migration, which has been started
+// in the meantime, sees the marker, and skips the clip.
+func beginClipWrite(id string) string {
+	if ClipStorage == nil || !clipIDRegex.MatchString(id) {
+		return ""
+	}
+
+	for {
+		key, ok := findClipKey(id)
+		if !ok {
+			// nothing to migrate
+			return ""
+		}
+
+		marker := key + ".writing"
+
+		err := WriteObject(marker, []byte{})
+		if err != nil {
+			log.Println("[WARN] Could not mark clip", id, "as writing", err.Error())
+			return ""
+		}
+
+		// the data could have been moved, before the marker has been written
+		current, ok := findClipKey(id)
+		if ok && current == key && !isClipMigrating(id, key) {
+			return marker
+		}
+
+		DeleteObjects(marker)
+		time.Sleep(migrationWaitInterval)
+	}
+}
+
+// isClipMigrating - Checks, if a clip with a key is moved from or into it by MigrateClipLayout()
+func isClipMigrating(id string, key string) bool {
+	prefix, _ := splitUserKey(key)
+
+	for _, layout := range clipLayouts() {
+		info, err := ClipStorage.Stat(prefix + GetLayoutKey(id, layout) + ".migrating")
+		if err == nil && time.Since(info.ModTime) <= MigrationMarkerTimeout {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clipLayouts - Returns all layouts, ClipLayout first
+func clipLayouts() []string {
+	if ClipLayout == "sharded" {
+		return []string{"sharded", "flat"}
+	}
+
+	return []string{"flat", "sharded"}
+}
+
+// copyClipObject - Copies an object of a clip into a new key, replacing an existing one
+func copyClipObject(src string, dest string) error {
+	linker, ok := ClipStorage.(StorageLinker)
+	if !ok {
+		return CopyObject(src, dest)
+	}
+
+	dir, name := path.Split(dest)
+	tmpKey := dir + "." + name + ".tmp-migrate"
+
+	// shares the data, like with deduplicated clips
+	err := linker.Link(src, tmpKey)
+	if err == nil {
+		err = ClipStorage.Rename(tmpKey, dest)
+	}
+	if err != nil {
+		DeleteObjects(tmpKey)
+	}
+
+	return err
+}
+
+// clipUserPrefixes - Returns the prefixes of the keys, s. GetUserPrefix(), which can contain
+// a clip, only the one of its user, if it is known already
+func clipUserPrefixes(id string) ([]string, error) {
+	if name, ok := getClipUser(id); ok {
+		return []string{GetUserPrefix(name)}, nil
+	}
+
+	return ListUserPrefixes(ClipStorage)
+}
+
+// findClipKey - Returns the key of the data of a clip, if it exists in a layout
+// of the namespace of a user
+func findClipKey(id string) (string, bool) {
+	prefixes, _ := clipUserPrefixes(id)
+	for _, prefix := range prefixes {
+		for _, layout := range clipLayouts() {
+			key := prefix + GetLayoutKey(id, layout)
+			if _, err := ClipStorage.Stat(key); err == nil {
+				setClipUser(id, getPrefixUser(prefix))
+				return key, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// getKeyLayout - Returns the layout of the key of a clip
+func getKeyLayout(key string) string {
+	_, key = splitUserKey(key)
+	if strings.Contains(key, "/") {
+		return "sharded"
+	}
+
+	return "flat"
+}
+
+// listClipKeyObjects - Returns all objects of a clip with a key, like its data,
+// meta data, shares, markers and old versions
+func listClipKeyObjects(base string) ([]StorageInfo, error) {
+	objects := make([]StorageInfo, 0)
+
+	candidates, err := ClipStorage.List(base)
+	if err != nil {
+		return objects, err
+	}
+
+	for _, o := range candidates {
+		// like "<id>" and "<id>.meta", but no other IDs
+		if o.Key == base || strings.HasPrefix(o.Key, base+".") {
+			objects = append(objects, o)
+		}
+	}
+
+	versions, err := ClipStorage.List(base + ".versions/")
+	if err != nil {
+		return objects, err
+	}
+
+	return append(objects, versions...), nil
+}
+
+// migrateClip - Moves all objects of a clip from one key to another, returns false,
+// if the clip has been skipped
+func migrateClip(src string, dest string) (bool, error) {
+	var snapshot []StorageInfo
+
+	// the server waits with changes from now on, s. beginClipWrite(),
+	// and the marker is deleted with the other objects of the old key
+	marker := src + ".migrating"
+	err := WriteObject(marker, []byte{})
+	if err != nil {
+		return false, err
+	}
+	defer DeleteObjects(marker)
+
+	for attempt := 0; attempt < 3; attempt++ {
+		objects, err := listClipKeyObjects(src)
+		if err != nil {
+			return false, err
+		}
+		if !unchangedClipObjects(snapshot, objects) {
+			if !canMigrateClipObjects(src, objects) {
+				break
+			}
+
+			err = copyClipObjects(src, dest, objects)
+			if os.IsNotExist(err) {
+				// deleted in the meantime
+				break
+			}
+			if err != nil {
+				return false, err
+			}
+
+			snapshot = objects
+			continue
+		}
+
+		return true, deleteClipKeyObjects(src)
+	}
+
+	// nothing has been deleted yet
+	if snapshot != nil {
+		err := deleteClipKeyObjects(dest)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// canMigrateClipObjects - Checks, if a clip has data and no running operation,
+// and is not changed by the server at the moment
+func canMigrateClipObjects(base string, objects []StorageInfo) bool {
+	hasData := false
+	for _, o := range objects {
+		switch o.Key {
+		case base:
+			hasData = true
+		case base + ".burning", base + ".pending", base + ".writing":
+			return false
+		}
+	}
+
+	return hasData
+}
+
+// copyClipObjects - Copies objects of a clip into a new key, its data last,
+// and deletes all other objects of the new key
+func copyClipObjects(src string, dest string, objects []StorageInfo) error {
+	existing, err := listClipKeyObjects(dest)
+	if err != nil {
+		return err
+	}
+
+	copied := map[string]bool{}
+	for _, o := range sortClipObjects(src, objects) {
+		if o.Key == src+".migrating" {
+			continue
+		}
+
+		destKey := dest + strings.TrimPrefix(o.Key, src)
+
+		err := copyClipObject(o.Key, destKey)
+		if err != nil {
+			return err
+		}
+
+		copied[destKey] = true
+	}
+
+	// like deleted shares or versions
+	for _, o := range existing {
+		if !copied[o.Key] {
+			err := DeleteObjects(o.Key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteClipKeyObjects - Deletes all objects of a clip with a key, its data first,
+// so the clip is found in the other layout
+func deleteClipKeyObjects(base string) error {
+	objects, err := listClipKeyObjects(base)
+	if err != nil {
+		return err
+	}
+
+	sorted := sortClipObjects(base, objects)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		err := DeleteObjects(sorted[i].Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseClipKey - Returns the ID of a clip and the suffix of one of its objects,
+// like ".meta", if the key is stored in one of the layouts of a namespace, but not for old versions
+func parseClipKey(key string) (string, string, bool) {
+	_, key = splitUserKey(key)
+	dir, name := path.Split(key)
+
+	id, suffix := name, ""
+	if i := strings.Index(name, "."); i > -1 {
+		id, suffix = name[:i], name[i:]
+	}
+
+	if !clipIDRegex.MatchString(id) || GetLayoutKey(id, getKeyLayout(key)) != dir+id {
+		return "", "", false
+	}
+
+	return id, suffix, true
+}
+
+// recoverClipLayout - Deletes the objects of a clip in the layout, which is not kept,
+// and returns the kept layout, or an empty string, if none has data
+func recoverClipLayout(layouts map[string]*clipLayoutObjects) (string, error) {
+	kept := ""
+	for _, layout := range clipLayouts() {
+		if l, ok := layouts[layout]; ok && l.hasData {
+			kept = layout
+			break
+		}
+	}
+	if kept == "" {
+		return "", nil
+	}
+
+	for layout, l := range layouts {
+		if layout == kept {
+			continue
+		}
+
+		err := deleteClipKeyObjects(l.base)
+		if err != nil {
+			return kept, err
+		}
+	}
+
+	return kept, nil
+}
+
+// scanClipLayouts - Returns the layouts of all clips, which have objects in ClipStorage
+func scanClipLayouts() (map[string]map[string]*clipLayoutObjects, error) {
+	clips := map[string]map[string]*clipLayoutObjects{}
+
+	add := func(id string, base string, hasData bool) {
+		layouts, ok := clips[id]
+		if !ok {
+			layouts = map[string]*clipLayoutObjects{}
+			clips[id] = layouts
+		}
+
+		layout := getKeyLayout(base)
+
+		l, ok := layouts[layout]
+		if !ok {
+			l = &clipLayoutObjects{base: base}
+			layouts[layout] = l
+		}
+		l.hasData = l.hasData || hasData
+	}
+
+	dirs, err := ListClipDirectories(ClipStorage)
+	if err != nil {
+		return clips, err
+	}
+
+	for _, dir := range dirs {
+		objects, err := ClipStorage.List(dir)
+		if err != nil {
+			return clips, err
+		}
+
+		for _, o := range objects {
+			id, suffix, ok := parseClipKey(o.Key)
+			if ok {
+				add(id, strings.TrimSuffix(o.Key, suffix), suffix == "")
+			}
+		}
+
+		// versions, which have been copied before the data
+		subDirs, err := ClipStorage.ListDirectories(dir)
+		if err != nil {
+			return clips, err
+		}
+
+		for _, d := range subDirs {
+			key := strings.TrimSuffix(d, "/")
+
+			id, suffix, ok := parseClipKey(key)
+			if ok && suffix == ".versions" {
+				add(id, strings.TrimSuffix(key, suffix), false)
+			}
+		}
+	}
+
+	return clips, nil
+}
+
+// sortClipObjects - Sorts the objects of a clip with a key in the order, they are copied:
+// old versions, shares, meta data, and data last
+func sortClipObjects(base string, objects []StorageInfo) []StorageInfo {
+	rank := func(key string) int {
+		switch {
+		case key == base:
+			return 3
+		case key == base+".meta":
+			return 2
+		case strings.HasPrefix(key, base+".versions/"):
+			return 0
+		}
+
+		return 1
+	}
+
+	sorted := append([]StorageInfo{}, objects...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank(sorted[i].Key) < rank(sorted[j].Key)
+	})
+
+	return sorted
+}
+
+// unchangedClipObjects - Checks, if the objects of a clip are the same as before
+func unchangedClipObjects(before []StorageInfo, after []StorageInfo) bool {
+	if before == nil || len(before) != len(after) {
+		return false
+	}
+
+	infos := map[string]StorageInfo{}
+	for _, o := range before {
+		infos[o.Key] = o
+	}
+
+	for _, o := range after {
+		b, ok := infos[o.Key]
+		if !ok || b.Size != o.Size || !b.ModTime.Equal(o.ModTime) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,259 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clipKeyLayouts - Returns the layouts, in which a clip has objects
+func clipKeyLayouts(t *testing.T, id string) []string {
+	clips, err := scanClipLayouts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layouts := []string{}
+	for layout := range clips[id] {
+		layouts = append(layouts, layout)
+	}
+
+	return layouts
+}
+
+func TestMigrateClipLayout(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("v1", "Content-Type", "text/plain")
+	server.expectStatus(200, "PUT", "/clips/"+clip.ID, "v2", "Content-Type", "text/plain")
+	server.expectStatus(201, "POST", "/clips/"+clip.ID+"/shares", "")
+	other := server.upload("other")
+
+	for _, layout := range []string{"sharded", "flat"} {
+		report, err := MigrateClipLayout(layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Migrated != 2 || report.Skipped != 0 || report.Unchanged != 0 {
+			t.Fatalf("unexpected report %+v", report)
+		}
+
+		for _, id := range []string{clip.ID, other.ID} {
+			if layouts := clipKeyLayouts(t, id); len(layouts) != 1 || layouts[0] != layout {
+				t.Errorf("clip %s is stored in %v layout, expected %s", id, layouts, layout)
+			}
+		}
+
+		if data := server.expectStatus(200, "GET", "/clips/"+clip.ID, ""); data != "v2" {
+			t.Errorf("clip contains %q", data)
+		}
+		if data := server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions/1", ""); data != "v1" {
+			t.Errorf("version contains %q", data)
+		}
+
+		var shares []shareItem
+		json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/"+clip.ID+"/shares", "")), &shares)
+		if len(shares) != 1 {
+			t.Errorf("unexpected shares %+v", shares)
+		}
+	}
+
+	report, err := MigrateClipLayout("flat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 0 || report.Unchanged != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestRecoverClipLayouts(t *testing.T) {
+	server := newTestServer(t)
+	clip := server.upload("data")
+
+	// interrupted, before the old objects have been deleted
+	objects, err := listClipKeyObjects(clip.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := copyClipObjects(clip.ID, GetLayoutKey(clip.ID, "sharded"), objects); err != nil {
+		t.Fatal(err)
+	}
+
+	ClipLayout = "sharded"
+
+	recovered, err := RecoverClipLayouts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered != 1 {
+		t.Errorf("recovered %d clips", recovered)
+	}
+	if layouts := clipKeyLayouts(t, clip.ID); len(layouts) != 1 || layouts[0] != "sharded" {
+		t.Errorf("clip is stored in %v layout", layouts)
+	}
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID, ""); data != "data" {
+		t.Errorf("clip contains %q", data)
+	}
+}
+
+func TestMigrateClipLayoutSkipsChangedClips(t *testing.T) {
+	server := newTestServer(t)
+	clip := server.upload("data")
+
+	// changed by the server at the moment
+	unlock := LockClip(clip.ID)
+	report, err := MigrateClipLayout("sharded")
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 0 || report.Skipped != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if layouts := clipKeyLayouts(t, clip.ID); len(layouts) != 1 || layouts[0] != "flat" {
+		t.Errorf("clip is stored in %v layout", layouts)
+	}
+
+	report, err = MigrateClipLayout("sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestLockClipWaitsForMigration(t *testing.T) {
+	server := newTestServer(t)
+	clip := server.upload("data")
+
+	marker := clip.ID + ".migrating"
+	if err := WriteObject(marker, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan bool)
+	go func() {
+		unlock := LockClip(clip.ID)
+		unlock()
+
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("clip has been locked while it is migrated")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	DeleteObjects(marker)
+	<-locked
+
+	// left by an interrupted migration
+	if err := WriteObject(marker, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := MigrationMarkerTimeout
+	MigrationMarkerTimeout = 0
+	defer func() { MigrationMarkerTimeout = timeout }()
+
+	LockClip(clip.ID)()
+}
+
+func TestMigrateClipLayoutConcurrently(t *testing.T) {
+	server := newTestServer(t)
+
+	clips := []uploadFileResponse{}
+	for i := 0; i < 4; i++ {
+		clips = append(clips, server.upload(fmt.Sprint("clip ", i)))
+	}
+
+	stop := make(chan bool)
+	var migrations sync.WaitGroup
+	var stopOnce sync.Once
+	stopMigrations := func() {
+		stopOnce.Do(func() { close(stop) })
+		migrations.Wait()
+	}
+	// also, if the test fails
+	defer stopMigrations()
+
+	migrations.Add(1)
+	go func() {
+		defer migrations.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			layout := "flat"
+			if i%2 == 0 {
+				layout = "sharded"
+			}
+
+			if _, err := MigrateClipLayout(layout); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// changes of all clips must survive their migrations
+	for i := 0; i < 15; i++ {
+		for _, clip := range clips {
+			server.expectStatus(200, "PATCH", "/clips/"+clip.ID, fmt.Sprintf(`{"name":"name %d"}`, i))
+			server.expectStatus(201, "POST", "/clips/"+clip.ID+"/shares", "")
+		}
+	}
+
+	stopMigrations()
+
+	for _, clip := range clips {
+		var shares []shareItem
+		json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/"+clip.ID+"/shares", "")), &shares)
+		if len(shares) != 15 {
+			t.Errorf("clip %s has %d shares", clip.ID, len(shares))
+		}
+
+		if layouts := clipKeyLayouts(t, clip.ID); len(layouts) != 1 {
+			t.Errorf("clip %s is stored in %v layouts", clip.ID, layouts)
+		}
+
+		clipMeta, err := ClipMetaStore.Read(clip.ID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clipMeta.Name != "name 14" {
+			t.Errorf("clip %s has name %q", clip.ID, clipMeta.Name)
+		}
+	}
+
+	for _, suffix := range []string{".migrating", ".writing"} {
+		if removed, err := RemoveClipMarkers(suffix); err != nil || removed != 0 {
+			t.Errorf("%d %s markers are left: %v", removed, suffix, err)
+		}
+	}
+}
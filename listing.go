@@ -0,0 +1,246 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxClipListLimit - Maximum number of items per page of a clip list
+const MaxClipListLimit = 1000
+
+type clipListCursor struct {
+	Sort             string `json:"s"`
+	ID               string `json:"i"`
+	Name             string `json:"n,omitempty"`
+	CreationTime     int64  `json:"c,omitempty"`
+	UploadTime       int64  `json:"u,omitempty"`
+	ModificationTime int64  `json:"m,omitempty"`
+	Size             int64  `json:"z,omitempty"`
+}
+
+type clipListOptions struct {
+	Cursor         *clipListCursor
+	Limit          int
+	MIME           string
+	Name           string
+	CreatedAfter   int64
+	CreatedBefore  int64
+	ModifiedAfter  int64
+	ModifiedBefore int64
+	Sort           string
+}
+
+var clipListSorters = map[string]func(a, b clipItem) bool{
+	"newest": func(a, b clipItem) bool {
+		if a.uploadTimeNs != b.uploadTimeNs {
+			return a.uploadTimeNs > b.uploadTimeNs
+		}
+		return a.ID < b.ID
+	},
+	"oldest": func(a, b clipItem) bool {
+		if a.uploadTimeNs != b.uploadTimeNs {
+			return a.uploadTimeNs < b.uploadTimeNs
+		}
+		return a.ID < b.ID
+	},
+	"size": func(a, b clipItem) bool {
+		// largest first
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.ID < b.ID
+	},
+	"name": func(a, b clipItem) bool {
+		nameA := strings.ToLower(a.Name)
+		nameB := strings.ToLower(b.Name)
+		if nameA != nameB {
+			return nameA < nameB
+		}
+		return a.ID < b.ID
+	},
+}
+
+// ApplyTo - Filters, sorts and pages a list of clip items
+//
+// Returns the items of the page and the cursor of the next page, if there is one.
+func (o clipListOptions) ApplyTo(items []clipItem) ([]clipItem, string) {
+	less := clipListSorters[o.Sort]
+
+	filteredItems := make([]clipItem, 0)
+	for _, item := range items {
+		if o.includes(item) {
+			filteredItems = append(filteredItems, item)
+		}
+	}
+
+	sort.SliceStable(filteredItems, func(i, j int) bool {
+		return less(filteredItems[i], filteredItems[j])
+	})
+
+	if o.Limit < 1 || len(filteredItems) <= o.Limit {
+		return filteredItems, ""
+	}
+
+	page := filteredItems[0:o.Limit]
+
+	last := page[len(page)-1]
+	cursor := clipListCursor{
+		Sort:             o.Sort,
+		ID:               last.ID,
+		Name:             last.Name,
+		CreationTime:     last.CreationTime,
+		UploadTime:       last.uploadTimeNs,
+		ModificationTime: last.ModificationTime,
+		Size:             last.Size,
+	}
+
+	cursorBytes, err := json.Marshal(cursor)
+	if err != nil {
+		return page, ""
+	}
+
+	return page, base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
+
+func (c clipListCursor) toClipItem() clipItem {
+	var item clipItem
+	item.ID = c.ID
+	item.Name = c.Name
+	item.CreationTime = c.CreationTime
+	item.uploadTimeNs = c.UploadTime
+	item.ModificationTime = c.ModificationTime
+	item.Size = c.Size
+
+	return item
+}
+
+func (o clipListOptions) includes(item clipItem) bool {
+	if !o.matches(item) {
+		return false
+	}
+
+	// skip everything up to the cursor
+	if o.Cursor != nil && !clipListSorters[o.Sort](o.Cursor.toClipItem(), item) {
+		return false
+	}
+
+	return true
+}
+
+func (o clipListOptions) matches(item clipItem) bool {
+	if o.MIME != "" && !MatchesMIMEPattern(item.MIME, o.MIME) {
+		return false
+	}
+	if o.Name != "" && !strings.Contains(strings.ToLower(item.Name), o.Name) {
+		return false
+	}
+	if o.CreatedAfter > 0 && item.CreationTime < o.CreatedAfter {
+		return false
+	}
+	if o.CreatedBefore > 0 && item.CreationTime > o.CreatedBefore {
+		return false
+	}
+	if o.ModifiedAfter > 0 && item.ModificationTime < o.ModifiedAfter {
+		return false
+	}
+	if o.ModifiedBefore > 0 && item.ModificationTime > o.ModifiedBefore {
+		return false
+	}
+
+	return true
+}
+
+// MatchesMIMEPattern - Checks if a MIME type matches a pattern like "image/png", "image/*" or "*/*"
+func MatchesMIMEPattern(mime string, pattern string) bool {
+	// ignore parameters like "charset"
+	mime = strings.TrimSpace(strings.ToLower(strings.SplitN(mime, ";", 2)[0]))
+
+	if pattern == "*" || pattern == "*/*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mime, pattern[0:len(pattern)-1])
+	}
+
+	return mime == pattern
+}
+
+func parseClipListOptions(query url.Values) (clipListOptions, error) {
+	var options clipListOptions
+
+	options.Sort = strings.TrimSpace(strings.ToLower(query.Get("sort")))
+	if options.Sort == "" {
+		options.Sort = "newest"
+	}
+	if _, ok := clipListSorters[options.Sort]; !ok {
+		return options, errors.New("Invalid value for sort")
+	}
+
+	limit := strings.TrimSpace(query.Get("limit"))
+	if limit != "" {
+		var err error
+		options.Limit, err = strconv.Atoi(limit)
+		if err != nil || options.Limit < 1 || options.Limit > MaxClipListLimit {
+			return options, errors.New("Invalid value for limit")
+		}
+	}
+
+	cursor := strings.TrimSpace(query.Get("cursor"))
+	if cursor != "" {
+		cursorBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return options, errors.New("Invalid value for cursor")
+		}
+
+		options.Cursor = &clipListCursor{}
+		err = json.Unmarshal(cursorBytes, options.Cursor)
+		if err != nil || options.Cursor.Sort != options.Sort {
+			return options, errors.New("Invalid value for cursor")
+		}
+	}
+
+	options.MIME = strings.TrimSpace(strings.ToLower(query.Get("mime")))
+	options.Name = strings.TrimSpace(strings.ToLower(query.Get("name")))
+
+	timeFilters := map[string]*int64{
+		"created_after":   &options.CreatedAfter,
+		"created_before":  &options.CreatedBefore,
+		"modified_after":  &options.ModifiedAfter,
+		"modified_before": &options.ModifiedBefore,
+	}
+	for name, value := range timeFilters {
+		str := strings.TrimSpace(query.Get(name))
+		if str == "" {
+			continue
+		}
+
+		var err error
+		*value, err = strconv.ParseInt(str, 10, 64)
+		if err != nil || *value < 0 {
+			return options, errors.New("Invalid value for " + name)
+		}
+	}
+
+	return options, nil
+}
@@ -0,0 +1,156 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+// listAllClips - Follows the cursors of a clip list and returns the IDs of all pages
+func listAllClips(t *testing.T, server *testServer, query url.Values, between func(page int)) []string {
+	ids := []string{}
+
+	for page := 0; ; page++ {
+		resp, data := server.do("GET", "/clips?"+query.Encode(), "")
+		if resp.StatusCode != 200 {
+			t.Fatalf("list returned %d %q", resp.StatusCode, data)
+		}
+
+		var items []clipItem
+		json.Unmarshal([]byte(data), &items)
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+
+		cursor := resp.Header.Get("X-Cclip-Next-Cursor")
+		if cursor == "" {
+			return ids
+		}
+		if resp.Header.Get("Link") == "" {
+			t.Error("Link header is missing")
+		}
+
+		query.Set("cursor", cursor)
+		if between != nil {
+			between(page)
+		}
+	}
+}
+
+func TestClipListCursor(t *testing.T) {
+	server := newTestServer(t)
+
+	uploaded := []string{}
+	for _, data := range []string{"1", "22", "333", "4444", "55555", "666666", "7777777"} {
+		uploaded = append([]string{server.upload(data).ID}, uploaded...)
+	}
+
+	ids := listAllClips(t, server, url.Values{"limit": {"3"}}, nil)
+	if len(ids) != 7 {
+		t.Fatalf("listed %d clips", len(ids))
+	}
+	for i := range ids {
+		if ids[i] != uploaded[i] {
+			t.Errorf("clip %d is %s, expected %s", i, ids[i], uploaded[i])
+		}
+	}
+
+	// deleting a listed clip does not skip the next ones, and new clips are not repeated
+	var added string
+	ids = listAllClips(t, server, url.Values{"limit": {"3"}}, func(page int) {
+		if page == 0 {
+			server.expectStatus(204, "DELETE", "/clips/"+uploaded[1], "")
+			added = server.upload("new").ID
+		}
+	})
+
+	expected := uploaded
+	if len(ids) != len(expected) {
+		t.Fatalf("listed %v, expected %v", ids, expected)
+	}
+	for i := range ids {
+		if ids[i] != expected[i] || ids[i] == added {
+			t.Errorf("clip %d is %s, expected %s", i, ids[i], expected[i])
+		}
+	}
+}
+
+func TestClipListSortAndFilters(t *testing.T) {
+	server := newTestServer(t)
+
+	b := server.upload("bb", "X-Cclip-Name", "Beta", "Content-Type", "text/plain")
+	a := server.upload("aaaa", "X-Cclip-Name", "alpha", "Content-Type", "text/markdown")
+	c := server.upload("c", "X-Cclip-Name", "gamma", "Content-Type", "image/png")
+
+	tests := []struct {
+		query    url.Values
+		expected []string
+	}{
+		{url.Values{"sort": {"oldest"}}, []string{b.ID, a.ID, c.ID}},
+		{url.Values{"sort": {"size"}}, []string{a.ID, b.ID, c.ID}},
+		{url.Values{"sort": {"name"}, "limit": {"1"}}, []string{a.ID, b.ID, c.ID}},
+		{url.Values{"mime": {"text/*"}}, []string{a.ID, b.ID}},
+		{url.Values{"mime": {"image/png"}}, []string{c.ID}},
+		{url.Values{"name": {"A"}, "sort": {"name"}}, []string{a.ID, b.ID, c.ID}},
+		{url.Values{"name": {"et"}}, []string{b.ID}},
+		{url.Values{"created_after": {"4102444800"}}, []string{}},
+	}
+	for _, test := range tests {
+		ids := listAllClips(t, server, test.query, nil)
+		if len(ids) != len(test.expected) {
+			t.Errorf("%v listed %v, expected %v", test.query, ids, test.expected)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.expected[i] {
+				t.Errorf("%v listed %v, expected %v", test.query, ids, test.expected)
+				break
+			}
+		}
+	}
+
+	resp, _ := server.do("GET", "/clips?sort=size&limit=1", "")
+	otherSortCursor := resp.Header.Get("X-Cclip-Next-Cursor")
+
+	for _, query := range []string{"limit=0", "limit=1001", "sort=random", "cursor=%21", "cursor=" + otherSortCursor, "created_after=-1"} {
+		server.expectStatus(400, "GET", "/clips?"+query, "")
+	}
+}
+
+func TestMatchesMIMEPattern(t *testing.T) {
+	tests := []struct {
+		mime    string
+		pattern string
+		matches bool
+	}{
+		{"text/plain", "text/plain", true},
+		{"Text/Plain; charset=utf-8", "text/plain", true},
+		{"text/plain", "text/*", true},
+		{"text/plain", "*/*", true},
+		{"text/plain", "*", true},
+		{"texts/plain", "text/*", false},
+		{"image/png", "text/*", false},
+		{"text/plain", "text/html", false},
+	}
+	for _, test := range tests {
+		if MatchesMIMEPattern(test.mime, test.pattern) != test.matches {
+			t.Errorf("MatchesMIMEPattern(%q, %q) is not %v", test.mime, test.pattern, test.matches)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MaxLockoutDuration - The maximum duration of a ban, s. LockoutDuration
+const MaxLockoutDuration = 24 * time.Hour
+
+// lockoutForgetAfter - The time, after which the failures of a client are forgotten,
+// since it has been blocked last
+const lockoutForgetAfter = 24 * time.Hour
+
+// LockoutDuration - The duration of the first ban of a client, which is doubled
+// with every further ban, up to MaxLockoutDuration
+var LockoutDuration = 5 * time.Minute
+
+// LockoutThreshold - The number of failed authentications of a client, after which
+// it is banned for LockoutDuration, or 0 to disable lockouts
+var LockoutThreshold = 5
+
+// TrustedProxies - The networks of the proxies, whose X-Forwarded-For header is used
+// to get the IP of a client, s. GetClientIP()
+var TrustedProxies = []*net.IPNet{}
+
+// ErrBanNotFound - Is returned, if a client is not banned
+var ErrBanNotFound = errors.New("Ban not found")
+
+// authFailures - The failed authentications of a client
+type authFailures struct {
+	// failed authentications since the last ban or successful authentication
+	Failures int
+	// number of bans, which have not been forgotten yet
+	Bans int
+	// if the client is blocked by a ban, not only by the backoff after a failure
+	Banned bool
+	// the client is blocked until then
+	BlockedUntil time.Time
+}
+
+type banItem struct {
+	IP      string `json:"ip"`
+	Bans    int    `json:"bans"`
+	Expires int64  `json:"expires"`
+}
+
+// serverLockout - The failed authentications of all clients by their IP
+var serverLockout = struct {
+	lock    sync.Mutex
+	clients map[string]*authFailures
+	pruned  time.Time
+}{
+	clients: map[string]*authFailures{},
+}
+
+// GetClientIP - Returns the IP of the client of a HTTP request, which is taken
+// from X-Forwarded-For, if the request comes from TrustedProxies
+func GetClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	// the last addresses have been added by the proxies, the first ones can be forged by the client
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(ip); i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+
+		ip = forwardedIP
+	}
+
+	return ip.String()
+}
+
+// ParseTrustedProxies - Parses a comma separated list of IPs and networks in CIDR notation
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0)
+
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return proxies, errors.New("Invalid IP " + p)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			p += "/" + strconv.Itoa(bits)
+		}
+
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return proxies, err
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+// canManageBans - Checks if a user can list and lift bans, like admins, and the shared namespace
+// with Password or a shared API token with the scope "admin"
+func canManageBans(u User) bool {
+	return u.IsAdmin() || (u.Name == "" && u.HasScope("admin"))
+}
+
+// checkLockout - Returns the time, a client has to wait before it can authenticate again
+func checkLockout(ip string) (time.Duration, bool) {
+	serverLockout.lock.Lock()
+	defer serverLockout.lock.Unlock()
+
+	client, ok := serverLockout.clients[ip]
+	if !ok {
+		return 0, false
+	}
+
+	retryAfter := time.Until(client.BlockedUntil)
+	return retryAfter, retryAfter > 0
+}
+
+// clearLockout - Removes the failed authentications and bans of a client
+func clearLockout(ip string) bool {
+	serverLockout.lock.Lock()
+	defer serverLockout.lock.Unlock()
+
+	_, ok := serverLockout.clients[ip]
+	delete(serverLockout.clients, ip)
+
+	return ok
+}
+
+// deleteBan - Lifts the ban of a client
+func deleteBan(w http.ResponseWriter, req *http.Request) {
+	if !canManageBans(GetRequestUser(req)) {
+		http.Error(w, "Admins only", 403)
+		return
+	}
+
+	vars := mux.Vars(req)
+
+	ip := net.ParseIP(vars["ip"])
+	if ip == nil {
+		http.Error(w, "Invalid IP", 400)
+		return
+	}
+
+	if !clearLockout(ip.String()) {
+		http.Error(w, ErrBanNotFound.Error(), 404)
+		return
+	}
+
+	log.Println("Lifted ban of", ip.String())
+
+	w.WriteHeader(204)
+}
+
+// deleteBans - Lifts all bans and forgets all failed authentications
+func deleteBans(w http.ResponseWriter, req *http.Request) {
+	if !canManageBans(GetRequestUser(req)) {
+		http.Error(w, "Admins only", 403)
+		return
+	}
+
+	serverLockout.lock.Lock()
+	serverLockout.clients = map[string]*authFailures{}
+	serverLockout.lock.Unlock()
+
+	log.Println("Lifted all bans")
+
+	w.WriteHeader(204)
+}
+
+// doubleLockoutDuration - Doubles a duration n times, up to MaxLockoutDuration
+func doubleLockoutDuration(duration time.Duration, n int) time.Duration {
+	for i := 0; i < n && duration < MaxLockoutDuration; i++ {
+		duration *= 2
+	}
+	if duration > MaxLockoutDuration {
+		duration = MaxLockoutDuration
+	}
+
+	return duration
+}
+
+// getBans - Lists all clients, which are banned currently
+func getBans(w http.ResponseWriter, req *http.Request) {
+	if !canManageBans(GetRequestUser(req)) {
+		http.Error(w, "Admins only", 403)
+		return
+	}
+
+	now := time.Now()
+
+	items := make([]banItem, 0)
+
+	serverLockout.lock.Lock()
+	for ip, client := range serverLockout.clients {
+		if client.Banned && now.Before(client.BlockedUntil) {
+			items = append(items, banItem{IP: ip, Bans: client.Bans, Expires: client.BlockedUntil.Unix()})
+		}
+	}
+	serverLockout.lock.Unlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].IP < items[j].IP
+	})
+
+	bytes, err := json.Marshal(items)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	w.Write(bytes)
+}
+
+// isTrustedProxy - Checks if an IP belongs to TrustedProxies
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordAuthFailure - Blocks a client after a failed authentication for 1 second,
+// which is doubled with every further failure, and bans it, after LockoutThreshold failures
+func recordAuthFailure(ip string) {
+	if LockoutThreshold < 1 {
+		return
+	}
+
+	now := time.Now()
+
+	serverLockout.lock.Lock()
+	defer serverLockout.lock.Unlock()
+
+	// not for each failure, which could be sent by many clients
+	if now.Sub(serverLockout.pruned) > time.Minute {
+		for clientIP, client := range serverLockout.clients {
+			if now.Sub(client.BlockedUntil) > lockoutForgetAfter {
+				delete(serverLockout.clients, clientIP)
+			}
+		}
+
+		serverLockout.pruned = now
+	}
+
+	client, ok := serverLockout.clients[ip]
+	if !ok {
+		client = &authFailures{}
+		serverLockout.clients[ip] = client
+	}
+
+	client.Failures++
+	client.Banned = client.Failures >= LockoutThreshold
+
+	if !client.Banned {
+		client.BlockedUntil = now.Add(doubleLockoutDuration(time.Second, client.Failures-1))
+
+		log.Println("Authentication of", ip, "failed", client.Failures, "time(s)")
+		return
+	}
+
+	client.Bans++
+	client.Failures = 0
+
+	duration := doubleLockoutDuration(LockoutDuration, client.Bans-1)
+	client.BlockedUntil = now.Add(duration)
+
+	log.Println("[WARN] Banned", ip, "for", duration, "after", LockoutThreshold, "failed authentications")
+}
+
+// recordAuthSuccess - Resets the failed authentications of a client, but keeps its bans,
+// so further bans take longer
+func recordAuthSuccess(ip string) {
+	serverLockout.lock.Lock()
+	defer serverLockout.lock.Unlock()
+
+	client, ok := serverLockout.clients[ip]
+	if !ok {
+		return
+	}
+
+	client.Failures = 0
+	if client.Bans == 0 {
+		delete(serverLockout.clients, ip)
+	}
+}
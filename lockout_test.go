@@ -0,0 +1,208 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// addTestToken - Adds an API token of a user, "" for the shared namespace, to TokensFile,
+// and returns the value of the Authorization header of its requests
+func addTestToken(t *testing.T, userName string, scopes ...string) string {
+	token, secret, err := CreateAPIToken(userName, "test", scopes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := ReadAPITokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = WriteAPITokens(append(tokens, token))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "Bearer " + secret
+}
+
+// getLockout - Returns a copy of the failed authentications of a client
+func getLockout(ip string) (authFailures, bool) {
+	serverLockout.lock.Lock()
+	defer serverLockout.lock.Unlock()
+
+	client, ok := serverLockout.clients[ip]
+	if !ok {
+		return authFailures{}, false
+	}
+
+	return *client, true
+}
+
+func TestLockout(t *testing.T) {
+	server := newTestServer(t)
+	Password = "secret"
+	LockoutThreshold = 3
+
+	server.expectStatus(401, "GET", "/clips", "", "Authorization", "Bearer wrong")
+
+	// even with valid credentials
+	resp, _ := server.do("GET", "/clips", "", "Authorization", "Bearer secret")
+	if resp.StatusCode != 429 || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("blocked client received %d with Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// the backoff is doubled with each failure
+	for failures := 2; failures <= 3; failures++ {
+		serverLockout.lock.Lock()
+		serverLockout.clients["127.0.0.1"].BlockedUntil = time.Now()
+		serverLockout.lock.Unlock()
+
+		server.expectStatus(401, "GET", "/clips", "", "Authorization", "Bearer wrong")
+	}
+
+	client, _ := getLockout("127.0.0.1")
+	if !client.Banned || client.Bans != 1 || client.Failures != 0 || time.Until(client.BlockedUntil) < LockoutDuration-time.Minute {
+		t.Fatalf("unexpected lockout %+v", client)
+	}
+
+	resp, _ = server.do("GET", "/clips", "", "Authorization", "Bearer secret")
+	if resp.StatusCode != 429 || resp.Header.Get("Retry-After") != "300" {
+		t.Fatalf("banned client received %d with Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// the ban is kept after a successful authentication, so the next one takes longer
+	serverLockout.lock.Lock()
+	serverLockout.clients["127.0.0.1"].BlockedUntil = time.Now()
+	serverLockout.lock.Unlock()
+
+	server.expectStatus(200, "GET", "/clips", "", "Authorization", "Bearer secret")
+	for i := 0; i < 3; i++ {
+		recordAuthFailure("127.0.0.1")
+	}
+
+	client, _ = getLockout("127.0.0.1")
+	if client.Bans != 2 || time.Until(client.BlockedUntil) <= LockoutDuration {
+		t.Errorf("unexpected lockout %+v", client)
+	}
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	resetTestSettings(t)
+	LockoutThreshold = 100
+
+	for i := 0; i < 99; i++ {
+		recordAuthFailure("203.0.113.7")
+
+		client, _ := getLockout("203.0.113.7")
+		if retryAfter := time.Until(client.BlockedUntil); retryAfter <= 0 || retryAfter > MaxLockoutDuration {
+			t.Fatalf("client is blocked for %s after %d failures", retryAfter, client.Failures)
+		}
+	}
+
+	for i := 1; i < 10; i++ {
+		recordAuthFailure("203.0.113.8")
+	}
+
+	client, _ := getLockout("203.0.113.8")
+	if retryAfter := time.Until(client.BlockedUntil); retryAfter < 255*time.Second || retryAfter > 256*time.Second {
+		t.Errorf("client is blocked for %s after 9 failures", retryAfter)
+	}
+}
+
+func TestLockoutPrune(t *testing.T) {
+	resetTestSettings(t)
+
+	forgotten := time.Now().Add(-lockoutForgetAfter - time.Hour)
+
+	serverLockout.lock.Lock()
+	serverLockout.clients["203.0.113.7"] = &authFailures{Bans: 1, BlockedUntil: forgotten}
+	serverLockout.pruned = time.Time{}
+	serverLockout.lock.Unlock()
+
+	recordAuthFailure("203.0.113.8")
+	if _, ok := getLockout("203.0.113.7"); ok {
+		t.Error("forgotten client has not been pruned")
+	}
+
+	// at most once per minute
+	serverLockout.lock.Lock()
+	serverLockout.clients["203.0.113.7"] = &authFailures{Bans: 1, BlockedUntil: forgotten}
+	serverLockout.lock.Unlock()
+
+	recordAuthFailure("203.0.113.9")
+	if _, ok := getLockout("203.0.113.7"); !ok {
+		t.Error("clients have been pruned again")
+	}
+}
+
+func TestManageBans(t *testing.T) {
+	server := newTestServer(t)
+	Password = "secret"
+
+	admin := addTestUser(t, "admin", "admin")
+	user := addTestUser(t, "user", "user")
+
+	for i := 0; i < LockoutThreshold; i++ {
+		recordAuthFailure("203.0.113.7")
+	}
+
+	allowed := []string{
+		admin,
+		"Bearer secret",
+		addTestToken(t, "", "admin"),
+		addTestToken(t, "admin", "read", "admin"),
+	}
+	for _, auth := range allowed {
+		var bans []banItem
+		json.Unmarshal([]byte(server.expectStatus(200, "GET", "/bans", "", "Authorization", auth)), &bans)
+		if len(bans) != 1 || bans[0].IP != "203.0.113.7" || bans[0].Bans != 1 {
+			t.Errorf("unexpected bans %+v", bans)
+		}
+	}
+
+	denied := []string{
+		user,
+		addTestToken(t, "", "read", "write", "delete"),
+		addTestToken(t, "admin", "read"),
+		addTestToken(t, "user", "admin"),
+	}
+	for _, auth := range denied {
+		resp, _ := server.do("GET", "/bans", "", "Authorization", auth)
+		if resp.StatusCode != 403 {
+			t.Errorf("GET /bans returned %d with %s", resp.StatusCode, auth)
+		}
+
+		resp, _ = server.do("DELETE", "/bans/203.0.113.7", "", "Authorization", auth)
+		if resp.StatusCode != 403 {
+			t.Errorf("DELETE /bans returned %d with %s", resp.StatusCode, auth)
+		}
+	}
+
+	server.expectStatus(400, "DELETE", "/bans/invalid", "", "Authorization", "Bearer secret")
+	server.expectStatus(204, "DELETE", "/bans/203.0.113.7", "", "Authorization", "Bearer secret")
+	server.expectStatus(404, "DELETE", "/bans/203.0.113.7", "", "Authorization", "Bearer secret")
+
+	recordAuthFailure("203.0.113.8")
+	server.expectStatus(204, "DELETE", "/bans", "", "Authorization", addTestToken(t, "", "admin"))
+	if _, ok := getLockout("203.0.113.8"); ok {
+		t.Error("failed authentications have not been forgotten")
+	}
+}
@@ -0,0 +1,113 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+)
+
+// MetaStore - Stores the meta data of clips and their old versions
+//
+// Version 0 is the current version of a clip. All methods return an error,
+// which satisfies os.IsNotExist(), if the meta data does not exist.
+type MetaStore interface {
+	// Delete - Deletes the meta data of a clip version
+	Delete(id string, version int64) error
+	// List - Returns the meta data of all clips, without their old versions, by ID
+	List() (map[string]clipMetaData, error)
+	// Read - Reads the meta data of a clip version
+	Read(id string, version int64) (clipMetaData, error)
+	// Write - Creates or replaces the meta data of a clip version,
+	// after its data has been stored
+	Write(id string, version int64, clipMeta clipMetaData) error
+}
+
+// FileMetaStore - Stores meta data as JSON objects next to the data in ClipStorage,
+// like "<id>.meta" or "<id>.versions/1.meta"
+type FileMetaStore struct {
+}
+
+// ClipMetaStore - The store of the meta data of all clips
+var ClipMetaStore MetaStore = &FileMetaStore{}
+
+// Delete - Deletes a ".meta" object
+func (s *FileMetaStore) Delete(id string, version int64) error {
+	return ClipStorage.Delete(GetMetaFile(id, version))
+}
+
+// List - Reads all ".meta" objects of clips
+func (s *FileMetaStore) List() (map[string]clipMetaData, error) {
+	metas := map[string]clipMetaData{}
+
+	objects, err := ListClipObjects(ClipStorage)
+	if err != nil {
+		return metas, err
+	}
+
+	for _, o := range objects {
+		id, suffix, ok := parseClipKey(o.Key)
+		if !ok || suffix != ".meta" {
+			continue
+		}
+
+		clipMeta, err := readMetaObject(o.Key)
+		if IsEncryptionError(err) {
+			// otherwise, the data would be handled as orphaned
+			return metas, err
+		}
+		if err != nil {
+			// unreadable or deleted in the meantime
+			continue
+		}
+
+		metas[id] = clipMeta
+	}
+
+	return metas, nil
+}
+
+// Read - Reads and parses a ".meta" object
+func (s *FileMetaStore) Read(id string, version int64) (clipMetaData, error) {
+	return readMetaObject(GetMetaFile(id, version))
+}
+
+// readMetaObject - Reads and parses a ".meta" object by its key
+func readMetaObject(key string) (clipMetaData, error) {
+	var clipMeta clipMetaData
+
+	clipMetaBytes, err := ReadObject(key)
+	if err == nil {
+		err = json.Unmarshal(clipMetaBytes, &clipMeta)
+	}
+
+	return clipMeta, err
+}
+
+// Write - Writes a ".meta" object atomically
+func (s *FileMetaStore) Write(id string, version int64, clipMeta clipMetaData) error {
+	clipMetaBytes, err := json.Marshal(clipMeta)
+	if err != nil {
+		return err
+	}
+
+	return WriteObject(GetMetaFile(id, version), clipMetaBytes)
+}
+
+// GetMetaFile - Returns the key of the ".meta" object of a clip version in ClipStorage
+func GetMetaFile(id string, version int64) string {
+	return GetClipDataFile(id, version) + ".meta"
+}
@@ -0,0 +1,346 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	// SQLite driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// MetaDatabaseFileName - The name of the SQLite database inside ClipDirectory
+const MetaDatabaseFileName = "meta.db"
+
+// SQLiteMetaStore - Stores meta data in an embedded SQLite database
+//
+// Each row also contains the size of the data, which is stored before the meta data.
+type SQLiteMetaStore struct {
+	db *sql.DB
+}
+
+const sqliteMetaSchema = `
+CREATE TABLE IF NOT EXISTS clips (
+	id TEXT NOT NULL,
+	version INTEGER NOT NULL DEFAULT 0,
+	name TEXT NOT NULL DEFAULT '',
+	mime TEXT NOT NULL DEFAULT '',
+	expires INTEGER NOT NULL DEFAULT 0,
+	burn INTEGER NOT NULL DEFAULT 0,
+	sha256 TEXT NOT NULL DEFAULT '',
+	ctime INTEGER NOT NULL DEFAULT 0,
+	utime INTEGER NOT NULL DEFAULT 0,
+	mtime INTEGER NOT NULL DEFAULT 0,
+	encoding TEXT NOT NULL DEFAULT '',
+	decoded_size INTEGER NOT NULL DEFAULT 0,
+	size INTEGER NOT NULL DEFAULT -1,
+	PRIMARY KEY (id, version)
+);
+CREATE INDEX IF NOT EXISTS clips_utime ON clips (version, utime);
+CREATE INDEX IF NOT EXISTS clips_sha256 ON clips (sha256);
+`
+
+const sqliteMetaColumns = "name, mime, expires, burn, sha256, ctime, utime, mtime, encoding, decoded_size"
+
+// sqliteMetaMigrations - Columns, which have been added to existing databases
+var sqliteMetaMigrations = []string{
+	"ALTER TABLE clips ADD COLUMN encoding TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE clips ADD COLUMN decoded_size INTEGER NOT NULL DEFAULT 0",
+}
+
+// OpenSQLiteMetaStore - Opens or creates a SQLite database
+func OpenSQLiteMetaStore(file string) (*SQLiteMetaStore, error) {
+	db, err := sql.Open("sqlite3", file+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows only one writer
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sqliteMetaSchema)
+	if err == nil {
+		err = migrateSQLiteMetaSchema(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteMetaStore{db: db}, nil
+}
+
+// Close - Closes the database
+func (s *SQLiteMetaStore) Close() error {
+	return s.db.Close()
+}
+
+// Count - Returns the number of rows, including old versions
+func (s *SQLiteMetaStore) Count() (int64, error) {
+	var count int64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM clips").Scan(&count)
+
+	return count, err
+}
+
+// Delete - Deletes the row of a clip version
+func (s *SQLiteMetaStore) Delete(id string, version int64) error {
+	result, err := s.db.Exec("DELETE FROM clips WHERE id = ? AND version = ?", id, version)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err == nil && rows == 0 {
+		err = notExistError("delete", GetMetaFile(id, version))
+	}
+
+	return err
+}
+
+// Each - Calls a function for each row, including old versions,
+// until it returns an error
+func (s *SQLiteMetaStore) Each(f func(id string, version int64, clipMeta clipMetaData) error) error {
+	rows, err := s.db.Query("SELECT id, version, " + sqliteMetaColumns + " FROM clips ORDER BY id, version")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var version int64
+		var clipMeta clipMetaData
+
+		err = rows.Scan(append([]interface{}{&id, &version}, sqliteMetaFields(&clipMeta)...)...)
+		if err == nil {
+			err = f(id, version, clipMeta)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// List - Returns the rows of all clips, without their old versions
+func (s *SQLiteMetaStore) List() (map[string]clipMetaData, error) {
+	metas := map[string]clipMetaData{}
+
+	rows, err := s.db.Query("SELECT id, " + sqliteMetaColumns + " FROM clips WHERE version = 0")
+	if err != nil {
+		return metas, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var clipMeta clipMetaData
+
+		err = rows.Scan(append([]interface{}{&id}, sqliteMetaFields(&clipMeta)...)...)
+		if err != nil {
+			return metas, err
+		}
+
+		metas[id] = clipMeta
+	}
+
+	return metas, rows.Err()
+}
+
+// Read - Reads the row of a clip version
+func (s *SQLiteMetaStore) Read(id string, version int64) (clipMetaData, error) {
+	var clipMeta clipMetaData
+
+	err := s.db.QueryRow(
+		"SELECT "+sqliteMetaColumns+" FROM clips WHERE id = ? AND version = ?", id, version,
+	).Scan(sqliteMetaFields(&clipMeta)...)
+	if err == sql.ErrNoRows {
+		err = notExistError("read", GetMetaFile(id, version))
+	}
+
+	return clipMeta, err
+}
+
+// Write - Creates or replaces the row of a clip version,
+// with the current size of its data
+func (s *SQLiteMetaStore) Write(id string, version int64, clipMeta clipMetaData) error {
+	var size int64 = -1
+
+	dataStat, err := ClipStorage.Stat(GetClipDataFile(id, version))
+	if err == nil {
+		size = dataStat.Size
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT OR REPLACE INTO clips (id, version, "+sqliteMetaColumns+", size) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		id, version,
+		clipMeta.Name, clipMeta.MIME, clipMeta.ExpiresAt, clipMeta.Burn, clipMeta.SHA256,
+		clipMeta.CreationTime, clipMeta.UploadTime, clipMeta.ModificationTime,
+		clipMeta.Encoding, clipMeta.Size,
+		size,
+	)
+
+	return err
+}
+
+// ExportMetaDatabase - Moves all rows of a SQLite database into ".meta" objects
+func ExportMetaDatabase(db *SQLiteMetaStore) (int, error) {
+	files := &FileMetaStore{}
+
+	exported := 0
+	err := db.Each(func(id string, version int64, clipMeta clipMetaData) error {
+		err := files.Write(id, version, clipMeta)
+		if err == nil {
+			exported++
+		}
+
+		return err
+	})
+	if err != nil {
+		return exported, err
+	}
+
+	// all rows are stored as files now
+	_, err = db.db.Exec("DELETE FROM clips")
+
+	return exported, err
+}
+
+// ImportMetaFiles - Moves all ".meta" objects of clips and their old versions into a SQLite database
+func ImportMetaFiles(db *SQLiteMetaStore) (int, error) {
+	files := &FileMetaStore{}
+
+	metas, err := files.List()
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for id, clipMeta := range metas {
+		versionObjects, err := ClipStorage.List(GetClipDataFile(id, 0) + ".versions/")
+		if err != nil {
+			return imported, err
+		}
+
+		// old versions first, so the clip is never visible without them
+		for _, o := range versionObjects {
+			if !strings.HasSuffix(o.Key, ".meta") {
+				continue
+			}
+
+			version, err := strconv.ParseInt(strings.TrimSuffix(path.Base(o.Key), ".meta"), 10, 64)
+			if err != nil || version < 1 {
+				continue
+			}
+
+			versionMeta, err := files.Read(id, version)
+			if err != nil {
+				return imported, err
+			}
+
+			err = importMetaFile(db, files, id, version, versionMeta)
+			if err != nil {
+				return imported, err
+			}
+		}
+
+		err = importMetaFile(db, files, id, 0, clipMeta)
+		if err != nil {
+			return imported, err
+		}
+
+		imported++
+	}
+
+	return imported, nil
+}
+
+func importMetaFile(db *SQLiteMetaStore, files *FileMetaStore, id string, version int64, clipMeta clipMetaData) error {
+	err := db.Write(id, version, clipMeta)
+	if err != nil {
+		return err
+	}
+
+	return files.Delete(id, version)
+}
+
+func sqliteMetaFields(clipMeta *clipMetaData) []interface{} {
+	return []interface{}{
+		&clipMeta.Name, &clipMeta.MIME, &clipMeta.ExpiresAt, &clipMeta.Burn, &clipMeta.SHA256,
+		&clipMeta.CreationTime, &clipMeta.UploadTime, &clipMeta.ModificationTime,
+		&clipMeta.Encoding, &clipMeta.Size,
+	}
+}
+
+// migrateSQLiteMetaSchema - Adds the columns, which are missing in databases of older versions
+func migrateSQLiteMetaSchema(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(clips)")
+	if err != nil {
+		return err
+	}
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+
+		err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		columns[name] = true
+	}
+	rows.Close()
+
+	for _, m := range sqliteMetaMigrations {
+		// ALTER TABLE clips ADD COLUMN <name> ...
+		if columns[strings.Fields(m)[5]] {
+			continue
+		}
+
+		_, err = db.Exec(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckIntegrity - Checks the database file for corruption
+func (s *SQLiteMetaStore) CheckIntegrity() error {
+	var result string
+
+	err := s.db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err == nil && result != "ok" {
+		err = errors.New(result)
+	}
+
+	return err
+}
@@ -0,0 +1,179 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestMetaDatabase(t *testing.T) *SQLiteMetaStore {
+	t.Helper()
+
+	db, err := OpenSQLiteMetaStore(filepath.Join(ClipDirectory, MetaDatabaseFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// testClipID - An ID like the ones of uploaded clips
+const testClipID = "0123456789abcdef0123456789abcdef"
+
+func TestSQLiteMetaStore(t *testing.T) {
+	resetTestSettings(t)
+	db := openTestMetaDatabase(t)
+
+	clipMeta := clipMetaData{
+		Name:             "name",
+		MIME:             "text/plain",
+		ExpiresAt:        4102444800,
+		Burn:             true,
+		SHA256:           "hash",
+		CreationTime:     1,
+		UploadTime:       2,
+		ModificationTime: 3,
+		Encoding:         "gzip",
+		Size:             4,
+	}
+	if err := db.Write(testClipID, 0, clipMeta); err != nil {
+		t.Fatal(err)
+	}
+
+	versionMeta := clipMeta
+	versionMeta.Name = "version"
+	if err := db.Write(testClipID, 1, versionMeta); err != nil {
+		t.Fatal(err)
+	}
+
+	if read, err := db.Read(testClipID, 0); err != nil || read != clipMeta {
+		t.Errorf("read %+v (%v)", read, err)
+	}
+	if read, err := db.Read(testClipID, 1); err != nil || read != versionMeta {
+		t.Errorf("read version %+v (%v)", read, err)
+	}
+
+	// without old versions
+	metas, err := db.List()
+	if err != nil || len(metas) != 1 || metas[testClipID] != clipMeta {
+		t.Errorf("listed %+v (%v)", metas, err)
+	}
+	if count, err := db.Count(); err != nil || count != 2 {
+		t.Errorf("counted %d rows (%v)", count, err)
+	}
+
+	if err := db.Delete(testClipID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Read(testClipID, 1); !os.IsNotExist(err) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := db.Delete(testClipID, 1); !os.IsNotExist(err) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if err := db.CheckIntegrity(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSQLiteMetaSchemaMigration(t *testing.T) {
+	resetTestSettings(t)
+
+	// database of the first version, without codec columns
+	file := filepath.Join(ClipDirectory, MetaDatabaseFileName)
+	old, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`CREATE TABLE clips (
+		id TEXT NOT NULL,
+		version INTEGER NOT NULL DEFAULT 0,
+		name TEXT NOT NULL DEFAULT '',
+		mime TEXT NOT NULL DEFAULT '',
+		expires INTEGER NOT NULL DEFAULT 0,
+		burn INTEGER NOT NULL DEFAULT 0,
+		sha256 TEXT NOT NULL DEFAULT '',
+		ctime INTEGER NOT NULL DEFAULT 0,
+		utime INTEGER NOT NULL DEFAULT 0,
+		mtime INTEGER NOT NULL DEFAULT 0,
+		size INTEGER NOT NULL DEFAULT -1,
+		PRIMARY KEY (id, version)
+	);
+	INSERT INTO clips (id, name, mime) VALUES ('0123456789abcdef0123456789abcdef', 'old', 'text/plain');`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestMetaDatabase(t)
+
+	read, err := db.Read(testClipID, 0)
+	if err != nil || read.Name != "old" || read.Encoding != "" || read.Size != 0 {
+		t.Errorf("read %+v (%v)", read, err)
+	}
+}
+
+func TestImportAndExportMetaFiles(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("v1", "Content-Type", "text/plain", "X-Cclip-Name", "clip")
+	server.expectStatus(200, "PUT", "/clips/"+clip.ID, "v2", "Content-Type", "text/plain")
+
+	db := openTestMetaDatabase(t)
+
+	imported, err := ImportMetaFiles(db)
+	if err != nil || imported != 1 {
+		t.Fatalf("imported %d clips (%v)", imported, err)
+	}
+	if count, err := db.Count(); err != nil || count != 2 {
+		t.Errorf("counted %d rows (%v)", count, err)
+	}
+	for _, version := range []int64{0, 1} {
+		if _, err := ClipStorage.Stat(GetMetaFile(clip.ID, version)); !os.IsNotExist(err) {
+			t.Errorf("meta file of version %d still exists (%v)", version, err)
+		}
+	}
+
+	ClipMetaStore = db
+	if err := ClipIndex.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.expectStatus(200, "PATCH", "/clips/"+clip.ID, `{"name":"renamed"}`)
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions/1", ""); data != "v1" {
+		t.Errorf("version contains %q", data)
+	}
+
+	ClipMetaStore = &FileMetaStore{}
+
+	exported, err := ExportMetaDatabase(db)
+	if err != nil || exported != 2 {
+		t.Fatalf("exported %d rows (%v)", exported, err)
+	}
+	if count, err := db.Count(); err != nil || count != 0 {
+		t.Errorf("counted %d rows after export (%v)", count, err)
+	}
+
+	if read, err := ClipMetaStore.Read(clip.ID, 0); err != nil || read.Name != "renamed" {
+		t.Errorf("read %+v (%v)", read, err)
+	}
+}
@@ -0,0 +1,147 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+)
+
+// MigrationsFileName - The key of the object inside ClipStorage, which stores the names
+// of the finished migrations
+const MigrationsFileName = "migrations.json"
+
+// MigrateClipTimes - Stores the timestamps of clips and versions, which have been
+// created by older versions of the server, inside their meta data
+//
+// The modification time of the data file is used for all timestamps. The storage is
+// only scanned once, because newer versions of the server always store the timestamps.
+func MigrateClipTimes() error {
+	done, err := isMigrationDone("clip-times")
+	if err != nil || done {
+		return err
+	}
+
+	clips, err := ScanClips()
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, c := range clips {
+		files := []ClipFile{c}
+
+		versions, err := c.GetVersions()
+		if err != nil {
+			return err
+		}
+		files = append(files, versions...)
+
+		for _, f := range files {
+			clipMeta, err := f.ReadMeta()
+			if err != nil {
+				// cannot be repaired here
+				continue
+			}
+			if clipMeta.UploadTime > 0 {
+				continue
+			}
+
+			fileTime := f.fileInfo.ModTime.UnixNano()
+
+			if clipMeta.CreationTime == 0 {
+				clipMeta.CreationTime = fileTime
+			}
+			if clipMeta.ModificationTime == 0 {
+				clipMeta.ModificationTime = fileTime
+			}
+			clipMeta.UploadTime = fileTime
+
+			err = f.WriteMeta(clipMeta)
+			if err != nil {
+				return err
+			}
+
+			migrated++
+		}
+	}
+
+	if migrated > 0 {
+		log.Println("Stored timestamps in meta data of", migrated, "clip(s) and version(s)")
+	}
+
+	return setMigrationDone("clip-times")
+}
+
+func isMigrationDone(name string) (bool, error) {
+	migrations, err := readMigrations()
+	if err != nil {
+		return false, err
+	}
+
+	return migrations[name], nil
+}
+
+func readMigrations() (map[string]bool, error) {
+	migrations := map[string]bool{}
+
+	migrationsBytes, err := ReadObject(MigrationsFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+
+		return migrations, err
+	}
+
+	var names []string
+	err = json.Unmarshal(migrationsBytes, &names)
+	if err != nil {
+		return migrations, err
+	}
+
+	for _, n := range names {
+		migrations[n] = true
+	}
+
+	return migrations, nil
+}
+
+func setMigrationDone(name string) error {
+	migrations, err := readMigrations()
+	if err != nil {
+		return err
+	}
+	if migrations[name] {
+		return nil
+	}
+
+	names := []string{name}
+	for n := range migrations {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	migrationsBytes, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	return WriteObject(MigrationsFileName, migrationsBytes)
+}
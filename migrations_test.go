@@ -0,0 +1,85 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+// stripClipTimes - Removes the timestamps from the meta data of a clip or version,
+// like it has been stored by older versions of the server
+func stripClipTimes(t *testing.T, id string, version int64) {
+	clipMeta, err := ClipMetaStore.Read(id, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clipMeta.CreationTime = 0
+	clipMeta.ModificationTime = 0
+	clipMeta.UploadTime = 0
+
+	if err := ClipMetaStore.Write(id, version, clipMeta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateClipTimes(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("v1")
+	server.expectStatus(200, "PUT", "/clips/"+clip.ID, "v2")
+
+	stripClipTimes(t, clip.ID, 0)
+	stripClipTimes(t, clip.ID, 1)
+
+	if err := MigrateClipTimes(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := GetClipByID(clip.ID)
+	versionClip, err := c.GetVersion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []ClipFile{c, versionClip} {
+		clipMeta, err := f.ReadMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fileTime := f.fileInfo.ModTime.UnixNano()
+		if clipMeta.CreationTime != fileTime || clipMeta.ModificationTime != fileTime || clipMeta.UploadTime != fileTime {
+			t.Errorf("unexpected timestamps %+v, expected %d", clipMeta, fileTime)
+		}
+	}
+
+	// the storage is not scanned again
+	stripClipTimes(t, clip.ID, 0)
+	if err := MigrateClipTimes(); err != nil {
+		t.Fatal(err)
+	}
+	if clipMeta, _ := c.ReadMeta(); clipMeta.UploadTime != 0 {
+		t.Error("clip timestamps have been migrated twice")
+	}
+
+	if done, err := isMigrationDone("clip-times"); err != nil || !done {
+		t.Errorf("migration has not been recorded: %v", err)
+	}
+	if report, err := CheckClipDirectory(false, nil); err != nil || len(report.Problems) != 0 {
+		t.Errorf("unexpected fsck report %+v (%v)", report, err)
+	}
+}
@@ -0,0 +1,192 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2 parameters of HashPasswordArgon2(), as recommended by RFC 9106
+const (
+	argon2Memory  = 64 * 1024
+	argon2Time    = 3
+	argon2Threads = 4
+	argon2KeySize = 32
+)
+
+// PasswordHash - The bcrypt or argon2id hash of Password, which is used instead of it,
+// s. LoadPasswordFromEnv()
+var PasswordHash string
+
+// verifiedSharedPassword - The last password, which matched PasswordHash,
+// so not every request has to compute the hash again
+var verifiedSharedPassword struct {
+	lock     sync.Mutex
+	verified verifiedPassword
+}
+
+// CheckPasswordHash - Checks a password against a bcrypt hash, or an argon2id hash
+// in the format of HashPasswordArgon2(), in constant time
+func CheckPasswordHash(hash string, password string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory uint32
+	var iterations uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+	if err != nil || iterations < 1 || threads < 1 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	passwordKey := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(passwordKey, key) == 1
+}
+
+// HashPasswordArgon2 - Returns the argon2id hash of a password in the PHC string format,
+// like "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>"
+func HashPasswordArgon2(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeySize)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// IsPasswordHash - Checks if a string is a bcrypt or argon2id hash
+func IsPasswordHash(s string) bool {
+	if strings.HasPrefix(s, "$argon2id$") {
+		return true
+	}
+
+	_, err := bcrypt.Cost([]byte(s))
+	return err == nil
+}
+
+// LoadPasswordFromEnv - Returns Password from CCLIP_PASSWORD, or PasswordHash from
+// CCLIP_PASSWORD_HASH, or one of them from CCLIP_PASSWORD_FILE, which can contain
+// the password or its hash, like a Docker secret
+func LoadPasswordFromEnv() (string, string, error) {
+	password := strings.TrimSpace(os.Getenv("CCLIP_PASSWORD"))
+	passwordHash := strings.TrimSpace(os.Getenv("CCLIP_PASSWORD_HASH"))
+	passwordFile := strings.TrimSpace(os.Getenv("CCLIP_PASSWORD_FILE"))
+
+	count := 0
+	for _, value := range []string{password, passwordHash, passwordFile} {
+		if value != "" {
+			count++
+		}
+	}
+	if count > 1 {
+		return "", "", errors.New("CCLIP_PASSWORD, CCLIP_PASSWORD_HASH and CCLIP_PASSWORD_FILE cannot be used together")
+	}
+
+	if passwordFile != "" {
+		fileBytes, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return "", "", err
+		}
+
+		value := strings.TrimSpace(string(fileBytes))
+		if value == "" {
+			return "", "", errors.New(passwordFile + " is empty")
+		}
+
+		if IsPasswordHash(value) {
+			passwordHash = value
+		} else {
+			password = value
+		}
+	}
+
+	if passwordHash != "" && !IsPasswordHash(passwordHash) {
+		return "", "", errors.New("CCLIP_PASSWORD_HASH is no bcrypt or argon2id hash")
+	}
+
+	return password, passwordHash, nil
+}
+
+// checkSharedPassword - Checks a bearer token against Password or PasswordHash in constant time
+func checkSharedPassword(secret string) bool {
+	secretHash := sha256.Sum256([]byte(secret))
+
+	if PasswordHash == "" {
+		passwordHash := sha256.Sum256([]byte(Password))
+		return subtle.ConstantTimeCompare(secretHash[:], passwordHash[:]) == 1
+	}
+
+	verifiedSharedPassword.lock.Lock()
+	verified := verifiedSharedPassword.verified
+	verifiedSharedPassword.lock.Unlock()
+
+	if verified.hash == PasswordHash &&
+		subtle.ConstantTimeCompare(verified.password[:], secretHash[:]) == 1 {
+		return true
+	}
+
+	if !CheckPasswordHash(PasswordHash, secret) {
+		return false
+	}
+
+	verifiedSharedPassword.lock.Lock()
+	verifiedSharedPassword.verified = verifiedPassword{hash: PasswordHash, password: secretHash}
+	verifiedSharedPassword.lock.Unlock()
+
+	return true
+}
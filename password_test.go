@@ -0,0 +1,206 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2Hash - Returns a fast argon2id hash of a password in the format of HashPasswordArgon2()
+func testArgon2Hash(password string, params string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 8, 1, argon2KeySize)
+
+	return fmt.Sprintf(
+		"$argon2id$%s$%s$%s",
+		params, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash := testArgon2Hash("secret", "v=19$m=8,t=1,p=1")
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+
+	tests := []struct {
+		hash     string
+		password string
+		matches  bool
+	}{
+		{string(bcryptHash), "secret", true},
+		{string(bcryptHash), "Secret", false},
+		{string(bcryptHash), "", false},
+		{argon2Hash, "secret", true},
+		{argon2Hash, "secret ", false},
+		{argon2Hash, "", false},
+		// malformed
+		{"", "", false},
+		{"secret", "secret", false},
+		{string(bcryptHash[:20]), "secret", false},
+		{strings.Replace(argon2Hash, "$argon2id$", "$argon2i$", 1), "secret", false},
+		{strings.TrimSuffix(argon2Hash, argon2Hash[strings.LastIndex(argon2Hash, "$"):]), "secret", false},
+		{argon2Hash + "$", "secret", false},
+		{strings.Replace(argon2Hash, "v=19", "v=16", 1), "secret", false},
+		{strings.Replace(argon2Hash, "v=19", "version", 1), "secret", false},
+		{strings.Replace(argon2Hash, "t=1", "t=0", 1), "secret", false},
+		{strings.Replace(argon2Hash, "p=1", "p=0", 1), "secret", false},
+		{strings.Replace(argon2Hash, "m=8", "m=x", 1), "secret", false},
+		{strings.Replace(argon2Hash, salt, "!"+salt, 1), "secret", false},
+		{argon2Hash[:strings.LastIndex(argon2Hash, "$")+1], "secret", false},
+	}
+
+	for _, test := range tests {
+		if matches := CheckPasswordHash(test.hash, test.password); matches != test.matches {
+			t.Errorf("%q matches %q: %v", test.hash, test.password, matches)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	for _, hashPassword := range []func(string) (string, error){HashPassword, HashPasswordArgon2} {
+		hash, err := hashPassword("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !IsPasswordHash(hash) || !CheckPasswordHash(hash, "secret") || CheckPasswordHash(hash, "other") {
+			t.Errorf("unexpected hash %q", hash)
+		}
+	}
+}
+
+func TestIsPasswordHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		s      string
+		isHash bool
+	}{
+		{"", false},
+		{"secret", false},
+		{"$2a$", false},
+		{string(bcryptHash), true},
+		{testArgon2Hash("secret", "v=19$m=8,t=1,p=1"), true},
+		{"$argon2i$v=19$m=65536,t=3,p=4$c2FsdA$a2V5", false},
+	}
+
+	for _, test := range tests {
+		if isHash := IsPasswordHash(test.s); isHash != test.isHash {
+			t.Errorf("%q is a hash: %v", test.s, isHash)
+		}
+	}
+}
+
+func TestLoadPasswordFromEnv(t *testing.T) {
+	bcryptHashBytes, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash := string(bcryptHashBytes)
+
+	tests := []struct {
+		password     string
+		passwordHash string
+		file         string
+		// expected
+		loadedPassword string
+		loadedHash     string
+		fails          bool
+	}{
+		{"", "", "", "", "", false},
+		{" secret ", "", "", "secret", "", false},
+		{"", " " + bcryptHash + " ", "", "", bcryptHash, false},
+		{"", "secret", "", "", "", true},
+		{"", "", "secret\n", "secret", "", false},
+		{"", "", bcryptHash + "\n", "", bcryptHash, false},
+		{"", "", " \n", "", "", true},
+		{"secret", bcryptHash, "", "", "", true},
+		{"secret", "", "secret", "", "", true},
+	}
+
+	for _, test := range tests {
+		passwordFile := ""
+		if test.file != "" {
+			passwordFile = filepath.Join(t.TempDir(), "password")
+			if err := ioutil.WriteFile(passwordFile, []byte(test.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		t.Setenv("CCLIP_PASSWORD", test.password)
+		t.Setenv("CCLIP_PASSWORD_HASH", test.passwordHash)
+		t.Setenv("CCLIP_PASSWORD_FILE", passwordFile)
+
+		password, passwordHash, err := LoadPasswordFromEnv()
+		if (err != nil) != test.fails || password != test.loadedPassword || passwordHash != test.loadedHash {
+			t.Errorf("%+v loaded %q, %q (%v)", test, password, passwordHash, err)
+		}
+	}
+}
+
+func TestSharedPasswordHash(t *testing.T) {
+	server := newTestServer(t)
+	LockoutThreshold = 0
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("shared"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, passwordHash := range []string{string(bcryptHash), testArgon2Hash("shared", "v=19$m=8,t=1,p=1")} {
+		PasswordHash = passwordHash
+
+		// the second time from the cache
+		for i := 0; i < 2; i++ {
+			server.expectStatus(200, "GET", "/clips", "", "Authorization", "Bearer shared")
+		}
+		server.expectStatus(401, "GET", "/clips", "", "Authorization", "Bearer other")
+		server.expectStatus(401, "GET", "/clips", "", "Authorization", "Bearer "+passwordHash)
+	}
+}
+
+func TestHashPasswordCommand(t *testing.T) {
+	for _, args := range [][]string{{"hash-password"}, {"hash-password", "--argon2"}} {
+		output, err := runTestCommand(t, "secret", args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash := strings.TrimSpace(output)
+		if strings.HasPrefix(hash, "$argon2id$") != (len(args) == 2) || !CheckPasswordHash(hash, "secret") {
+			t.Errorf("%v printed %q", args, output)
+		}
+	}
+
+	if _, err := runTestCommand(t, "", "hash-password"); err == nil {
+		t.Error("empty password has been hashed")
+	}
+}
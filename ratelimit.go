@@ -0,0 +1,389 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DownloadRate - The maximum bandwidth of the downloads of a client, in bytes per second,
+// or 0 for no limit
+var DownloadRate int64 = 0
+
+// RequestRate - The maximum number of requests of a client per minute, or 0 for no limit
+var RequestRate int64 = 0
+
+// UploadQuota - The maximum size of the uploads of a client per day, in bytes, or 0 for no limit
+var UploadQuota int64 = 0
+
+// maxDownloadWait - The maximum time, the downloads of a client can be behind DownloadRate,
+// before further downloads are rejected
+var maxDownloadWait = time.Minute
+
+// RateLimitError - Is returned, if a client has exceeded a limit, like UploadQuota
+type RateLimitError struct {
+	// "requests", "upload" or "download"
+	Limit string
+	// the time, the client has to wait, before it can try again
+	RetryAfter time.Duration
+	Message    string
+
+	// the state of the exceeded limit, s. setRateLimitHeaders()
+	quota     int64
+	remaining float64
+	reset     time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Message
+}
+
+// clientLimits - The token buckets of a client, s. getClientLimits()
+type clientLimits struct {
+	Requests  *tokenBucket
+	Uploads   *tokenBucket
+	Downloads *tokenBucket
+}
+
+type rateLimitErrorResponse struct {
+	Error      string `json:"error"`
+	Limit      string `json:"limit"`
+	RetryAfter int64  `json:"retry_after"`
+}
+
+// tokenBucket - A bucket, which is filled with tokens at a constant rate up to its capacity,
+// and from which requests, or bytes, take tokens
+type tokenBucket struct {
+	lock     sync.Mutex
+	capacity float64
+	// tokens per second
+	rate    float64
+	tokens  float64
+	updated time.Time
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	bucket *tokenBucket
+	req    *http.Request
+}
+
+type uploadQuotaReader struct {
+	io.ReadCloser
+	bucket *tokenBucket
+}
+
+// serverRateLimits - The limits of all clients, by their token or IP, s. getRateLimitClient()
+var serverRateLimits = struct {
+	lock    sync.Mutex
+	clients map[string]*clientLimits
+	pruned  time.Time
+}{
+	clients: map[string]*clientLimits{},
+}
+
+// SendRateLimitError - Sends a 429 error with a JSON explanation of the exceeded limit
+func SendRateLimitError(w http.ResponseWriter, err *RateLimitError) {
+	retryAfter := int64(math.Ceil(err.RetryAfter.Seconds()))
+
+	bytes, _ := json.Marshal(rateLimitErrorResponse{
+		Error:      err.Message,
+		Limit:      err.Limit,
+		RetryAfter: retryAfter,
+	})
+
+	// the exceeded limit, instead of the one of the requests
+	setRateLimitHeaders(w, err.quota, err.remaining, err.reset)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	w.WriteHeader(429)
+	w.Write(bytes)
+}
+
+// checkRateLimit - Rejects requests of a client, which has exceeded RequestRate,
+// and sends the RateLimit-* headers of the limit
+func checkRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RequestRate < 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bucket := getClientLimits(r).Requests
+
+		ok, remaining, reset := bucket.take(1)
+
+		setRateLimitHeaders(w, RequestRate, remaining, reset)
+
+		if !ok {
+			SendRateLimitError(w, &RateLimitError{
+				Limit:      "requests",
+				RetryAfter: bucket.waitTime(1),
+				Message:    "Too many requests, only " + strconv.FormatInt(RequestRate, 10) + " per minute are allowed",
+				quota:      RequestRate,
+				remaining:  remaining,
+				reset:      reset,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getClientLimits - Returns the token buckets of the client of a HTTP request
+func getClientLimits(req *http.Request) *clientLimits {
+	client := getRateLimitClient(req)
+	now := time.Now()
+
+	serverRateLimits.lock.Lock()
+	defer serverRateLimits.lock.Unlock()
+
+	// full buckets are the same as new ones
+	if now.Sub(serverRateLimits.pruned) > time.Minute {
+		for c, limits := range serverRateLimits.clients {
+			if limits.Requests.isFull(now) && limits.Uploads.isFull(now) && limits.Downloads.isFull(now) {
+				delete(serverRateLimits.clients, c)
+			}
+		}
+
+		serverRateLimits.pruned = now
+	}
+
+	limits, ok := serverRateLimits.clients[client]
+	if !ok {
+		limits = &clientLimits{
+			Requests: newTokenBucket(float64(RequestRate), float64(RequestRate)/60, now),
+			Uploads:  newTokenBucket(float64(UploadQuota), float64(UploadQuota)/(24*60*60), now),
+			// bursts of one second
+			Downloads: newTokenBucket(float64(DownloadRate), float64(DownloadRate), now),
+		}
+
+		serverRateLimits.clients[client] = limits
+	}
+
+	return limits
+}
+
+// getRateLimitClient - Returns the API token of the client of a HTTP request, or its IP,
+// by which its limits are shared
+func getRateLimitClient(req *http.Request) string {
+	if token := GetRequestUser(req).token; token != nil {
+		return "token:" + token.ID
+	}
+
+	return "ip:" + GetClientIP(req)
+}
+
+// limitDownload - Limits the bandwidth of a response to DownloadRate, and returns a RateLimitError,
+// if the running downloads of the client are behind it by more than maxDownloadWait
+func limitDownload(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *RateLimitError) {
+	if DownloadRate < 1 {
+		return w, nil
+	}
+
+	bucket := getClientLimits(req).Downloads
+
+	if wait := bucket.waitTime(1); wait > maxDownloadWait {
+		_, remaining, reset := bucket.take(0)
+
+		return w, &RateLimitError{
+			Limit:      "download",
+			RetryAfter: wait - maxDownloadWait,
+			Message:    "Too many downloads, only " + strconv.FormatInt(DownloadRate, 10) + " bytes per second are allowed",
+			quota:      DownloadRate,
+			remaining:  remaining,
+			reset:      reset,
+		}
+	}
+
+	return &throttledResponseWriter{
+		ResponseWriter: w,
+		bucket:         bucket,
+		req:            req,
+	}, nil
+}
+
+// limitUpload - Limits the body of a request to the remaining UploadQuota of the client,
+// and returns a RateLimitError, if its known size is too large already
+func limitUpload(req *http.Request) *RateLimitError {
+	if UploadQuota < 1 {
+		return nil
+	}
+
+	bucket := getClientLimits(req).Uploads
+
+	if req.ContentLength > 0 {
+		_, remaining, _ := bucket.take(0)
+		if float64(req.ContentLength) > remaining {
+			return newUploadQuotaError(bucket, req.ContentLength)
+		}
+	}
+
+	req.Body = &uploadQuotaReader{ReadCloser: req.Body, bucket: bucket}
+	return nil
+}
+
+// newTokenBucket - Creates a full token bucket
+func newTokenBucket(capacity float64, rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity: capacity,
+		rate:     rate,
+		tokens:   capacity,
+		updated:  now,
+	}
+}
+
+func newUploadQuotaError(bucket *tokenBucket, size int64) *RateLimitError {
+	_, remaining, reset := bucket.take(0)
+
+	err := &RateLimitError{
+		Limit:      "upload",
+		RetryAfter: bucket.waitTime(float64(size)),
+		Message:    "Upload quota of " + strconv.FormatInt(UploadQuota, 10) + " bytes per day exceeded",
+		quota:      UploadQuota,
+		remaining:  remaining,
+		reset:      reset,
+	}
+	if size > UploadQuota {
+		err.Message = "Clip is larger than the upload quota of " + strconv.FormatInt(UploadQuota, 10) + " bytes per day"
+	}
+
+	return err
+}
+
+// setRateLimitHeaders - Writes the state of a limit to the RateLimit-* headers of a HTTP response
+func setRateLimitHeaders(w http.ResponseWriter, quota int64, remaining float64, reset time.Duration) {
+	w.Header().Set("RateLimit-Limit", strconv.FormatInt(quota, 10))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(int64(remaining), 10))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(reset.Seconds())), 10))
+}
+
+func (r *uploadQuotaReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if ok, _, _ := r.bucket.take(float64(n)); !ok {
+			return 0, newUploadQuotaError(r.bucket, int64(n))
+		}
+	}
+
+	return n, err
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	written := 0
+
+	for written < len(b) {
+		// not more than the bucket can hold, so other downloads of the client are not starved
+		chunk := b[written:]
+		if len(chunk) > int(w.bucket.capacity) {
+			chunk = chunk[:int(w.bucket.capacity)]
+		}
+
+		wait := w.bucket.reserve(float64(len(chunk)))
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-w.req.Context().Done():
+				timer.Stop()
+				return written, w.req.Context().Err()
+			}
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// isFull - Checks if a bucket has been refilled completely
+func (b *tokenBucket) isFull(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+// refill - Adds the tokens since the last update, the lock must be held
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.updated) {
+		b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+		b.updated = now
+	}
+}
+
+// reserve - Takes tokens, even if the bucket does not contain enough,
+// and returns the time until they are available
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take - Takes tokens, if the bucket contains enough, and returns the remaining tokens
+// and the time until the bucket is full again
+func (b *tokenBucket) take(n float64) (bool, float64, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+
+	ok := b.tokens >= n
+	if ok {
+		b.tokens -= n
+	}
+
+	remaining := math.Max(0, math.Floor(b.tokens))
+	return ok, remaining, time.Duration((b.capacity - b.tokens) / b.rate * float64(time.Second))
+}
+
+// waitTime - Returns the time until a bucket contains enough tokens, or is full,
+// if it cannot hold that many tokens
+func (b *tokenBucket) waitTime(n float64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+
+	missing := math.Min(n, b.capacity) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+
+	return time.Duration(missing / b.rate * float64(time.Second))
+}
@@ -0,0 +1,124 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// expectRateLimitError - Checks a 429 response and the headers of the exceeded limit
+func expectRateLimitError(t *testing.T, resp *http.Response, data string, limit string, quota string, remaining string) {
+	t.Helper()
+
+	var body rateLimitErrorResponse
+	json.Unmarshal([]byte(data), &body)
+
+	retryAfter, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
+	if resp.StatusCode != 429 || err != nil || retryAfter < 1 || body.Limit != limit || body.RetryAfter != retryAfter {
+		t.Errorf("unexpected response %d %q with Retry-After %q", resp.StatusCode, data, resp.Header.Get("Retry-After"))
+	}
+
+	reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64)
+	if resp.Header.Get("RateLimit-Limit") != quota || resp.Header.Get("RateLimit-Remaining") != remaining || err != nil || reset < 1 {
+		t.Errorf("unexpected headers %v of %s limit", resp.Header, limit)
+	}
+}
+
+func TestRequestRateLimit(t *testing.T) {
+	server := newTestServer(t)
+	RequestRate = 2
+
+	for _, remaining := range []string{"1", "0"} {
+		resp, _ := server.do("HEAD", "/clips", "")
+		if resp.StatusCode == 429 || resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Remaining") != remaining {
+			t.Fatalf("unexpected response %d with headers %v", resp.StatusCode, resp.Header)
+		}
+	}
+
+	resp, data := server.do("GET", "/clips", "")
+	expectRateLimitError(t, resp, data, "requests", "2", "0")
+}
+
+func TestUploadQuota(t *testing.T) {
+	server := newTestServer(t)
+	RequestRate = 100
+	UploadQuota = 10
+
+	server.upload("123456")
+
+	resp, data := server.do("POST", "/clips", "123456")
+	expectRateLimitError(t, resp, data, "upload", "10", "4")
+
+	// the size of chunked uploads is not known in advance
+	req, err := http.NewRequest("POST", server.URL+"/api/v1/clips", strings.NewReader("123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body rateLimitErrorResponse
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != 429 || body.Limit != "upload" || resp.Header.Get("RateLimit-Limit") != "10" || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("chunked upload returned %d %+v with headers %v", resp.StatusCode, body, resp.Header)
+	}
+
+	if usage := ClipIndex.Usage(); usage.Count != 1 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
+
+func TestDownloadRate(t *testing.T) {
+	server := newTestServer(t)
+	RequestRate = 100
+	DownloadRate = 100
+
+	clip := server.upload("data")
+	server.expectStatus(200, "GET", "/clips/"+clip.ID, "")
+
+	// like many running downloads
+	serverRateLimits.lock.Lock()
+	bucket := serverRateLimits.clients["ip:127.0.0.1"].Downloads
+	serverRateLimits.lock.Unlock()
+
+	bucket.reserve(float64(DownloadRate) * (maxDownloadWait.Seconds() + 10))
+
+	resp, data := server.do("GET", "/clips/"+clip.ID, "")
+	expectRateLimitError(t, resp, data, "download", "100", "0")
+	if retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retryAfter > 11 {
+		t.Errorf("unexpected Retry-After %d", retryAfter)
+	}
+
+	// a burn-after-read clip is not read
+	burned := server.upload("burned", "X-Cclip-Burn", "true")
+	resp, data = server.do("GET", "/clips/"+burned.ID, "")
+	expectRateLimitError(t, resp, data, "download", "100", "0")
+
+	DownloadRate = 0
+	if data := server.expectStatus(200, "GET", "/clips/"+burned.ID, ""); data != "burned" {
+		t.Errorf("burn-after-read clip contains %q", data)
+	}
+}
@@ -0,0 +1,299 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// clipOperation - An operation, which changes the data of a clip in several steps
+//
+// It is stored in the "<id>.pending" object, before the first step is done,
+// and deleted after the last one, so RecoverPendingClips() can complete or
+// roll back the operation, if the server crashed in the meantime.
+type clipOperation struct {
+	// "upload", "replace" or "delete"
+	Type string `json:"type"`
+	// the hash and codec of the new data
+	SHA256   string `json:"sha256,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Blob     string `json:"blob,omitempty"`
+	// the version, the current data is archived as
+	Version int64 `json:"version,omitempty"`
+	Time    int64 `json:"time"`
+}
+
+// BeginOperation - Stores a pending operation of the clip, with the meta data of its new data
+func (c ClipFile) BeginOperation(opType string, clipMeta clipMetaData, version int64) error {
+	var op clipOperation
+	op.Type = opType
+	op.SHA256 = clipMeta.SHA256
+	op.Encoding = clipMeta.Encoding
+	op.Blob = clipMeta.Blob
+	op.Version = version
+	op.Time = time.Now().UnixNano()
+
+	opBytes, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	return WriteObject(c.PendingMarkerFile(), opBytes)
+}
+
+// FinishOperation - Deletes the pending operation of the clip, after its last step
+func (c ClipFile) FinishOperation() error {
+	return DeleteObjects(c.PendingMarkerFile())
+}
+
+// PendingMarkerFile - Returns the key of the object, which stores a pending operation of the clip
+func (c ClipFile) PendingMarkerFile() string {
+	return c.file + ".pending"
+}
+
+// RecoverPendingClips - Completes or rolls back all uploads, replacements and
+// deletions of clips, which were interrupted by a crash
+func RecoverPendingClips() error {
+	objects, err := ListClipObjects(ClipStorage)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		id, suffix, ok := parseClipKey(o.Key)
+		if !ok || suffix != ".pending" {
+			continue
+		}
+
+		var op clipOperation
+
+		opBytes, err := ReadObject(o.Key)
+		if err == nil {
+			err = json.Unmarshal(opBytes, &op)
+		}
+		if IsEncryptionError(err) {
+			// do not guess with a wrong key
+			return err
+		}
+		if err != nil {
+			log.Println("[WARN] Could not read pending operation of clip", id, err.Error())
+
+			// nothing known, so ScanClips() decides by data and meta data
+			op.Type = "unknown"
+		}
+
+		var clip ClipFile
+		clip.file = strings.TrimSuffix(o.Key, suffix)
+		clip.id = id
+
+		result, err := recoverClipOperation(clip, op)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Recovered interrupted", op.Type, "of clip", id+":", result)
+	}
+
+	return nil
+}
+
+// recoverClipOperation - Completes or rolls back a pending operation of a clip
+// and returns, what has been done
+func recoverClipOperation(c ClipFile, op clipOperation) (string, error) {
+	var opMeta clipMetaData
+	opMeta.SHA256 = op.SHA256
+	opMeta.Encoding = op.Encoding
+	opMeta.Blob = op.Blob
+
+	if op.Type == "delete" {
+		// the clip may be incomplete already, so finish the job
+		return "deleted", c.delete(opMeta)
+	}
+
+	clipMeta, metaErr := c.ReadMeta()
+	if metaErr != nil && !os.IsNotExist(metaErr) {
+		return "", metaErr
+	}
+
+	_, dataErr := ClipStorage.Stat(c.file)
+	if dataErr != nil && !os.IsNotExist(dataErr) {
+		return "", dataErr
+	}
+
+	// the meta data is always written last
+	completed := dataErr == nil && metaErr == nil
+	if op.Type == "replace" || op.Type == "upload" {
+		completed = completed && clipMeta.BlobID() == opMeta.BlobID()
+	}
+	if completed {
+		return "completed", c.FinishOperation()
+	}
+
+	if op.Type != "replace" || op.Version < 1 {
+		// nothing to go back to
+		if clipMeta.SHA256 == "" {
+			clipMeta = opMeta
+		}
+
+		return "deleted", c.delete(clipMeta)
+	}
+
+	versionFile := c.versionFile(op.Version)
+
+	_, err := ClipStorage.Stat(versionFile)
+	if os.IsNotExist(err) {
+		// never archived, so the data is still the current one
+		if metaErr != nil || dataErr != nil {
+			return "deleted", c.delete(clipMetaData{})
+		}
+
+		return "rolled back", c.FinishOperation()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// the current data has been archived as op.Version,
+	// so existing data is the new one
+	if dataErr == nil {
+		err = ClipStorage.Delete(c.file)
+		if err == nil {
+			err = ReleaseBlob(opMeta.BlobID())
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = ClipStorage.Rename(versionFile, c.file)
+	if err == nil {
+		err = ClipMetaStore.Delete(c.id, op.Version)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil && metaErr != nil {
+		return "deleted", c.delete(clipMetaData{})
+	}
+	if err == nil {
+		err = c.FinishOperation()
+	}
+
+	return "rolled back", err
+}
+
+// RecoverOrphanedClips - Deletes data without meta data and meta data without data,
+// which was left by crashes of older versions, and stale temporary files
+//
+// Data with unreadable meta data is kept for fsck, which reports and quarantines the meta data.
+func RecoverOrphanedClips() error {
+	objects, err := ListClipObjects(ClipStorage)
+	if err != nil {
+		return err
+	}
+
+	metas, err := ClipMetaStore.List()
+	if err != nil {
+		return err
+	}
+
+	dataIDs := map[string]bool{}
+	for _, o := range objects {
+		id, suffix, ok := parseClipKey(o.Key)
+		if !ok || suffix != "" {
+			continue
+		}
+
+		dataIDs[id] = true
+
+		if _, ok := metas[id]; ok {
+			continue
+		}
+
+		// List() skips unreadable meta data, like absent one
+		_, err := ClipMetaStore.Read(id, 0)
+		if err == nil {
+			// written in the meantime
+			continue
+		}
+		if !os.IsNotExist(err) {
+			log.Println("[WARN] Kept data of clip", id, "with unreadable meta data, run fsck:", err.Error())
+			continue
+		}
+
+		err = DeleteObjects(o.Key, o.Key+".shares")
+		if err != nil {
+			return err
+		}
+		removeClipUser(id)
+
+		log.Println("Deleted data of clip", id, "without meta data")
+	}
+
+	for id := range metas {
+		if dataIDs[id] {
+			continue
+		}
+
+		err := ClipMetaStore.Delete(id, 0)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		log.Println("Deleted meta data of clip", id, "without data")
+	}
+
+	if ClipDirectory == "" {
+		return nil
+	}
+
+	return removeStaleTempFiles(ClipDirectory)
+}
+
+// removeStaleTempFiles - Removes all temporary files of uploads and atomic writes,
+// which have been left in a directory and its sub directories
+func removeStaleTempFiles(dir string) error {
+	return filepath.Walk(dir, func(file string, fileStat os.FileInfo, err error) error {
+		if err != nil || fileStat.IsDir() {
+			return err
+		}
+
+		if !isTempFileName(fileStat.Name()) {
+			return nil
+		}
+
+		err = os.Remove(file)
+		if err == nil {
+			log.Println("Removed stale temporary file", file)
+		}
+
+		return err
+	})
+}
+
+// isTempFileName - Checks if a file name is the one of a temporary file
+// of an upload or an atomic write
+func isTempFileName(name string) bool {
+	return strings.HasPrefix(name, ".upload-") ||
+		strings.HasPrefix(name, ".restore-") ||
+		(strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp"))
+}
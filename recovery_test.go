@@ -0,0 +1,249 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// getTestClip - Returns an uploaded clip and its meta data
+func getTestClip(t *testing.T, id string) (ClipFile, clipMetaData) {
+	t.Helper()
+
+	clip, err := GetClipByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clipMeta, err := clip.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clip, clipMeta
+}
+
+// recoverTestClips - Recovers pending operations, like on startup
+func recoverTestClips(t *testing.T) {
+	t.Helper()
+
+	if err := RecoverPendingClips(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClipIndex.Load(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverReplacedClips(t *testing.T) {
+	// the steps of ClipFile.ReplaceData(), which are done before the crash
+	steps := []string{"begin", "archive data", "archive meta data", "store data", "write meta data"}
+
+	for _, dedupMode := range []string{"off", "link"} {
+		for done := range steps {
+			t.Run(fmt.Sprintf("%s/%s", dedupMode, steps[done]), func(t *testing.T) {
+				server := newTestServer(t)
+				DedupMode = dedupMode
+
+				uploaded := server.upload("old", "Content-Type", "text/plain")
+				clip, clipMeta := getTestClip(t, uploaded.ID)
+
+				hash := sha256.Sum256([]byte("new"))
+				newMeta := clipMeta
+				newMeta.SHA256 = hex.EncodeToString(hash[:])
+				newMeta.Size = 3
+
+				if err := clip.BeginOperation("replace", newMeta, 1); err != nil {
+					t.Fatal(err)
+				}
+				if done >= 1 {
+					if err := ClipStorage.Rename(clip.file, clip.versionFile(1)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if done >= 2 {
+					if err := ClipMetaStore.Write(clip.id, 1, clipMeta); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if done >= 3 {
+					tmpFile := filepath.Join(ClipDirectory, ".upload-test")
+					if err := ioutil.WriteFile(tmpFile, []byte("new"), 0600); err != nil {
+						t.Fatal(err)
+					}
+					if err := StoreClipData(tmpFile, newMeta.BlobID(), clip.file); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if done >= 4 {
+					if err := ClipMetaStore.Write(clip.id, 0, newMeta); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				recoverTestClips(t)
+
+				expected, expectedVersions := "old", 0
+				if done == len(steps)-1 {
+					expected, expectedVersions = "new", 1
+				}
+
+				if data := server.expectStatus(200, "GET", "/clips/"+clip.id, ""); data != expected {
+					t.Errorf("clip contains %q", data)
+				}
+
+				var versions []clipVersionItem
+				json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/"+clip.id+"/versions", "")), &versions)
+				if len(versions) != expectedVersions {
+					t.Errorf("unexpected versions %+v", versions)
+				}
+
+				if _, err := ClipStorage.Stat(clip.PendingMarkerFile()); !os.IsNotExist(err) {
+					t.Errorf("pending operation still exists (%v)", err)
+				}
+				if dedupMode == "link" && expected == "old" {
+					if links := blobLinks(t, newMeta.SHA256); links != 0 {
+						t.Errorf("new blob has %d links", links)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRecoverUploadedAndDeletedClips(t *testing.T) {
+	server := newTestServer(t)
+
+	// crashed before the meta data has been written
+	uploaded := server.upload("upload", "Content-Type", "text/plain")
+	clip, clipMeta := getTestClip(t, uploaded.ID)
+	if err := clip.BeginOperation("upload", clipMeta, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClipMetaStore.Delete(clip.id, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// crashed after the data has been deleted
+	deleted := server.upload("delete", "Content-Type", "text/plain")
+	deletedClip, deletedMeta := getTestClip(t, deleted.ID)
+	if err := deletedClip.BeginOperation("delete", deletedMeta, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClipStorage.Delete(deletedClip.file); err != nil {
+		t.Fatal(err)
+	}
+
+	// completed, but the marker has not been deleted
+	completed := server.upload("completed", "Content-Type", "text/plain")
+	completedClip, completedMeta := getTestClip(t, completed.ID)
+	if err := completedClip.BeginOperation("upload", completedMeta, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	recoverTestClips(t)
+
+	for _, c := range []ClipFile{clip, deletedClip} {
+		if _, err := ClipStorage.Stat(c.file); !os.IsNotExist(err) {
+			t.Errorf("data of clip %s still exists (%v)", c.id, err)
+		}
+		if _, err := ClipMetaStore.Read(c.id, 0); !os.IsNotExist(err) {
+			t.Errorf("meta data of clip %s still exists (%v)", c.id, err)
+		}
+		if _, err := ClipStorage.Stat(c.PendingMarkerFile()); !os.IsNotExist(err) {
+			t.Errorf("pending operation of clip %s still exists (%v)", c.id, err)
+		}
+	}
+
+	if data := server.expectStatus(200, "GET", "/clips/"+completed.ID, ""); data != "completed" {
+		t.Errorf("clip contains %q", data)
+	}
+	if _, err := ClipStorage.Stat(completedClip.PendingMarkerFile()); !os.IsNotExist(err) {
+		t.Errorf("pending operation still exists (%v)", err)
+	}
+}
+
+func TestRecoverOrphanedClips(t *testing.T) {
+	server := newTestServer(t)
+
+	withoutMeta := server.upload("without meta data", "Content-Type", "text/plain")
+	withoutMetaClip, _ := getTestClip(t, withoutMeta.ID)
+	if err := ClipMetaStore.Delete(withoutMeta.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	withoutData := server.upload("without data", "Content-Type", "text/plain")
+	withoutDataClip, _ := getTestClip(t, withoutData.ID)
+	if err := ClipStorage.Delete(withoutDataClip.file); err != nil {
+		t.Fatal(err)
+	}
+
+	invalidMeta := server.upload("invalid meta data", "Content-Type", "text/plain")
+	server.expectStatus(201, "POST", "/clips/"+invalidMeta.ID+"/shares", "")
+	invalidMetaClip, _ := getTestClip(t, invalidMeta.ID)
+	if err := WriteObject(GetMetaFile(invalidMeta.ID, 0), []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := server.upload("kept", "Content-Type", "text/plain")
+
+	tmpFile := filepath.Join(ClipDirectory, ".upload-123")
+	if err := ioutil.WriteFile(tmpFile, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RecoverOrphanedClips(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ClipStorage.Stat(withoutMetaClip.file); !os.IsNotExist(err) {
+		t.Errorf("data without meta data still exists (%v)", err)
+	}
+	if _, err := ClipMetaStore.Read(withoutData.ID, 0); !os.IsNotExist(err) {
+		t.Errorf("meta data without data still exists (%v)", err)
+	}
+	if _, err := os.Stat(tmpFile); !os.IsNotExist(err) {
+		t.Errorf("temporary file still exists (%v)", err)
+	}
+
+	// kept for fsck
+	for _, key := range []string{invalidMetaClip.file, invalidMetaClip.SharesFile()} {
+		if _, err := ClipStorage.Stat(key); err != nil {
+			t.Errorf("%s of clip with invalid meta data has been deleted (%v)", key, err)
+		}
+	}
+	report, err := CheckClipDirectory(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"invalid-meta " + invalidMeta.ID + ".meta", "orphaned-object " + invalidMeta.ID + ".shares"}
+	if problems := fsckProblemList(report); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("unexpected problems %v", problems)
+	}
+
+	if data := server.expectStatus(200, "GET", "/clips/"+kept.ID, ""); data != "kept" {
+		t.Errorf("clip contains %q", data)
+	}
+}
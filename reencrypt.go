@@ -0,0 +1,209 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+)
+
+// ReencryptReport - The result of ReencryptClipDirectory()
+type ReencryptReport struct {
+	// objects, which have been encrypted with the current key or decrypted
+	Rewritten int
+	// clips and versions, which have been linked to a rewritten shared data object again
+	Relinked int
+	// objects, which already have been encrypted with the current key
+	Unchanged int
+}
+
+// ReencryptClipDirectory - Encrypts all objects inside ClipDirectory with the current key
+// of an encrypted storage, which has been created by NewEncryptedStorage(), or decrypts
+// them, if it has no current key
+//
+// Objects, which have been encrypted with an old key, are decrypted with it. Clips, which
+// share their data with other clips, s. StoreClipData(), keep sharing it. The server must
+// not run in the meantime.
+func ReencryptClipDirectory(storage Storage) (ReencryptReport, error) {
+	var report ReencryptReport
+
+	s := GetEncryptedStorage(storage)
+	if s == nil {
+		return report, errors.New("Storage is not encrypted")
+	}
+
+	currentKeyID := ""
+	if s.CurrentKey != nil {
+		currentKeyID = s.CurrentKey.ID()
+	}
+
+	keys, err := listReencryptKeys(s.Storage)
+	if err != nil {
+		return report, err
+	}
+
+	for _, key := range keys {
+		keyID, err := s.KeyID(key)
+		if err != nil {
+			return report, errors.New("Reading " + key + " failed: " + err.Error())
+		}
+		if keyID == currentKeyID {
+			report.Unchanged++
+			continue
+		}
+
+		relinked, err := relinkBlob(storage, key)
+		if err == nil && !relinked {
+			err = rewriteObject(s, key)
+		}
+		if err != nil {
+			return report, errors.New("Re-encrypting " + key + " failed: " + err.Error())
+		}
+
+		if relinked {
+			report.Relinked++
+		} else {
+			report.Rewritten++
+		}
+	}
+
+	return report, nil
+}
+
+// listReencryptKeys - Returns the keys of all objects, which belong to clips,
+// shared data objects first, so clips can be linked to them again
+func listReencryptKeys(storage Storage) ([]string, error) {
+	keys := make([]string, 0)
+
+	blobs, err := storage.List(BlobDirectoryName + "/")
+	if err != nil {
+		return keys, err
+	}
+
+	dirs, err := ListClipDirectories(storage)
+	if err != nil {
+		return keys, err
+	}
+
+	objects := make([]StorageInfo, 0)
+	versions := make([]StorageInfo, 0)
+	for _, dir := range dirs {
+		dirObjects, err := storage.List(dir)
+		if err != nil {
+			return keys, err
+		}
+
+		objects = append(objects, dirObjects...)
+
+		subDirs, err := storage.ListDirectories(dir)
+		if err != nil {
+			return keys, err
+		}
+
+		for _, d := range subDirs {
+			if !strings.HasSuffix(d, ".versions/") {
+				continue
+			}
+
+			dirVersions, err := storage.List(d)
+			if err != nil {
+				return keys, err
+			}
+
+			versions = append(versions, dirVersions...)
+		}
+	}
+
+	for _, o := range append(blobs, append(objects, versions...)...) {
+		name := path.Base(o.Key)
+
+		// the database is not supported, s. RunServer(), and the users and tokens are read directly
+		if isTempFileName(name) || strings.HasPrefix(name, MetaDatabaseFileName) || isAccountFile(o.Key) {
+			continue
+		}
+
+		keys = append(keys, o.Key)
+	}
+
+	return keys, nil
+}
+
+// relinkBlob - Replaces the data of a clip or version by a link to its shared data object,
+// if it exists
+func relinkBlob(storage Storage, key string) (bool, error) {
+	linker, ok := storage.(StorageLinker)
+	if !ok || strings.HasPrefix(key, BlobDirectoryName+"/") {
+		return false, nil
+	}
+
+	// data of clips and their old versions only
+	base := strings.SplitN(key, ".versions/", 2)[0]
+	if _, suffix, ok := parseClipKey(base); !ok || suffix != "" {
+		return false, nil
+	}
+
+	id, version := parseDataKey(key)
+	if key != base && version < 1 {
+		return false, nil
+	}
+
+	clipMeta, err := (&FileMetaStore{}).Read(id, version)
+	if err != nil {
+		// meta data is re-encrypted separately
+		return false, nil
+	}
+
+	blobID := clipMeta.BlobID()
+	if clipMeta.SHA256 == "" {
+		return false, nil
+	}
+
+	_, err = storage.Stat(GetBlobFile(blobID))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	dir, name := path.Split(key)
+	tmpKey := dir + "." + name + ".tmp-relink"
+
+	err = linker.Link(GetBlobFile(blobID), tmpKey)
+	if err == nil {
+		err = storage.Rename(tmpKey, key)
+	}
+	if err != nil {
+		storage.Delete(tmpKey)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// rewriteObject - Stores an object again, so it is encrypted with the current key
+func rewriteObject(s *EncryptedStorage, key string) error {
+	obj, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	return s.Put(key, obj)
+}
@@ -0,0 +1,156 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// MaxClips - Maximum number of all clips, 0 for unlimited
+var MaxClips int64 = 0
+
+// MaxTotalSize - Maximum size of all clips, in bytes, 0 for unlimited
+var MaxTotalSize int64 = 0
+
+// MaxUserClips - Maximum number of clips of each user, 0 for unlimited
+var MaxUserClips int64 = 0
+
+// MaxUserTotalSize - Maximum size of all clips of each user, in bytes, 0 for unlimited
+var MaxUserTotalSize int64 = 0
+
+// ClipUsage - The current usage of the clip store
+type ClipUsage struct {
+	Count     int64
+	TotalSize int64
+}
+
+// GetClipUsage - Returns the usage of a list of clips
+func GetClipUsage(clips []ClipFile) ClipUsage {
+	var usage ClipUsage
+	for _, c := range clips {
+		usage.Count++
+		usage.TotalSize += c.fileInfo.Size
+	}
+
+	return usage
+}
+
+// EnforceRetentionLimits - Deletes the oldest clips of the user of a clip, until they fit into
+// MaxUserClips and MaxUserTotalSize again, and then the oldest clips of all users, until the store
+// fits into MaxClips and MaxTotalSize again
+//
+// The clip with the ID keepID is never deleted.
+func EnforceRetentionLimits(keepID string) (int, error) {
+	deleted := 0
+
+	if keep, ok := ClipIndex.Get(keepID); ok && (MaxUserClips > 0 || MaxUserTotalSize > 0) {
+		userName := keep.Clip.User()
+
+		n, err := evictClips(keepID, func(c ClipFile) bool {
+			return c.User() == userName
+		}, func() bool {
+			return ClipIndex.UserUsage(userName).exceedsUserLimits()
+		})
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	if MaxClips > 0 || MaxTotalSize > 0 {
+		n, err := evictClips(keepID, func(c ClipFile) bool {
+			return true
+		}, func() bool {
+			return ClipIndex.Usage().exceedsLimits()
+		})
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// evictClips - Deletes the oldest clips, which match a filter, except the clip with the ID keepID,
+// as long as exceeded() returns true
+func evictClips(keepID string, filter func(c ClipFile) bool, exceeded func() bool) (int, error) {
+	// newest first
+	clips := ClipIndex.List()
+
+	deleted := 0
+	for i := len(clips) - 1; i >= 0; i-- {
+		// concurrent requests change the usage as well
+		if !exceeded() {
+			break
+		}
+
+		c := clips[i]
+		if c.id == keepID || !filter(c) {
+			continue
+		}
+
+		unlock := LockClip(c.id)
+		err := c.Delete()
+		unlock()
+
+		if os.IsNotExist(err) {
+			// already deleted by another request
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+
+		log.Println("Evicted clip", c.id, "to fit retention limits")
+
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// SetUsageHeaders - Writes the usage of the clips of a user and the limits to HTTP response headers
+func SetUsageHeaders(w http.ResponseWriter, usage ClipUsage) {
+	w.Header().Set("X-Cclip-Count", strconv.FormatInt(usage.Count, 10))
+	w.Header().Set("X-Cclip-Total-Size", strconv.FormatInt(usage.TotalSize, 10))
+	if MaxClips > 0 {
+		w.Header().Set("X-Cclip-Max-Count", strconv.FormatInt(MaxClips, 10))
+	}
+	if MaxTotalSize > 0 {
+		w.Header().Set("X-Cclip-Max-Total-Size", strconv.FormatInt(MaxTotalSize, 10))
+	}
+	if MaxUserClips > 0 {
+		w.Header().Set("X-Cclip-Max-User-Count", strconv.FormatInt(MaxUserClips, 10))
+	}
+	if MaxUserTotalSize > 0 {
+		w.Header().Set("X-Cclip-Max-User-Total-Size", strconv.FormatInt(MaxUserTotalSize, 10))
+	}
+}
+
+func (u ClipUsage) exceedsLimits() bool {
+	return (MaxClips > 0 && u.Count > MaxClips) ||
+		(MaxTotalSize > 0 && u.TotalSize > MaxTotalSize)
+}
+
+func (u ClipUsage) exceedsUserLimits() bool {
+	return (MaxUserClips > 0 && u.Count > MaxUserClips) ||
+		(MaxUserTotalSize > 0 && u.TotalSize > MaxUserTotalSize)
+}
@@ -0,0 +1,128 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMaxClips(t *testing.T) {
+	server := newTestServer(t)
+	MaxClips = 3
+
+	clips := []uploadFileResponse{}
+	for _, data := range []string{"1", "2", "3", "4", "5"} {
+		clips = append(clips, server.upload(data))
+	}
+
+	for _, c := range clips[:2] {
+		server.expectStatus(404, "GET", "/clips/"+c.ID, "")
+	}
+	for _, c := range clips[2:] {
+		server.expectStatus(200, "GET", "/clips/"+c.ID, "")
+	}
+
+	resp, _ := server.do("HEAD", "/clips", "")
+	if resp.Header.Get("X-Cclip-Count") != "3" || resp.Header.Get("X-Cclip-Max-Count") != "3" {
+		t.Errorf("unexpected usage headers %v", resp.Header)
+	}
+}
+
+func TestMaxTotalSize(t *testing.T) {
+	server := newTestServer(t)
+	MaxTotalSize = 10
+
+	first := server.upload("12345")
+	second := server.upload("12345")
+	third := server.upload("123")
+
+	server.expectStatus(404, "GET", "/clips/"+first.ID, "")
+	server.expectStatus(200, "GET", "/clips/"+second.ID, "")
+	server.expectStatus(200, "GET", "/clips/"+third.ID, "")
+
+	// a new clip is kept, even if it exceeds the limit alone
+	large := server.upload("12345678901")
+
+	server.expectStatus(404, "GET", "/clips/"+second.ID, "")
+	server.expectStatus(404, "GET", "/clips/"+third.ID, "")
+	server.expectStatus(200, "GET", "/clips/"+large.ID, "")
+
+	if usage := ClipIndex.Usage(); usage.Count != 1 || usage.TotalSize != 11 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
+
+func TestMaxUserClips(t *testing.T) {
+	server := newTestServer(t)
+	MaxClips = 3
+	MaxUserClips = 2
+
+	alice := addTestUser(t, "alice", "user")
+	bob := addTestUser(t, "bob", "user")
+
+	a1 := server.upload("a1", "Authorization", alice)
+	a2 := server.upload("a2", "Authorization", alice)
+	b1 := server.upload("b1", "Authorization", bob)
+
+	// only the oldest clip of the user
+	a3 := server.upload("a3", "Authorization", alice)
+	server.expectStatus(404, "GET", "/clips/"+a1.ID, "", "Authorization", alice)
+	server.expectStatus(200, "GET", "/clips/"+a2.ID, "", "Authorization", alice)
+	server.expectStatus(200, "GET", "/clips/"+b1.ID, "", "Authorization", bob)
+
+	// the oldest clip of all users
+	b2 := server.upload("b2", "Authorization", bob)
+	server.expectStatus(404, "GET", "/clips/"+a2.ID, "", "Authorization", alice)
+	for _, c := range []uploadFileResponse{a3, b1, b2} {
+		if _, ok := ClipIndex.Get(c.ID); !ok {
+			t.Errorf("clip %s has been evicted", c.ID)
+		}
+	}
+
+	resp, _ := server.do("HEAD", "/clips", "", "Authorization", bob)
+	if resp.Header.Get("X-Cclip-Count") != "2" || resp.Header.Get("X-Cclip-Max-Count") != "3" ||
+		resp.Header.Get("X-Cclip-Max-User-Count") != "2" {
+		t.Errorf("unexpected usage headers %v", resp.Header)
+	}
+
+	// the users of deleted clips are forgotten
+	server.expectStatus(204, "DELETE", "/clips/"+b1.ID, "", "Authorization", bob)
+	for _, id := range []string{a1.ID, a2.ID, b1.ID} {
+		if name, ok := getClipUser(id); ok {
+			t.Errorf("clip %s still belongs to %q", id, name)
+		}
+	}
+	if name, ok := getClipUser(b2.ID); !ok || name != "bob" {
+		t.Errorf("clip %s belongs to %q", b2.ID, name)
+	}
+}
+
+func TestMaxUserTotalSize(t *testing.T) {
+	server := newTestServer(t)
+	MaxUserTotalSize = 10
+	Password = "shared"
+
+	alice := addTestUser(t, "alice", "user")
+
+	first := server.upload("12345", "Authorization", alice)
+	shared := server.upload("1234567890", "Authorization", "Bearer shared")
+	second := server.upload("123456", "Authorization", alice)
+
+	server.expectStatus(404, "GET", "/clips/"+first.ID, "", "Authorization", alice)
+	server.expectStatus(200, "GET", "/clips/"+second.ID, "", "Authorization", alice)
+	server.expectStatus(200, "GET", "/clips/"+shared.ID, "", "Authorization", "Bearer shared")
+}
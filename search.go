@@ -0,0 +1,516 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxSearchContentSize - Maximum number of bytes of a clip, which are indexed and searched
+const MaxSearchContentSize = 1048576
+
+// SearchIndexFileName - The key of the object inside ClipStorage, which stores the search index
+const SearchIndexFileName = "search.index"
+
+// SearchIndexSaveDelay - The time, changes of the search index are collected, before it is saved
+var SearchIndexSaveDelay = 5 * time.Second
+
+const searchSnippetContext = 40
+const maxSearchSnippets = 3
+
+type searchIndex struct {
+	// term => clip IDs
+	Terms map[string][]string `json:"terms"`
+	// clip ID => terms
+	Clips map[string][]string `json:"clips"`
+	// clip ID => modification time of the indexed meta data
+	Times map[string]int64 `json:"times"`
+}
+
+type searchHighlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type searchMatch struct {
+	Field      string            `json:"field"`
+	Snippet    string            `json:"snippet"`
+	Highlights []searchHighlight `json:"highlights"`
+}
+
+type searchResultItem struct {
+	Clip    clipItem      `json:"clip"`
+	Matches []searchMatch `json:"matches"`
+}
+
+var clipSearchIndex *searchIndex
+var searchIndexLock sync.Mutex
+var searchIndexSaveLock sync.Mutex
+var searchIndexSaveTimer *time.Timer
+
+// IndexClip - Adds or updates a clip in the search index
+func IndexClip(clip ClipFile) error {
+	clipMeta, err := clip.ReadMeta()
+	if err != nil {
+		return err
+	}
+
+	if clipMeta.Burn {
+		// the content of burn-after-read clips must only be read once
+		return RemoveClipFromIndex(clip.id)
+	}
+
+	terms := map[string]bool{}
+	for _, t := range TokenizeSearchText(clipMeta.Name) {
+		terms[t] = true
+	}
+
+	if IsTextMIME(clipMeta.MIME) {
+		content, err := readSearchContent(clip, clipMeta)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range TokenizeSearchText(content) {
+			terms[t] = true
+		}
+	}
+
+	searchIndexLock.Lock()
+	defer searchIndexLock.Unlock()
+
+	index := getSearchIndex()
+	index.remove(clip.id)
+
+	clipTerms := make([]string, 0, len(terms))
+	for t := range terms {
+		clipTerms = append(clipTerms, t)
+		index.Terms[t] = append(index.Terms[t], clip.id)
+	}
+	sort.Strings(clipTerms)
+	index.Clips[clip.id] = clipTerms
+	index.Times[clip.id] = clipMeta.ModificationTime
+
+	scheduleSearchIndexSave()
+	return nil
+}
+
+// IsTextMIME - Checks if a MIME type describes text, which can be searched
+func IsTextMIME(mime string) bool {
+	mime = strings.TrimSpace(strings.ToLower(strings.SplitN(mime, ";", 2)[0]))
+
+	if strings.HasPrefix(mime, "text/") {
+		return true
+	}
+	if strings.HasSuffix(mime, "+json") || strings.HasSuffix(mime, "+xml") {
+		return true
+	}
+
+	switch mime {
+	case "application/json", "application/xml", "application/javascript", "application/x-yaml", "application/x-sh":
+		return true
+	}
+
+	return false
+}
+
+// LoadSearchIndex - Loads the search index from ClipStorage and
+// (re)indexes all clips, which are not part of it
+func LoadSearchIndex() error {
+	searchIndexLock.Lock()
+
+	if searchIndexSaveTimer != nil {
+		// changes of the old index are replaced
+		searchIndexSaveTimer.Stop()
+		searchIndexSaveTimer = nil
+	}
+
+	index := newSearchIndex()
+
+	indexBytes, err := ReadObject(SearchIndexFileName)
+	if err == nil {
+		err = json.Unmarshal(indexBytes, index)
+		if err != nil || index.Terms == nil || index.Clips == nil {
+			// rebuild
+			index = newSearchIndex()
+		}
+		if index.Times == nil {
+			index.Times = map[string]int64{}
+		}
+	} else if !os.IsNotExist(err) {
+		searchIndexLock.Unlock()
+		return err
+	}
+
+	clipSearchIndex = index
+
+	clips, err := ScanClips()
+	if err != nil {
+		searchIndexLock.Unlock()
+		return err
+	}
+
+	// remove clips, which do not exist anymore
+	existingIDs := map[string]bool{}
+	for _, c := range clips {
+		existingIDs[c.id] = true
+	}
+	for id := range index.Clips {
+		if !existingIDs[id] {
+			index.remove(id)
+		}
+	}
+
+	searchIndexLock.Unlock()
+
+	// add missing clips and the ones, which have been changed
+	// after the last save, like before a crash
+	for _, c := range clips {
+		searchIndexLock.Lock()
+		_, isIndexed := index.Clips[c.id]
+		indexedTime := index.Times[c.id]
+		searchIndexLock.Unlock()
+
+		if isIndexed {
+			clipMeta, err := c.ReadMeta()
+			if err != nil {
+				return err
+			}
+			if clipMeta.ModificationTime == indexedTime && !clipMeta.Burn {
+				continue
+			}
+		}
+
+		err := IndexClip(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return SaveSearchIndex()
+}
+
+// RemoveClipFromIndex - Removes a clip from the search index
+func RemoveClipFromIndex(id string) error {
+	searchIndexLock.Lock()
+	defer searchIndexLock.Unlock()
+
+	index := getSearchIndex()
+	if _, ok := index.Clips[id]; !ok {
+		return nil
+	}
+
+	index.remove(id)
+
+	scheduleSearchIndexSave()
+	return nil
+}
+
+// SaveSearchIndex - Saves all pending changes of the search index to ClipStorage at once
+func SaveSearchIndex() error {
+	searchIndexSaveLock.Lock()
+	defer searchIndexSaveLock.Unlock()
+
+	searchIndexLock.Lock()
+	if searchIndexSaveTimer != nil {
+		searchIndexSaveTimer.Stop()
+		searchIndexSaveTimer = nil
+	}
+
+	indexBytes, err := json.Marshal(getSearchIndex())
+	searchIndexLock.Unlock()
+
+	if err != nil || ClipStorage == nil {
+		return err
+	}
+
+	// written without lock, so searches and updates are not blocked
+	return WriteObject(SearchIndexFileName, indexBytes)
+}
+
+// SearchClipIDs - Returns the IDs of all clips, which contain all terms of a query
+func SearchClipIDs(query string) []string {
+	terms := TokenizeSearchText(query)
+	if len(terms) == 0 {
+		return []string{}
+	}
+
+	searchIndexLock.Lock()
+	defer searchIndexLock.Unlock()
+
+	index := getSearchIndex()
+
+	var ids map[string]bool
+	for _, t := range terms {
+		termIDs := map[string]bool{}
+		for _, id := range index.Terms[t] {
+			if ids == nil || ids[id] {
+				termIDs[id] = true
+			}
+		}
+
+		ids = termIDs
+	}
+
+	result := make([]string, 0, len(ids))
+	for id := range ids {
+		result = append(result, id)
+	}
+
+	return result
+}
+
+// TokenizeSearchText - Splits a text into lower case search terms
+func TokenizeSearchText(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if utf8.RuneCountInString(f) > 1 {
+			terms = append(terms, f)
+		}
+	}
+
+	return terms
+}
+
+func findSearchMatches(field string, text string, terms []string) (searchMatch, bool) {
+	var match searchMatch
+	match.Field = field
+
+	patterns := make([]string, 0, len(terms))
+	for _, t := range terms {
+		patterns = append(patterns, regexp.QuoteMeta(t))
+	}
+
+	locations := regexp.MustCompile("(?i)"+strings.Join(patterns, "|")).FindAllStringIndex(text, -1)
+	if len(locations) == 0 {
+		return match, false
+	}
+
+	// snippet around the first matches
+	start := locations[0][0] - searchSnippetContext
+	if start < 0 {
+		start = 0
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+
+	end := locations[0][1] + searchSnippetContext
+	for i, l := range locations {
+		if i >= maxSearchSnippets || l[1] > end+searchSnippetContext {
+			break
+		}
+
+		if l[1]+searchSnippetContext > end {
+			end = l[1] + searchSnippetContext
+		}
+	}
+	if end > len(text) {
+		end = len(text)
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	match.Snippet = text[start:end]
+	match.Highlights = make([]searchHighlight, 0)
+	for _, l := range locations {
+		if l[0] >= start && l[1] <= end {
+			match.Highlights = append(match.Highlights, searchHighlight{
+				Start: l[0] - start,
+				End:   l[1] - start,
+			})
+		}
+	}
+
+	return match, true
+}
+
+func getSearchIndex() *searchIndex {
+	if clipSearchIndex == nil {
+		clipSearchIndex = newSearchIndex()
+	}
+
+	return clipSearchIndex
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		Terms: map[string][]string{},
+		Clips: map[string][]string{},
+		Times: map[string]int64{},
+	}
+}
+
+func readSearchContent(clip ClipFile, clipMeta clipMetaData) (string, error) {
+	file, err := ClipStorage.Get(clip.file)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	decoder, err := NewDecoder(clipMeta.Encoding, file)
+	if err != nil {
+		return "", err
+	}
+	defer decoder.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(decoder, MaxSearchContentSize))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToValidUTF8(string(content), ""), nil
+}
+
+func (index *searchIndex) remove(id string) {
+	for _, t := range index.Clips[id] {
+		ids := index.Terms[t]
+		for i, termID := range ids {
+			if termID == id {
+				ids = append(ids[:i], ids[i+1:]...)
+				break
+			}
+		}
+
+		if len(ids) == 0 {
+			delete(index.Terms, t)
+		} else {
+			index.Terms[t] = ids
+		}
+	}
+
+	delete(index.Clips, id)
+	delete(index.Times, id)
+}
+
+// scheduleSearchIndexSave - Saves the search index after SearchIndexSaveDelay, together with
+// all other changes until then, must be called with lock
+//
+// Changes, which are lost by a crash, are indexed again by LoadSearchIndex().
+func scheduleSearchIndexSave() {
+	if searchIndexSaveTimer != nil {
+		return
+	}
+
+	searchIndexSaveTimer = time.AfterFunc(SearchIndexSaveDelay, func() {
+		err := SaveSearchIndex()
+		if err != nil {
+			log.Println("[WARN] Saving search index failed", err.Error())
+		}
+	})
+}
+
+func searchClips(w http.ResponseWriter, req *http.Request) {
+	query := strings.TrimSpace(req.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Missing value for q", 400)
+		return
+	}
+
+	limit := 50
+	if req.URL.Query().Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(req.URL.Query().Get("limit"))
+		if err != nil || limit < 1 || limit > MaxClipListLimit {
+			http.Error(w, "Invalid value for limit", 400)
+			return
+		}
+	}
+
+	terms := TokenizeSearchText(query)
+
+	// rank by the in-memory indexes, before reading any data
+	now := time.Now()
+	user := GetRequestUser(req)
+	clips := make([]clipItem, 0)
+	for _, id := range SearchClipIDs(query) {
+		entry, ok := ClipIndex.Get(id)
+		if !ok || entry.Meta.Burn || entry.Meta.IsExpired(now) || !user.CanAccess(entry.Clip) {
+			continue
+		}
+
+		clips = append(clips, newClipItem(entry.Clip, entry.Meta))
+	}
+
+	// newest first
+	sort.Slice(clips, func(i, j int) bool {
+		return clipListSorters["newest"](clips[i], clips[j])
+	})
+	if len(clips) > limit {
+		clips = clips[0:limit]
+	}
+
+	// load snippets of the returned clips only
+	items := make([]searchResultItem, 0, len(clips))
+	for _, c := range clips {
+		clip, err := GetActiveUserClip(req, c.ID)
+		if err != nil {
+			continue
+		}
+
+		clipMeta, err := clip.ReadMeta()
+		if err != nil {
+			continue
+		}
+
+		var newItem searchResultItem
+		newItem.Clip = newClipItem(clip, clipMeta)
+		newItem.Matches = make([]searchMatch, 0)
+
+		if match, ok := findSearchMatches("name", clipMeta.Name, terms); ok {
+			newItem.Matches = append(newItem.Matches, match)
+		}
+		if IsTextMIME(clipMeta.MIME) && !clipMeta.Burn {
+			content, err := readSearchContent(clip, clipMeta)
+			if err == nil {
+				if match, ok := findSearchMatches("content", content, terms); ok {
+					newItem.Matches = append(newItem.Matches, match)
+				}
+			}
+		}
+
+		items = append(items, newItem)
+	}
+
+	bytes, err := json.Marshal(items)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	w.Write(bytes)
+}
@@ -0,0 +1,204 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStorage - A storage, which counts the reads of clip data
+type countingStorage struct {
+	Storage
+	gets int64
+}
+
+func (s *countingStorage) Get(key string) (StorageObject, error) {
+	if _, suffix, ok := parseClipKey(key); ok && suffix == "" {
+		atomic.AddInt64(&s.gets, 1)
+	}
+
+	return s.Storage.Get(key)
+}
+
+func (server *testServer) search(query string) []searchResultItem {
+	var items []searchResultItem
+	json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/search?"+query, "")), &items)
+
+	return items
+}
+
+func TestSearchClips(t *testing.T) {
+	server := newTestServer(t)
+
+	fox := server.upload("The quick brown fox jumps over the lazy dog", "Content-Type", "text/plain", "X-Cclip-Name", "animals")
+	time.Sleep(10 * time.Millisecond)
+	cat := server.upload("A quick cat", "Content-Type", "text/plain", "X-Cclip-Name", "Fox notes")
+	server.upload("quick fox", "Content-Type", "application/octet-stream")
+
+	server.expectStatus(400, "GET", "/clips/search", "")
+	server.expectStatus(400, "GET", "/clips/search?q=fox&limit=0", "")
+
+	// all terms must match, and only text is searched
+	items := server.search("q=" + url.QueryEscape("Quick FOX"))
+	if len(items) != 2 || items[0].Clip.ID != cat.ID || items[1].Clip.ID != fox.ID {
+		t.Fatalf("unexpected search results %+v", items)
+	}
+	if len(items[0].Matches) != 2 || items[0].Matches[0].Field != "name" || items[0].Matches[1].Field != "content" {
+		t.Errorf("unexpected matches %+v", items[0].Matches)
+	}
+
+	content := items[1].Matches[0]
+	if content.Field != "content" || len(content.Highlights) != 2 {
+		t.Fatalf("unexpected match %+v", content)
+	}
+	for _, h := range content.Highlights {
+		term := strings.ToLower(content.Snippet[h.Start:h.End])
+		if term != "quick" && term != "fox" {
+			t.Errorf("unexpected highlight %q", term)
+		}
+	}
+
+	// newest first
+	items = server.search("q=quick&limit=1")
+	if len(items) != 1 || items[0].Clip.ID != cat.ID {
+		t.Errorf("unexpected search results %+v", items)
+	}
+
+	if items := server.search("q=lazy+cat"); len(items) != 0 {
+		t.Errorf("unexpected search results %+v", items)
+	}
+
+	server.expectStatus(204, "DELETE", "/clips/"+fox.ID, "")
+	if items := server.search("q=lazy"); len(items) != 0 {
+		t.Errorf("deleted clip has been found %+v", items)
+	}
+}
+
+func TestSearchReadsReturnedClipsOnly(t *testing.T) {
+	server := newTestServer(t)
+
+	for i := 0; i < 5; i++ {
+		server.upload("needle in a haystack", "Content-Type", "text/plain")
+	}
+
+	storage := &countingStorage{Storage: ClipStorage}
+	ClipStorage = storage
+	defer func() { ClipStorage = storage.Storage }()
+
+	if items := server.search("q=needle&limit=2"); len(items) != 2 {
+		t.Fatalf("unexpected search results %+v", items)
+	}
+	if gets := atomic.LoadInt64(&storage.gets); gets != 2 {
+		t.Errorf("%d clips have been read for 2 results", gets)
+	}
+}
+
+func TestSearchSkipsBurnClips(t *testing.T) {
+	server := newTestServer(t)
+
+	burn := server.upload("secret needle", "Content-Type", "text/plain", "X-Cclip-Burn", "true", "X-Cclip-Name", "needle")
+	clip := server.upload("another needle", "Content-Type", "text/plain")
+
+	storage := &countingStorage{Storage: ClipStorage}
+	ClipStorage = storage
+	defer func() { ClipStorage = storage.Storage }()
+
+	if items := server.search("q=needle"); len(items) != 1 || items[0].Clip.ID != clip.ID {
+		t.Fatalf("unexpected search results %+v", items)
+	}
+	if gets := atomic.LoadInt64(&storage.gets); gets != 1 {
+		t.Errorf("%d clips have been read for 1 result", gets)
+	}
+
+	// a clip, which becomes burn-after-read, is removed from the index
+	server.expectStatus(200, "PATCH", "/clips/"+clip.ID, `{"burn":true}`)
+	if items := server.search("q=needle"); len(items) != 0 {
+		t.Errorf("unexpected search results %+v", items)
+	}
+	if err := SaveSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if index := readStoredSearchIndex(t); len(index.Clips) != 0 || len(index.Terms) != 0 {
+		t.Errorf("burn-after-read clips have been indexed %+v", index)
+	}
+
+	// the search has not burned anything
+	if data := server.expectStatus(200, "GET", "/clips/"+burn.ID, ""); data != "secret needle" {
+		t.Errorf("clip contains %q", data)
+	}
+}
+
+func TestSearchIndexSaves(t *testing.T) {
+	server := newTestServer(t)
+
+	saveDelay := SearchIndexSaveDelay
+	SearchIndexSaveDelay = time.Hour
+	defer func() { SearchIndexSaveDelay = saveDelay }()
+
+	clip := server.upload("some text", "Content-Type", "text/plain", "X-Cclip-Name", "first")
+
+	// saved later
+	index := readStoredSearchIndex(t)
+	if _, ok := index.Clips[clip.ID]; ok {
+		t.Fatal("search index has been saved at once")
+	}
+
+	if err := SaveSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	index = readStoredSearchIndex(t)
+	if _, ok := index.Clips[clip.ID]; !ok {
+		t.Fatal("search index has not been saved")
+	}
+
+	// a change, which is lost by a crash, is indexed again on startup
+	server.expectStatus(200, "PATCH", "/clips/"+clip.ID, `{"name":"second"}`)
+	if err := LoadSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	if items := server.search("q=second"); len(items) != 1 {
+		t.Errorf("changed clip has not been found %+v", items)
+	}
+	if items := server.search("q=first"); len(items) != 0 {
+		t.Errorf("old name has been found %+v", items)
+	}
+}
+
+func readStoredSearchIndex(t *testing.T) *searchIndex {
+	t.Helper()
+
+	index := newSearchIndex()
+
+	indexBytes, err := ReadObject(SearchIndexFileName)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(indexBytes, index); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return index
+}
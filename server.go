@@ -17,7 +17,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -39,15 +43,99 @@ type clipItem struct {
 	Name             string `json:"name"`
 	MIME             string `json:"mime"`
 	CreationTime     int64  `json:"ctime"`
+	UploadTime       int64  `json:"utime"`
 	ModificationTime int64  `json:"mtime"`
 	Size             int64  `json:"size"`
+	StoredSize       int64  `json:"stored_size"`
+	Encoding         string `json:"encoding,omitempty"`
+	ExpiresAt        int64  `json:"expires,omitempty"`
+	Burn             bool   `json:"burn"`
+	SHA256           string `json:"sha256,omitempty"`
 	ResourceLink     string `json:"resource"`
-	ShareLink        string `json:"share"`
+	SharesLink       string `json:"shares"`
+	User             string `json:"user,omitempty"`
+
+	// upload time in nanoseconds, for sorting
+	uploadTimeNs int64
 }
 
 type clipMetaData struct {
-	Name string `json:"name"`
-	MIME string `json:"mime"`
+	Name      string `json:"name"`
+	MIME      string `json:"mime"`
+	ExpiresAt int64  `json:"expires,omitempty"`
+	Burn      bool   `json:"burn,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	// UNIX timestamps, in nanoseconds
+	CreationTime     int64 `json:"ctime,omitempty"`
+	UploadTime       int64 `json:"utime,omitempty"`
+	ModificationTime int64 `json:"mtime,omitempty"`
+	// codec of compressed data, s. CompressionCodec
+	Encoding string `json:"encoding,omitempty"`
+	// size of the decompressed data
+	Size int64 `json:"size,omitempty"`
+	// ID of the shared data object, if it is not derived from SHA256, s. NewBlobID()
+	Blob string `json:"blob,omitempty"`
+}
+
+// BlobID - Returns the ID of the shared data object of the clip, s. GetBlobFile()
+func (m clipMetaData) BlobID() string {
+	if m.Blob != "" {
+		return m.Blob
+	}
+	if m.SHA256 == "" || m.Encoding == "" {
+		return m.SHA256
+	}
+
+	// the same data can be stored with different codecs
+	return m.SHA256 + "." + m.Encoding
+}
+
+// GetCreationTime - Returns the time, the clip has been created
+func (m clipMetaData) GetCreationTime(fallback time.Time) time.Time {
+	if m.CreationTime > 0 {
+		return time.Unix(0, m.CreationTime)
+	}
+
+	return fallback
+}
+
+// GetModificationTime - Returns the time, the data or meta data of the clip has been changed
+func (m clipMetaData) GetModificationTime(fallback time.Time) time.Time {
+	if m.ModificationTime > 0 {
+		return time.Unix(0, m.ModificationTime)
+	}
+
+	return fallback
+}
+
+// GetUploadTime - Returns the time, the current data of the clip has been uploaded
+func (m clipMetaData) GetUploadTime(fallback time.Time) time.Time {
+	if m.UploadTime > 0 {
+		return time.Unix(0, m.UploadTime)
+	}
+
+	return fallback
+}
+
+// GetSize - Returns the size of the (decompressed) data of the clip
+func (m clipMetaData) GetSize(storedSize int64) int64 {
+	if m.Encoding != "" {
+		return m.Size
+	}
+
+	return storedSize
+}
+
+// IsExpired - Checks if the clip has been expired
+func (m clipMetaData) IsExpired(now time.Time) bool {
+	return m.ExpiresAt > 0 && now.Unix() >= m.ExpiresAt
+}
+
+type patchClipRequest struct {
+	Name      *string `json:"name"`
+	MIME      *string `json:"mime"`
+	ExpiresAt *int64  `json:"expires"`
+	Burn      *bool   `json:"burn"`
 }
 
 type serverInfo struct {
@@ -60,50 +148,53 @@ type uploadFileResponse struct {
 	Name             string `json:"name"`
 	MIME             string `json:"mime"`
 	CreationTime     int64  `json:"ctime"`
+	UploadTime       int64  `json:"utime"`
 	ModificationTime int64  `json:"mtime"`
 	Size             int64  `json:"size"`
+	StoredSize       int64  `json:"stored_size"`
+	Encoding         string `json:"encoding,omitempty"`
+	ExpiresAt        int64  `json:"expires,omitempty"`
+	Burn             bool   `json:"burn"`
+	SHA256           string `json:"sha256,omitempty"`
 	ResourceLink     string `json:"resource"`
-	ShareLink        string `json:"share"`
+	SharesLink       string `json:"shares"`
 }
 
-// Password - The API password
+// DefaultClipTTL - The default time-to-live of a clip, in seconds
+var DefaultClipTTL int64 = 0
+
+// Password - The API password of the shared namespace, s. AuthenticateRequest() and PasswordHash
 var Password string
 
-func checkPassword(next http.Handler) http.Handler {
-	authorization := "Bearer " + Password
+func deleteAllClips(w http.ResponseWriter, req *http.Request) {
+	user := GetRequestUser(req)
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Authorization") != authorization {
-			w.WriteHeader(401)
-			return
+	for _, c := range ClipIndex.List() {
+		if !user.CanAccess(c) {
+			continue
 		}
 
-		next.ServeHTTP(w, r)
-	})
-}
+		unlock := LockClip(c.id)
+		err := c.Delete()
+		unlock()
 
-func deleteAllClips(w http.ResponseWriter, req *http.Request) {
-	clips, err := ScanClipDirectory()
-	if err == nil {
-		for _, c := range clips {
-			err := c.Delete()
-			if err != nil {
-				SendError(w, err)
-				return
-			}
+		if err != nil && !os.IsNotExist(err) {
+			SendError(w, err)
+			return
 		}
-
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(204)
-	} else {
-		SendError(w, err)
 	}
+
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(204)
 }
 
 func deleteClip(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
-	clip, err := GetClipByID(vars["id"])
+	unlock := LockClip(vars["id"])
+	defer unlock()
+
+	clip, err := GetUserClip(req, vars["id"])
 	if err == nil {
 		err = clip.Delete()
 		if err == nil {
@@ -114,108 +205,87 @@ func deleteClip(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if os.IsNotExist(err) {
+		w.WriteHeader(404)
+		return
+	}
+
 	SendError(w, err)
 }
 
 func getClipData(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
-	clipFileName := path.Join(ClipDirectory, vars["id"])
-	clipFileStat, err := os.Stat(clipFileName)
+	clip, err := GetActiveUserClip(req, vars["id"])
 	if err != nil {
-		SendError(w, err)
-		return
-	}
-
-	if clipFileStat.IsDir() {
-		w.WriteHeader(404)
-		return
-	}
-
-	clipMetaFileName := path.Join(ClipDirectory, vars["id"]+".meta")
-	clipMetaFileStat, err := os.Stat(clipMetaFileName)
-	if err != nil {
-		SendError(w, err)
-		return
-	}
-
-	if clipMetaFileStat.IsDir() {
-		w.WriteHeader(404)
-		return
-	}
-
-	// get mime type
-	var clipMime string
-	{
-		clipMetaBytes, err := ioutil.ReadFile(clipMetaFileName)
-		if err == nil {
-			var clipMeta clipMetaData
-
-			err := json.Unmarshal(clipMetaBytes, &clipMeta)
-			if err == nil {
-				clipMime = clipMeta.MIME
-			}
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
 		}
-	}
-	clipMime = strings.TrimSpace(strings.ToLower(clipMime))
 
-	file, err := os.Open(clipFileName)
-	if err != nil {
-		SendError(w, err)
 		return
 	}
 
-	defer file.Close()
+	SendClipData(w, req, clip)
+}
 
-	if clipMime != "" {
-		w.Header().Set("Content-Type", clipMime)
-	}
-	w.Header().Set("Content-Length", strconv.FormatInt(clipFileStat.Size(), 10))
-	w.Header().Set("Date", clipFileStat.ModTime().Format(http.TimeFormat))
-	io.Copy(w, file)
+func newClipItem(c ClipFile, clipMeta clipMetaData) clipItem {
+	var newItem clipItem
+	newItem.ID = c.id
+	newItem.MIME = clipMeta.MIME
+	newItem.Name = clipMeta.Name
+	newItem.CreationTime = clipMeta.GetCreationTime(c.fileInfo.ModTime).Unix()
+	newItem.UploadTime = clipMeta.GetUploadTime(c.fileInfo.ModTime).Unix()
+	newItem.uploadTimeNs = c.UploadTime().UnixNano()
+	newItem.ModificationTime = clipMeta.GetModificationTime(c.fileInfo.ModTime).Unix()
+	newItem.Size = clipMeta.GetSize(c.fileInfo.Size)
+	newItem.StoredSize = c.fileInfo.Size
+	newItem.Encoding = clipMeta.Encoding
+	newItem.ExpiresAt = clipMeta.ExpiresAt
+	newItem.Burn = clipMeta.Burn
+	newItem.SHA256 = clipMeta.SHA256
+	newItem.ResourceLink = "/api/v1/clips/" + url.PathEscape(newItem.ID)
+	newItem.SharesLink = "/api/v1/clips/" + url.PathEscape(newItem.ID) + "/shares"
+	newItem.User = c.User()
+
+	return newItem
 }
 
 func getClips(w http.ResponseWriter, req *http.Request) {
-	// try scan directory for ".meta" files
-	clips, err := ScanClipDirectory()
+	options, err := parseClipListOptions(req.URL.Query())
 	if err != nil {
-		SendError(w, err)
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
+	now := time.Now()
+	user := GetRequestUser(req)
+
+	var newestClip *ClipFile
 	items := make([]clipItem, 0)
 
-	for _, c := range clips {
-		clipMetaBytes, err := ioutil.ReadFile(c.metaFile)
-		if err != nil {
-			continue
+	ClipIndex.Each(func(entry ClipIndexEntry) bool {
+		if entry.Meta.IsExpired(now) || !user.CanAccess(entry.Clip) {
+			return true
 		}
 
-		var clipMeta clipMetaData
-		err = json.Unmarshal(clipMetaBytes, &clipMeta)
-		if err != nil {
-			continue
+		if newestClip == nil {
+			newestClip = &entry.Clip
 		}
 
-		// clip meta from JSON
-		err = json.Unmarshal(clipMetaBytes, &clipMeta)
-		if err != nil {
-			continue
+		// create a new clip item for the result list
+		newItem := newClipItem(entry.Clip, entry.Meta)
+		if options.includes(newItem) {
+			items = append(items, newItem)
 		}
 
-		// create a new clip item for the result list
-		var newItem clipItem
-		newItem.ID = c.id
-		newItem.MIME = clipMeta.MIME
-		newItem.Name = clipMeta.Name
-		newItem.ModificationTime = c.fileInfo.ModTime().Unix()
-		newItem.CreationTime = newItem.ModificationTime
-		newItem.Size = c.fileInfo.Size()
-		newItem.ResourceLink = "/api/v1/clips/" + url.PathEscape(newItem.ID)
-		newItem.ShareLink = "/api/v1/shares/" + url.PathEscape(newItem.ID)
+		// the index is sorted by newest first, so the first page is
+		// complete, if it has one more item than requested
+		return !(options.Sort == "newest" && options.Limit > 0 && len(items) > options.Limit)
+	})
 
-		items = append(items, newItem)
-	}
+	items, nextCursor := options.ApplyTo(items)
 
 	// serialize list to JSON
 	bytes, err := json.Marshal(items)
@@ -224,35 +294,49 @@ func getClips(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if len(clips) > 0 {
-		w.Header().Set("Date", clips[0].fileInfo.ModTime().Format(http.TimeFormat))
+	if newestClip != nil {
+		w.Header().Set("Date", newestClip.UploadTime().Format(http.TimeFormat))
 	}
 
+	if nextCursor != "" {
+		nextURL := *req.URL
+		query := nextURL.Query()
+		query.Set("cursor", nextCursor)
+		nextURL.RawQuery = query.Encode()
+
+		w.Header().Set("Link", "<"+nextURL.RequestURI()+">; rel=\"next\"")
+		w.Header().Set("X-Cclip-Next-Cursor", nextCursor)
+	}
+
+	SetUsageHeaders(w, user.Usage())
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
 	w.Write(bytes)
 }
 
 func getClipsHead(w http.ResponseWriter, req *http.Request) {
-	clips, err := ScanClipDirectory()
-	if err == nil {
-		if len(clips) > 0 {
-			w.Header().Set("Date", clips[0].fileInfo.ModTime().Format(http.TimeFormat))
+	now := time.Now()
+	user := GetRequestUser(req)
+
+	ClipIndex.Each(func(entry ClipIndexEntry) bool {
+		if entry.Meta.IsExpired(now) || !user.CanAccess(entry.Clip) {
+			return true
 		}
 
-		w.Header().Set("Content-Length", "0")
-		w.Header().Set("X-Cclip-Count", strconv.Itoa(len(clips)))
+		w.Header().Set("Date", entry.Clip.UploadTime().Format(http.TimeFormat))
+		return false
+	})
 
-		w.WriteHeader(204)
-	} else {
-		w.WriteHeader(500)
-	}
+	w.Header().Set("Content-Length", "0")
+	SetUsageHeaders(w, user.Usage())
+
+	w.WriteHeader(204)
 }
 
 func getServerInfo(w http.ResponseWriter, req *http.Request) {
 	// collect data
 	var info serverInfo
-	info.IP = req.RemoteAddr
+	info.IP = GetClientIP(req)
 	info.Time = time.Now().Format(time.RFC3339)
 
 	// serialize to JSON
@@ -266,57 +350,157 @@ func getServerInfo(w http.ResponseWriter, req *http.Request) {
 	w.Write(bytes)
 }
 
-func uploadClip(w http.ResponseWriter, req *http.Request) {
-	tmpFile, err := ioutil.TempFile("", "cclip")
+func patchClip(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var patch patchClipRequest
+	err := json.NewDecoder(req.Body).Decode(&patch)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	unlock := LockClip(vars["id"])
+	defer unlock()
+
+	clip, err := GetActiveUserClip(req, vars["id"])
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	clipMeta, err := clip.ReadMeta()
 	if err != nil {
 		SendError(w, err)
 		return
 	}
 
-	// try delete, when leave function
-	defer os.Remove(tmpFile.Name())
+	// update only submitted fields
+	if patch.Name != nil {
+		clipMeta.Name = strings.TrimSpace(*patch.Name)
+	}
+	if patch.MIME != nil {
+		clipMeta.MIME = strings.TrimSpace(strings.ToLower(*patch.MIME))
+	}
+	if patch.ExpiresAt != nil {
+		if *patch.ExpiresAt < 0 {
+			http.Error(w, "Invalid value for expires", 400)
+			return
+		}
 
-	if MaxClipSize > 0 {
-		// has a maximum size
-		req.Body = http.MaxBytesReader(w, req.Body, MaxClipSize)
+		clipMeta.ExpiresAt = *patch.ExpiresAt
 	}
+	if patch.Burn != nil {
+		clipMeta.Burn = *patch.Burn
+	}
+	clipMeta.ModificationTime = time.Now().UnixNano()
 
-	defer req.Body.Close()
+	err = clip.WriteMeta(clipMeta)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
 
-	_, err = io.Copy(tmpFile, req.Body)
+	err = IndexClip(clip)
+	if err != nil {
+		log.Println("[WARN] Could not index clip", clip.id, err.Error())
+	}
+
+	bytes, err := json.Marshal(newClipItem(clip, clipMeta))
 	if err != nil {
 		SendError(w, err)
 		return
 	}
 
-	ctime := time.Now().Unix()
-	id := strings.ReplaceAll(uuid.New().String(), "-", "")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	w.Write(bytes)
+}
 
-	clipFileName := path.Join(ClipDirectory, id)
-	clipMetaFileName := path.Join(ClipDirectory, id+".meta")
+func sendExistingClip(w http.ResponseWriter, clip ClipFile) {
+	clipMeta, err := clip.ReadMeta()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
 
-	err = MoveFile(tmpFile.Name(), clipFileName)
+	bytes, err := json.Marshal(newClipItem(clip, clipMeta))
 	if err != nil {
 		SendError(w, err)
 		return
 	}
 
-	clipFile, err := os.Open(clipFileName)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	w.Header().Set("X-Cclip-Duplicate", "1")
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+func uploadClip(w http.ResponseWriter, req *http.Request) {
+	// time-to-live
+	ttl := DefaultClipTTL
+	headerTTL := strings.TrimSpace(req.Header.Get("X-Cclip-TTL"))
+	if headerTTL != "" {
+		var err error
+		ttl, err = strconv.ParseInt(headerTTL, 10, 64)
+		if err != nil || ttl < 0 {
+			http.Error(w, "Invalid value for X-Cclip-TTL", 400)
+			return
+		}
+	}
+
+	// burn after read
+	var burn bool
+	headerBurn := strings.TrimSpace(strings.ToLower(req.Header.Get("X-Cclip-Burn")))
+	if headerBurn != "" {
+		var err error
+		burn, err = strconv.ParseBool(headerBurn)
+		if err != nil {
+			http.Error(w, "Invalid value for X-Cclip-Burn", 400)
+			return
+		}
+	}
+
+	tmpFile, hash, err := ReceiveClipData(w, req)
 	if err != nil {
-		os.Remove(clipFileName)
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			SendRateLimitError(w, rateLimitErr)
+		} else {
+			SendError(w, err)
+		}
 
-		SendError(w, err)
 		return
 	}
 
-	defer clipFile.Close()
+	// try delete, when leave function
+	defer os.Remove(tmpFile)
+
+	user := GetRequestUser(req)
+
+	if DedupMode == "reuse" && !burn {
+		existingClip, ok := FindClipByHash(hash, user.Name)
+		if ok {
+			// return existing clip instead
+			sendExistingClip(w, existingClip)
+			return
+		}
+	}
+
+	now := time.Now()
+	ctime := now.Unix()
+	id := strings.ReplaceAll(uuid.New().String(), "-", "")
 
 	clipMime := strings.TrimSpace(strings.ToLower(req.Header.Get("Content-Type")))
 	if clipMime == "" {
-		clipMime, err = GetFileContentType(clipFile)
+		clipMime, err = GetContentTypeOfFile(tmpFile)
 		if err != nil {
-			os.Remove(clipFileName)
-
 			SendError(w, err)
 			return
 		}
@@ -326,44 +510,105 @@ func uploadClip(w http.ResponseWriter, req *http.Request) {
 	var clipMeta clipMetaData
 	clipMeta.MIME = clipMime
 	clipMeta.Name = strings.TrimSpace(req.Header.Get("X-Cclip-Name"))
+	clipMeta.CreationTime = now.UnixNano()
+	clipMeta.UploadTime = now.UnixNano()
+	clipMeta.ModificationTime = now.UnixNano()
+	if ttl > 0 {
+		clipMeta.ExpiresAt = ctime + ttl
+	}
+	clipMeta.Burn = burn
+	clipMeta.SHA256 = hash
+
+	dataFile, err := CompressClipData(tmpFile, &clipMeta)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+	if dataFile != tmpFile {
+		defer os.Remove(dataFile)
+	}
+	clipMeta.Blob = NewBlobID(clipMeta.SHA256, clipMeta.Encoding)
+
+	// in the namespace of the uploading user, also for admins
+	setClipUser(id, user.Name)
+
+	var newClip ClipFile
+	newClip.file = GetUserPrefix(user.Name) + GetLayoutKey(id, ClipLayout)
+	newClip.id = id
+
+	// data first, meta data last, s. RecoverPendingClips()
+	err = newClip.BeginOperation("upload", clipMeta, 0)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
 
-	// serialize meta to JSON
-	bytes, err := json.Marshal(clipMeta)
+	err = StoreClipData(dataFile, clipMeta.BlobID(), newClip.file)
 	if err != nil {
-		os.Remove(clipFileName)
+		// rollback
+		newClip.delete(clipMeta)
 
 		SendError(w, err)
 		return
 	}
 
-	// try write to .meta file
-	err = ioutil.WriteFile(clipMetaFileName, bytes, 0644)
+	err = ClipMetaStore.Write(id, 0, clipMeta)
+	if err == nil {
+		err = newClip.FinishOperation()
+	}
 	if err != nil {
-		os.Remove(clipFileName)
+		// rollback
+		newClip.delete(clipMeta)
+
+		SendError(w, err)
+		return
+	}
 
+	err = ClipIndex.Refresh(id)
+	if err != nil {
 		SendError(w, err)
 		return
 	}
 
+	newClip, err = GetClipByID(id)
+	if err == nil {
+		err = IndexClip(newClip)
+	}
+	if err != nil {
+		log.Println("[WARN] Could not index clip", id, err.Error())
+	}
+
+	// remove oldest clips, if needed
+	_, err = EnforceRetentionLimits(id)
+	if err != nil {
+		log.Println("[WARN] Could not enforce retention limits", err.Error())
+	}
+
 	// create response object
 	var response uploadFileResponse
 	response.ID = id
 	response.MIME = clipMeta.MIME
 	response.Name = clipMeta.Name
 	response.ResourceLink = "/api/v1/clips/" + url.PathEscape(id)
-	response.ShareLink = "/api/v1/shares/" + url.PathEscape(id)
+	response.SharesLink = "/api/v1/clips/" + url.PathEscape(id) + "/shares"
 	response.CreationTime = ctime
-	response.ModificationTime = -1
+	response.UploadTime = ctime
+	response.ModificationTime = ctime
+	response.ExpiresAt = clipMeta.ExpiresAt
+	response.Burn = clipMeta.Burn
+	response.SHA256 = clipMeta.SHA256
+	response.Encoding = clipMeta.Encoding
 	response.Size = -1
+	response.StoredSize = -1
 
-	clipFileStat, err := os.Stat(clipFileName)
+	clipFileStat, err := ClipStorage.Stat(newClip.file)
 	if err == nil {
-		response.ModificationTime = clipFileStat.ModTime().Unix()
-		response.Size = clipFileStat.Size()
+		response.Size = clipMeta.GetSize(clipFileStat.Size)
+		response.StoredSize = clipFileStat.Size
 	}
 
 	// serialize response
-	bytes, err = json.Marshal(response)
+	bytes, err := json.Marshal(response)
 	if err != nil {
 		SendError(w, err)
 		return
@@ -376,16 +621,173 @@ func uploadClip(w http.ResponseWriter, req *http.Request) {
 	w.Write(bytes)
 }
 
-// RunServer - Runs the server component
-func RunServer(c *cli.Context) error {
-	// CCLIP_PORT
-	envPort := strings.TrimSpace(os.Getenv("CCLIP_PORT"))
-	if envPort == "" {
-		// default port
-		envPort = "50979"
+// ReceiveClipData - Writes the body of a HTTP request to a temporary file inside ClipDirectory,
+// or the system's temp directory, if clips are not stored in the file system,
+// respecting MaxClipSize and UploadQuota, and returns its path and the SHA-256 hash of the data
+func ReceiveClipData(w http.ResponseWriter, req *http.Request) (string, string, error) {
+	if err := limitUpload(req); err != nil {
+		return "", "", err
 	}
 
-	// CCLIP_DIR
+	// same device as the final file, so it can be renamed atomically
+	tmpFile, err := ioutil.TempFile(ClipDirectory, ".upload-")
+	if err != nil {
+		return "", "", err
+	}
+
+	defer tmpFile.Close()
+
+	if MaxClipSize > 0 {
+		// has a maximum size
+		req.Body = http.MaxBytesReader(w, req.Body, MaxClipSize)
+	}
+
+	defer req.Body.Close()
+
+	hash := sha256.New()
+
+	_, err = io.Copy(io.MultiWriter(tmpFile, hash), req.Body)
+	if err == nil {
+		// data must be on disk, before it is published
+		err = tmpFile.Sync()
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+
+		return "", "", err
+	}
+
+	return tmpFile.Name(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// SendClipData - Sends the data of a clip to a HTTP client, limited to DownloadRate
+//
+// Supports HEAD requests, ranges and conditional requests.
+func SendClipData(w http.ResponseWriter, req *http.Request, clip ClipFile) {
+	// read meta data and open data consistently
+	unlock := RLockClip(clip.id)
+	clipMeta, _ := clip.ReadMeta()
+
+	// a HEAD request does not read a clip,
+	// and the data of a burn-after-read clip is opened, after it has been marked as read
+	burn := clipMeta.Burn && req.Method != "HEAD"
+
+	var file StorageObject
+	var err error
+	if burn {
+		_, err = ClipStorage.Stat(clip.file)
+	} else {
+		file, err = ClipStorage.Get(clip.file)
+	}
+	unlock()
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	// before a burn-after-read clip is marked as read
+	w, rateLimitErr := limitDownload(w, req)
+	if rateLimitErr != nil {
+		if file != nil {
+			file.Close()
+		}
+
+		SendRateLimitError(w, rateLimitErr)
+		return
+	}
+
+	if burn {
+		err = clip.BeginBurn()
+		if err == nil {
+			file, err = ClipStorage.Get(clip.file)
+			if err != nil {
+				clip.FinishBurn(false)
+			}
+		}
+		if err != nil {
+			if err == ErrClipBurned || os.IsNotExist(err) {
+				w.WriteHeader(410)
+			} else {
+				SendError(w, err)
+			}
+
+			return
+		}
+
+		// a clip can only be burned, if it is read completely
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+	}
+
+	defer file.Close()
+
+	clip.fileInfo = file.Info()
+	clip.uploadTime = clipMeta.GetUploadTime(clip.fileInfo.ModTime)
+
+	// get mime type
+	clipMime := strings.TrimSpace(strings.ToLower(clipMeta.MIME))
+
+	if clipMime != "" {
+		w.Header().Set("Content-Type", clipMime)
+	}
+	etag := GetClipETag(clip)
+	if clipMeta.Burn {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	var content io.ReadSeeker = file
+	size := clip.fileInfo.Size
+	if clipMeta.Encoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if AcceptsEncoding(req, clipMeta.Encoding) {
+			// send compressed data as it is
+			w.Header().Set("Content-Encoding", clipMeta.Encoding)
+
+			// another representation needs another entity tag
+			etag = strings.TrimSuffix(etag, "\"") + "-" + clipMeta.Encoding + "\""
+		} else {
+			decoder := NewDecodingReadSeeker(file, clipMeta.Encoding, clipMeta.Size)
+			defer decoder.Close()
+
+			content = decoder
+			size = clipMeta.Size
+		}
+	}
+	w.Header().Set("ETag", etag)
+
+	if !burn {
+		http.ServeContent(w, req, "", clip.UploadTime(), content)
+		return
+	}
+
+	counter := &countingResponseWriter{ResponseWriter: w}
+	http.ServeContent(counter, req, "", clip.UploadTime(), content)
+
+	file.Close()
+
+	// not, if nothing has been sent, like for conditional requests
+	sent := (counter.status == 200 || counter.status == 206) && counter.written == size
+	err = clip.FinishBurn(sent)
+	if err != nil {
+		log.Println("[WARN] Could not finish burn-after-read of clip", clip.id, err.Error())
+	}
+}
+
+// GetClipETag - Returns the entity tag of the current data of a clip
+func GetClipETag(clip ClipFile) string {
+	return fmt.Sprintf("\"%s-%x-%x\"", clip.id, clip.UploadTime().UnixNano(), clip.fileInfo.Size)
+}
+
+// GetClipDirectoryFromEnv - Returns the absolute path of the clip directory from CCLIP_DIR
+func GetClipDirectoryFromEnv() string {
 	envDir := strings.TrimSpace(os.Getenv("CCLIP_DIR"))
 	if envDir == "" {
 		// default clip dir
@@ -400,6 +802,61 @@ func RunServer(c *cli.Context) error {
 		envDir = path.Join(cwd, envDir)
 	}
 
+	return envDir
+}
+
+// NewRouter - Creates the router with all routes of the API
+func NewRouter() *mux.Router {
+	router := mux.NewRouter()
+
+	// routes, which do not require a password, like shares
+	publicRouter := router.NewRoute().Subrouter()
+	publicRouter.Use(checkRateLimit)
+
+	// all other routes
+	apiRouter := router.NewRoute().Subrouter()
+	apiRouter.Use(checkAuthorization, checkRateLimit)
+
+	// initialize public routes
+	AddHTTPAction(publicRouter, "/shares/{token:[0-9a-f]{64}}", "", getShareData, "GET")
+
+	// initialize routes
+	AddHTTPAction(apiRouter, "", "read", getServerInfo, "GET")
+	AddHTTPAction(apiRouter, "/bans", "admin", getBans, "GET")
+	AddHTTPAction(apiRouter, "/bans", "admin", deleteBans, "DELETE")
+	AddHTTPAction(apiRouter, "/bans/{ip}", "admin", deleteBan, "DELETE")
+	AddHTTPAction(apiRouter, "/clips", "delete", deleteAllClips, "DELETE")
+	AddHTTPAction(apiRouter, "/clips", "read", getClips, "GET")
+	AddHTTPAction(apiRouter, "/clips", "read", getClipsHead, "HEAD")
+	AddHTTPAction(apiRouter, "/clips", "write", uploadClip, "POST")
+	AddHTTPAction(apiRouter, "/clips/search", "read", searchClips, "GET")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}", "read", getClipData, "GET")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}", "read", getClipData, "HEAD")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}", "delete", deleteClip, "DELETE")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}", "write", patchClip, "PATCH")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}", "write", replaceClip, "PUT")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}/versions", "read", getClipVersions, "GET")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}/versions/{version:[0-9]+}", "read", getClipVersionData, "GET")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}/versions/{version:[0-9]+}/restore", "write", restoreClipVersion, "POST")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}/shares", "read", getShares, "GET")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}/shares", "write", createShare, "POST")
+	AddHTTPAction(apiRouter, "/clips/{id:[0-9a-f]{32}}/shares/{token:[0-9a-f]{64}}", "write", deleteShare, "DELETE")
+
+	return router
+}
+
+// RunServer - Runs the server component
+func RunServer(c *cli.Context) error {
+	// CCLIP_PORT
+	envPort := strings.TrimSpace(os.Getenv("CCLIP_PORT"))
+	if envPort == "" {
+		// default port
+		envPort = "50979"
+	}
+
+	// CCLIP_DIR
+	envDir := GetClipDirectoryFromEnv()
+
 	// CCLIP_MAX_SIZE
 	envMaxSize := strings.TrimSpace(os.Getenv("CCLIP_MAX_SIZE"))
 	if envMaxSize == "" {
@@ -407,6 +864,130 @@ func RunServer(c *cli.Context) error {
 		envMaxSize = "134217728"
 	}
 
+	// CCLIP_DEFAULT_TTL
+	envDefaultTTL := strings.TrimSpace(os.Getenv("CCLIP_DEFAULT_TTL"))
+	if envDefaultTTL == "" {
+		// no expiration
+		envDefaultTTL = "0"
+	}
+
+	// CCLIP_REAPER_INTERVAL
+	envReaperInterval := strings.TrimSpace(os.Getenv("CCLIP_REAPER_INTERVAL"))
+	if envReaperInterval == "" {
+		// default: every minute
+		envReaperInterval = "60"
+	}
+
+	// CCLIP_MAX_CLIPS
+	envMaxClips := strings.TrimSpace(os.Getenv("CCLIP_MAX_CLIPS"))
+	if envMaxClips == "" {
+		// unlimited
+		envMaxClips = "0"
+	}
+
+	// CCLIP_MAX_TOTAL_SIZE
+	envMaxTotalSize := strings.TrimSpace(os.Getenv("CCLIP_MAX_TOTAL_SIZE"))
+	if envMaxTotalSize == "" {
+		// unlimited
+		envMaxTotalSize = "0"
+	}
+
+	// CCLIP_MAX_USER_CLIPS
+	envMaxUserClips := strings.TrimSpace(os.Getenv("CCLIP_MAX_USER_CLIPS"))
+	if envMaxUserClips == "" {
+		// unlimited
+		envMaxUserClips = "0"
+	}
+
+	// CCLIP_MAX_USER_TOTAL_SIZE
+	envMaxUserTotalSize := strings.TrimSpace(os.Getenv("CCLIP_MAX_USER_TOTAL_SIZE"))
+	if envMaxUserTotalSize == "" {
+		// unlimited
+		envMaxUserTotalSize = "0"
+	}
+
+	// CCLIP_MAX_VERSIONS
+	envMaxVersions := strings.TrimSpace(os.Getenv("CCLIP_MAX_VERSIONS"))
+	if envMaxVersions == "" {
+		// default number of old versions
+		envMaxVersions = "10"
+	}
+
+	// CCLIP_DEDUP
+	envDedup := strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_DEDUP")))
+	if envDedup == "" {
+		// no deduplication
+		envDedup = "off"
+	}
+	if envDedup != "off" && envDedup != "link" && envDedup != "reuse" {
+		log.Fatalln("Invalid value for deduplication mode", envDedup)
+	}
+
+	// CCLIP_COMPRESSION
+	envCompression := strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_COMPRESSION")))
+	if envCompression == "" {
+		// no compression
+		envCompression = "off"
+	}
+	if envCompression != "off" && envCompression != "gzip" && envCompression != "zstd" {
+		log.Fatalln("Invalid compression codec", envCompression)
+	}
+
+	// CCLIP_RESCAN_INTERVAL
+	envRescanInterval := strings.TrimSpace(os.Getenv("CCLIP_RESCAN_INTERVAL"))
+	if envRescanInterval == "" {
+		// default: every minute
+		envRescanInterval = "60"
+	}
+
+	// CCLIP_STORAGE
+	envStorage := strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_STORAGE")))
+	if envStorage == "" {
+		// files inside CCLIP_DIR
+		envStorage = "fs"
+	}
+	if envStorage != "fs" && envStorage != "memory" && envStorage != "s3" {
+		log.Fatalln("Invalid storage backend", envStorage)
+	}
+
+	// CCLIP_LAYOUT
+	envLayout := strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_LAYOUT")))
+	if envLayout == "" {
+		// all clips inside one directory
+		envLayout = "flat"
+	}
+	if envLayout != "flat" && envLayout != "sharded" {
+		log.Fatalln("Invalid clip layout", envLayout)
+	}
+
+	// CCLIP_META_STORE
+	envMetaStore := strings.TrimSpace(strings.ToLower(os.Getenv("CCLIP_META_STORE")))
+	if envMetaStore == "" {
+		// .meta files
+		envMetaStore = "files"
+	}
+	if envMetaStore != "files" && envMetaStore != "sqlite" {
+		log.Fatalln("Invalid meta data store", envMetaStore)
+	}
+	if envMetaStore == "sqlite" && envStorage != "fs" {
+		log.Fatalln("The meta data store sqlite requires the storage backend fs")
+	}
+
+	// CCLIP_ENCRYPTION_KEY, CCLIP_ENCRYPTION_OLD_KEYS
+	encryptionKey, oldEncryptionKeys, err := LoadEncryptionKeysFromEnv()
+	if err != nil {
+		log.Fatalln("Invalid encryption key", err.Error())
+	}
+	if (encryptionKey != nil || len(oldEncryptionKeys) > 0) && envMetaStore == "sqlite" {
+		log.Fatalln("Encryption is not supported by the meta data store sqlite")
+	}
+
+	// CCLIP_ENCRYPTION_ALLOW_UNENCRYPTED
+	allowUnencrypted, err := LoadAllowUnencryptedFromEnv()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
 	// convert CCLIP_PORT to integer
 	port, err := strconv.Atoi(envPort)
 	if err != nil {
@@ -426,19 +1007,85 @@ func RunServer(c *cli.Context) error {
 		log.Fatalln("Invalid value for maximum clip size", maxSize, err.Error())
 	}
 
-	// create output directory, if needed
-	clipDirStat, err := os.Stat(envDir)
-	if os.IsNotExist(err) {
-		err := os.MkdirAll(envDir, 0755)
+	// convert CCLIP_DEFAULT_TTL to integer
+	defaultTTL, err := strconv.ParseInt(envDefaultTTL, 10, 64)
+	if err != nil || defaultTTL < 0 {
+		log.Fatalln("Invalid value for default clip TTL", envDefaultTTL)
+	}
+
+	// convert CCLIP_REAPER_INTERVAL to integer
+	reaperInterval, err := strconv.ParseInt(envReaperInterval, 10, 64)
+	if err != nil || reaperInterval < 1 {
+		log.Fatalln("Invalid value for reaper interval", envReaperInterval)
+	}
+
+	// convert CCLIP_MAX_CLIPS to integer
+	maxClips, err := strconv.ParseInt(envMaxClips, 10, 64)
+	if err != nil {
+		log.Fatalln("Invalid value for maximum number of clips", envMaxClips, err.Error())
+	}
+
+	// convert CCLIP_MAX_TOTAL_SIZE to integer
+	maxTotalSize, err := strconv.ParseInt(envMaxTotalSize, 10, 64)
+	if err != nil {
+		log.Fatalln("Invalid value for maximum total size of clips", envMaxTotalSize, err.Error())
+	}
+
+	// convert CCLIP_MAX_USER_CLIPS to integer
+	maxUserClips, err := strconv.ParseInt(envMaxUserClips, 10, 64)
+	if err != nil {
+		log.Fatalln("Invalid value for maximum number of clips of each user", envMaxUserClips, err.Error())
+	}
+
+	// convert CCLIP_MAX_USER_TOTAL_SIZE to integer
+	maxUserTotalSize, err := strconv.ParseInt(envMaxUserTotalSize, 10, 64)
+	if err != nil {
+		log.Fatalln("Invalid value for maximum total size of the clips of each user", envMaxUserTotalSize, err.Error())
+	}
+
+	// convert CCLIP_MAX_VERSIONS to integer
+	maxVersions, err := strconv.ParseInt(envMaxVersions, 10, 64)
+	if err != nil || maxVersions < 0 {
+		log.Fatalln("Invalid value for maximum number of clip versions", envMaxVersions)
+	}
+
+	// convert CCLIP_RESCAN_INTERVAL to integer
+	rescanInterval, err := strconv.ParseInt(envRescanInterval, 10, 64)
+	if err != nil || rescanInterval < 1 {
+		log.Fatalln("Invalid value for rescan interval", envRescanInterval)
+	}
+
+	switch envStorage {
+	case "memory":
+		ClipStorage = NewMemoryStorage()
+
+		log.Println("[WARN] Clips are stored in memory only and will be lost on shutdown")
+	case "s3":
+		s3Storage, err := NewS3StorageFromEnv()
 		if err != nil {
-			log.Fatalln("Creating", envDir, "directory failed")
+			log.Fatalln("Invalid S3 storage settings", err.Error())
+		}
+
+		ClipStorage = s3Storage
+
+		log.Println("Use S3 bucket", s3Storage.Bucket, "at", s3Storage.Endpoint.String())
+	default:
+		// create output directory, if needed
+		clipDirStat, err := os.Stat(envDir)
+		if os.IsNotExist(err) {
+			err := os.MkdirAll(envDir, 0755)
+			if err != nil {
+				log.Fatalln("Creating", envDir, "directory failed")
+			}
+		} else if !clipDirStat.IsDir() {
+			log.Fatalln(envDir, "is no directory")
 		}
-	} else if !clipDirStat.IsDir() {
-		log.Fatalln(envDir, "is no directory")
-	}
 
-	ClipDirectory = envDir // set clip directory
-	log.Println("Use clip directory", ClipDirectory)
+		ClipDirectory = envDir // set clip directory
+		ClipStorage = NewFileStorage(ClipDirectory)
+
+		log.Println("Use clip directory", ClipDirectory)
+	}
 
 	if maxSize > 0 {
 		MaxClipSize = maxSize
@@ -448,24 +1095,258 @@ func RunServer(c *cli.Context) error {
 		log.Println("[WARN] You have no maximum clip size defined")
 	}
 
-	Password = strings.TrimSpace(os.Getenv("CCLIP_PASSWORD"))
+	if maxClips > 0 {
+		MaxClips = maxClips
 
-	router := mux.NewRouter()
+		log.Println("Keeping a maximum of", MaxClips, "clips ...")
+	}
 
-	if Password != "" {
-		router.Use(checkPassword)
-	} else {
-		log.Println("[WARN] You have no password defined! Use CCLIP_PASSWORD to set one")
+	if maxTotalSize > 0 {
+		MaxTotalSize = maxTotalSize
+
+		log.Println("Using maximum total size of", MaxTotalSize, "bytes ...")
 	}
 
-	// initialize routes
-	AddHTTPAction(router, "", getServerInfo, "GET")
-	AddHTTPAction(router, "/clips", deleteAllClips, "DELETE")
-	AddHTTPAction(router, "/clips", getClips, "GET")
-	AddHTTPAction(router, "/clips", getClipsHead, "HEAD")
-	AddHTTPAction(router, "/clips", uploadClip, "POST")
-	AddHTTPAction(router, "/clips/{id:[0-9a-f]{32}}", getClipData, "GET")
-	AddHTTPAction(router, "/clips/{id:[0-9a-f]{32}}", deleteClip, "DELETE")
+	if maxUserClips > 0 {
+		MaxUserClips = maxUserClips
+
+		log.Println("Keeping a maximum of", MaxUserClips, "clips of each user ...")
+	}
+
+	if maxUserTotalSize > 0 {
+		MaxUserTotalSize = maxUserTotalSize
+
+		log.Println("Using maximum total size of", MaxUserTotalSize, "bytes for the clips of each user ...")
+	}
+
+	MaxClipVersions = maxVersions
+	if MaxClipVersions > 0 {
+		log.Println("Keeping a maximum of", MaxClipVersions, "old version(s) per clip ...")
+	}
+
+	if defaultTTL > 0 {
+		DefaultClipTTL = defaultTTL
+
+		log.Println("Using default clip TTL of", DefaultClipTTL, "seconds ...")
+	}
+
+	DedupMode = envDedup
+	if DedupMode != "off" {
+		log.Println("Using deduplication mode", DedupMode, "...")
+	}
+	if _, ok := ClipStorage.(StorageLinker); DedupMode == "link" && !ok {
+		log.Fatalln("Deduplication mode link is not supported by storage backend", envStorage)
+	}
+
+	// without keys, encrypted files are still recognized, and not deleted as broken ones
+	if encryptionKey != nil || len(oldEncryptionKeys) > 0 || envStorage == "fs" {
+		ClipStorage = NewEncryptedStorage(ClipStorage, encryptionKey, oldEncryptionKeys)
+		GetEncryptedStorage(ClipStorage).AllowUnencrypted = allowUnencrypted
+	}
+	if encryptionKey != nil {
+		log.Println("Encrypting clips with key", encryptionKey.ID(), "...")
+
+		if allowUnencrypted {
+			log.Println("[WARN] Unencrypted clips can still be read, until they are re-encrypted")
+		}
+	} else if len(oldEncryptionKeys) > 0 {
+		log.Println("[WARN] New clips are not encrypted, because CCLIP_ENCRYPTION_KEY is not set")
+	}
+
+	ClipLayout = envLayout
+	if ClipLayout != "flat" {
+		log.Println("Storing new clips in", ClipLayout, "layout ...")
+	}
+
+	CompressionCodec = envCompression
+	if CompressionCodec != "off" {
+		log.Println("Compressing clips with", CompressionCodec, "...")
+	}
+
+	metaDatabaseFile := path.Join(ClipDirectory, MetaDatabaseFileName)
+	if envMetaStore == "sqlite" {
+		metaDatabase, err := OpenSQLiteMetaStore(metaDatabaseFile)
+		if err != nil {
+			log.Fatalln("Opening meta data database failed", err.Error())
+		}
+
+		ClipMetaStore = metaDatabase
+
+		log.Println("Use meta data database", metaDatabaseFile)
+
+		// clips, which have been stored without database
+		imported, err := ImportMetaFiles(metaDatabase)
+		if err != nil {
+			log.Fatalln("Importing .meta files failed", err.Error())
+		}
+		if imported > 0 {
+			log.Println("Imported meta data of", imported, "clip(s) into database")
+		}
+	} else if _, err := os.Stat(metaDatabaseFile); err == nil && ClipDirectory != "" {
+		log.Println("[WARN] Meta data database", metaDatabaseFile, "is not used, run 'cclip meta export' to move its meta data into .meta files")
+	}
+
+	err = RecoverPendingClips()
+	if err != nil {
+		log.Fatalln("Recovering interrupted uploads and deletions failed", err.Error())
+	}
+
+	_, err = RecoverClipLayouts()
+	if err != nil {
+		log.Fatalln("Recovering interrupted layout migrations failed", err.Error())
+	}
+
+	// left by a crash, s. LockClip()
+	_, err = RemoveClipMarkers(".writing")
+	if err != nil {
+		log.Fatalln("Removing markers of changed clips failed", err.Error())
+	}
+
+	err = RecoverBurnedClips()
+	if err != nil {
+		log.Fatalln("Recovering burn-after-read clips failed", err.Error())
+	}
+
+	err = RecoverOrphanedClips()
+	if err != nil {
+		log.Fatalln("Recovering orphaned clips failed", err.Error())
+	}
+
+	err = MigrateClipTimes()
+	if err != nil {
+		log.Fatalln("Migrating clip timestamps failed", err.Error())
+	}
+
+	err = ReleaseUnusedBlobs()
+	if err != nil {
+		log.Fatalln("Releasing unused blobs failed", err.Error())
+	}
+
+	err = ClipIndex.Load()
+	if err != nil {
+		log.Fatalln("Loading clip index failed", err.Error())
+	}
+
+	StartClipIndexRescan(time.Duration(rescanInterval) * time.Second)
+
+	err = LoadSearchIndex()
+	if err != nil {
+		log.Fatalln("Loading search index failed", err.Error())
+	}
+
+	StartExpiryReaper(time.Duration(reaperInterval) * time.Second)
+
+	// CCLIP_PASSWORD, CCLIP_PASSWORD_HASH or CCLIP_PASSWORD_FILE
+	Password, PasswordHash, err = LoadPasswordFromEnv()
+	if err != nil {
+		log.Fatalln("Loading password failed", err.Error())
+	}
+	if PasswordHash != "" {
+		log.Println("Use password hash")
+	}
+
+	// CCLIP_LOCKOUT_THRESHOLD
+	envLockoutThreshold := strings.TrimSpace(os.Getenv("CCLIP_LOCKOUT_THRESHOLD"))
+	if envLockoutThreshold != "" {
+		lockoutThreshold, err := strconv.Atoi(envLockoutThreshold)
+		if err != nil || lockoutThreshold < 0 {
+			log.Fatalln("Invalid value for lockout threshold", envLockoutThreshold)
+		}
+
+		LockoutThreshold = lockoutThreshold
+	}
+
+	// CCLIP_LOCKOUT_DURATION
+	envLockoutDuration := strings.TrimSpace(os.Getenv("CCLIP_LOCKOUT_DURATION"))
+	if envLockoutDuration != "" {
+		lockoutDuration, err := strconv.ParseInt(envLockoutDuration, 10, 64)
+		if err != nil || lockoutDuration < 1 {
+			log.Fatalln("Invalid value for lockout duration", envLockoutDuration)
+		}
+
+		LockoutDuration = time.Duration(lockoutDuration) * time.Second
+	}
+
+	if LockoutThreshold > 0 {
+		log.Println("Ban clients for", LockoutDuration, "after", LockoutThreshold, "failed authentications")
+	}
+
+	// CCLIP_TRUSTED_PROXIES
+	TrustedProxies, err = ParseTrustedProxies(os.Getenv("CCLIP_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalln("Invalid value for trusted proxies", err.Error())
+	}
+	if len(TrustedProxies) > 0 {
+		log.Println("Trust X-Forwarded-For of", len(TrustedProxies), "proxy network(s)")
+	}
+
+	// CCLIP_RATE_LIMIT
+	envRateLimit := strings.TrimSpace(os.Getenv("CCLIP_RATE_LIMIT"))
+	if envRateLimit != "" {
+		rateLimit, err := strconv.ParseInt(envRateLimit, 10, 64)
+		if err != nil || rateLimit < 0 {
+			log.Fatalln("Invalid value for rate limit", envRateLimit)
+		}
+
+		RequestRate = rateLimit
+	}
+	if RequestRate > 0 {
+		log.Println("Limit clients to", RequestRate, "request(s) per minute")
+	}
+
+	// CCLIP_UPLOAD_QUOTA
+	envUploadQuota := strings.TrimSpace(os.Getenv("CCLIP_UPLOAD_QUOTA"))
+	if envUploadQuota != "" {
+		uploadQuota, err := strconv.ParseInt(envUploadQuota, 10, 64)
+		if err != nil || uploadQuota < 0 {
+			log.Fatalln("Invalid value for upload quota", envUploadQuota)
+		}
+
+		UploadQuota = uploadQuota
+	}
+	if UploadQuota > 0 {
+		log.Println("Limit uploads of clients to", UploadQuota, "bytes per day")
+	}
+
+	// CCLIP_DOWNLOAD_RATE
+	envDownloadRate := strings.TrimSpace(os.Getenv("CCLIP_DOWNLOAD_RATE"))
+	if envDownloadRate != "" {
+		downloadRate, err := strconv.ParseInt(envDownloadRate, 10, 64)
+		if err != nil || downloadRate < 0 {
+			log.Fatalln("Invalid value for download rate", envDownloadRate)
+		}
+
+		DownloadRate = downloadRate
+	}
+	if DownloadRate > 0 {
+		log.Println("Limit downloads of clients to", DownloadRate, "bytes per second")
+	}
+
+	// CCLIP_USERS_FILE
+	UsersFile = GetUsersFileFromEnv()
+
+	users, err := ReadUsers()
+	if err != nil {
+		log.Fatalln("Reading users file failed", err.Error())
+	}
+	if _, err := os.Stat(UsersFile); err == nil {
+		log.Println("Use", len(users), "user(s) of", UsersFile)
+	} else if Password == "" && PasswordHash == "" {
+		log.Println("[WARN] You have no password defined! Use CCLIP_PASSWORD_HASH to set one, or add users with 'cclip user add'")
+	}
+
+	// CCLIP_TOKENS_FILE
+	TokensFile = GetTokensFileFromEnv()
+
+	tokens, err := ReadAPITokens()
+	if err != nil {
+		log.Fatalln("Reading tokens file failed", err.Error())
+	}
+	if len(tokens) > 0 {
+		log.Println("Use", len(tokens), "API token(s) of", TokensFile)
+	}
+
+	router := NewRouter()
 
 	log.Println("Server will run on port", port, "...")
 
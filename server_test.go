@@ -0,0 +1,359 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testServer - A server with an empty clip directory, s. newTestServer()
+type testServer struct {
+	*httptest.Server
+	t *testing.T
+}
+
+// newTestServer - Resets the settings of the server and starts it with an empty clip
+// directory in the file system, which is removed after the test
+func newTestServer(t *testing.T) *testServer {
+	resetTestSettings(t)
+
+	if err := ClipIndex.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testServer{Server: httptest.NewServer(NewRouter()), t: t}
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// resetTestSettings - Sets all settings of the environment to their defaults,
+// with an empty clip directory in the file system
+func resetTestSettings(t *testing.T) {
+	ClipDirectory = t.TempDir()
+	ClipStorage = NewFileStorage(ClipDirectory)
+	ClipMetaStore = &FileMetaStore{}
+	ClipLayout = "flat"
+	CompressionCodec = "off"
+	DedupMode = "off"
+	DefaultClipTTL = 0
+	MaxClipSize = 0
+	MaxClipVersions = 10
+	MaxClips = 0
+	MaxTotalSize = 0
+	MaxUserClips = 0
+	MaxUserTotalSize = 0
+
+	Password = ""
+	PasswordHash = ""
+	UsersFile = path.Join(t.TempDir(), UsersFileName)
+	TokensFile = path.Join(t.TempDir(), TokensFileName)
+
+	LockoutThreshold = 5
+	TrustedProxies = nil
+	serverLockout.lock.Lock()
+	serverLockout.clients = map[string]*authFailures{}
+	serverLockout.lock.Unlock()
+
+	DownloadRate = 0
+	RequestRate = 0
+	UploadQuota = 0
+	serverRateLimits.lock.Lock()
+	serverRateLimits.clients = map[string]*clientLimits{}
+	serverRateLimits.lock.Unlock()
+}
+
+// addTestUser - Adds a user with a role to UsersFile, and returns the value of
+// the Authorization header of its requests
+func addTestUser(t *testing.T, name string, role string) string {
+	// fast, unlike HashPassword()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := ReadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = WriteUsers(append(users, User{Name: name, PasswordHash: string(hash), Role: role}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(name+":secret"))
+}
+
+// do - Sends a request to the API, with headers as pairs of names and values
+func (s *testServer) do(method string, p string, body string, headers ...string) (*http.Response, string) {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, s.URL+"/api/v1"+p, reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	return resp, string(data)
+}
+
+// upload - Uploads a new clip and returns it
+func (s *testServer) upload(body string, headers ...string) uploadFileResponse {
+	resp, data := s.do("POST", "/clips", body, headers...)
+	if resp.StatusCode != 201 {
+		s.t.Fatalf("upload failed: %d %s", resp.StatusCode, data)
+	}
+
+	var clip uploadFileResponse
+	if err := json.Unmarshal([]byte(data), &clip); err != nil {
+		s.t.Fatal(err)
+	}
+
+	return clip
+}
+
+// expectStatus - Sends a request and checks the status code of the response
+func (s *testServer) expectStatus(status int, method string, p string, body string, headers ...string) string {
+	s.t.Helper()
+
+	resp, data := s.do(method, p, body, headers...)
+	if resp.StatusCode != status {
+		s.t.Fatalf("%s %s returned %d %q, expected %d", method, p, resp.StatusCode, data, status)
+	}
+
+	return data
+}
+
+func TestPatchClip(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("data", "X-Cclip-Name", "old", "Content-Type", "text/plain")
+
+	var patched clipItem
+	json.Unmarshal([]byte(server.expectStatus(200, "PATCH", "/clips/"+clip.ID, `{"name":" new ","expires":4102444800}`)), &patched)
+	if patched.Name != "new" || patched.MIME != "text/plain" || patched.ExpiresAt != 4102444800 || patched.Burn {
+		t.Errorf("unexpected clip %+v", patched)
+	}
+
+	json.Unmarshal([]byte(server.expectStatus(200, "PATCH", "/clips/"+clip.ID, `{"mime":"Text/Markdown","burn":true}`)), &patched)
+	if patched.Name != "new" || patched.MIME != "text/markdown" || patched.ExpiresAt != 4102444800 || !patched.Burn {
+		t.Errorf("unexpected clip %+v", patched)
+	}
+	if patched.CreationTime != clip.CreationTime || patched.UploadTime != clip.UploadTime || patched.ModificationTime < clip.ModificationTime {
+		t.Errorf("unexpected times %+v of %+v", patched, clip)
+	}
+
+	server.expectStatus(400, "PATCH", "/clips/"+clip.ID, `{"name":`)
+	server.expectStatus(400, "PATCH", "/clips/"+clip.ID, `{"expires":-1}`)
+
+	// the data is not changed
+	resp, data := server.do("GET", "/clips/"+clip.ID, "")
+	if data != "data" || resp.Header.Get("Content-Type") != "text/markdown" {
+		t.Errorf("unexpected data %q of type %s", data, resp.Header.Get("Content-Type"))
+	}
+
+	server.expectStatus(404, "PATCH", "/clips/0123456789abcdef0123456789abcdef", `{"name":"x"}`)
+}
+
+func TestClipRanges(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("0123456789", "Content-Type", "text/plain")
+
+	resp, data := server.do("GET", "/clips/"+clip.ID, "", "Range", "bytes=2-4")
+	if resp.StatusCode != 206 || data != "234" || resp.Header.Get("Content-Range") != "bytes 2-4/10" {
+		t.Errorf("range returned %d %q %s", resp.StatusCode, data, resp.Header.Get("Content-Range"))
+	}
+
+	resp, data = server.do("GET", "/clips/"+clip.ID, "", "Range", "bytes=-3")
+	if resp.StatusCode != 206 || data != "789" {
+		t.Errorf("suffix range returned %d %q", resp.StatusCode, data)
+	}
+
+	server.expectStatus(416, "GET", "/clips/"+clip.ID, "", "Range", "bytes=20-30")
+
+	resp, data = server.do("HEAD", "/clips/"+clip.ID, "")
+	if resp.StatusCode != 200 || data != "" || resp.ContentLength != 10 || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("HEAD returned %d %q with length %d", resp.StatusCode, data, resp.ContentLength)
+	}
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+
+	server.expectStatus(304, "GET", "/clips/"+clip.ID, "", "If-None-Match", etag)
+	server.expectStatus(304, "GET", "/clips/"+clip.ID, "", "If-Modified-Since", lastModified)
+	server.expectStatus(412, "GET", "/clips/"+clip.ID, "", "If-Match", `"other"`)
+
+	// a range of changed data is not sent
+	server.expectStatus(200, "PUT", "/clips/"+clip.ID, "abcdefghij", "Content-Type", "text/plain")
+
+	resp, data = server.do("GET", "/clips/"+clip.ID, "", "Range", "bytes=0-1", "If-Range", etag)
+	if resp.StatusCode != 200 || data != "abcdefghij" {
+		t.Errorf("If-Range with old entity tag returned %d %q", resp.StatusCode, data)
+	}
+	if resp.Header.Get("ETag") == etag {
+		t.Error("entity tag has not been changed")
+	}
+}
+
+func TestUserNamespaces(t *testing.T) {
+	server := newTestServer(t)
+
+	alice := addTestUser(t, "alice", "user")
+	bob := addTestUser(t, "bob", "user")
+	admin := addTestUser(t, "admin", "admin")
+
+	clip := server.upload("v1", "Authorization", alice, "Content-Type", "text/plain", "X-Cclip-Name", "notes")
+	server.expectStatus(200, "PUT", "/clips/"+clip.ID, "v2", "Authorization", alice, "Content-Type", "text/plain")
+
+	var share shareItem
+	json.Unmarshal([]byte(server.expectStatus(201, "POST", "/clips/"+clip.ID+"/shares", "", "Authorization", alice)), &share)
+
+	other := server.upload("other notes", "Authorization", bob, "Content-Type", "text/plain")
+
+	listIDs := func(auth string) []string {
+		var items []clipItem
+		json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips", "", "Authorization", auth)), &items)
+
+		ids := []string{}
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		sort.Strings(ids)
+
+		return ids
+	}
+	searchIDs := func(auth string) []string {
+		var items []searchResultItem
+		json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/search?q=notes", "", "Authorization", auth)), &items)
+
+		ids := []string{}
+		for _, item := range items {
+			ids = append(ids, item.Clip.ID)
+		}
+		sort.Strings(ids)
+
+		return ids
+	}
+
+	// the clips of other users do not exist for a user
+	for _, r := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/clips/" + clip.ID, ""},
+		{"HEAD", "/clips/" + clip.ID, ""},
+		{"PUT", "/clips/" + clip.ID, "replaced"},
+		{"PATCH", "/clips/" + clip.ID, `{"name":"renamed"}`},
+		{"GET", "/clips/" + clip.ID + "/versions", ""},
+		{"GET", "/clips/" + clip.ID + "/versions/1", ""},
+		{"POST", "/clips/" + clip.ID + "/versions/1/restore", ""},
+		{"GET", "/clips/" + clip.ID + "/shares", ""},
+		{"POST", "/clips/" + clip.ID + "/shares", ""},
+		{"DELETE", "/clips/" + clip.ID + "/shares/" + share.Token, ""},
+		{"DELETE", "/clips/" + clip.ID, ""},
+	} {
+		server.expectStatus(404, r.method, r.path, r.body, "Authorization", bob)
+	}
+
+	if ids := listIDs(bob); !reflect.DeepEqual(ids, []string{other.ID}) {
+		t.Errorf("bob lists %v", ids)
+	}
+	if ids := searchIDs(bob); !reflect.DeepEqual(ids, []string{other.ID}) {
+		t.Errorf("bob finds %v", ids)
+	}
+
+	// deletes the own clips only
+	server.expectStatus(204, "DELETE", "/clips", "", "Authorization", bob)
+	if ids := listIDs(bob); len(ids) != 0 {
+		t.Errorf("bob lists %v after deleting all clips", ids)
+	}
+
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID, "", "Authorization", alice); data != "v2" {
+		t.Errorf("clip contains %q", data)
+	}
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions/1", "", "Authorization", alice); data != "v1" {
+		t.Errorf("version contains %q", data)
+	}
+	server.expectStatus(200, "GET", "/shares/"+share.Token, "")
+
+	// admins see all namespaces
+	other = server.upload("other notes", "Authorization", bob, "Content-Type", "text/plain")
+	expected := []string{clip.ID, other.ID}
+	sort.Strings(expected)
+
+	if ids := listIDs(admin); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("admin lists %v, expected %v", ids, expected)
+	}
+	if ids := searchIDs(admin); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("admin finds %v, expected %v", ids, expected)
+	}
+	server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions/1", "", "Authorization", admin)
+	server.expectStatus(204, "DELETE", "/clips/"+other.ID, "", "Authorization", admin)
+}
+
+func TestUserAuthentication(t *testing.T) {
+	server := newTestServer(t)
+	// s. TestLockout()
+	LockoutThreshold = 0
+
+	alice := addTestUser(t, "alice", "user")
+	server.expectStatus(200, "GET", "/clips", "", "Authorization", alice)
+
+	wrongPassword := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong"))
+	unknownUser := "Basic " + base64.StdEncoding.EncodeToString([]byte("mallory:secret"))
+	for _, auth := range []string{wrongPassword, unknownUser, "Bearer secret", ""} {
+		server.expectStatus(401, "GET", "/clips", "", "Authorization", auth)
+		server.expectStatus(401, "POST", "/clips", "data", "Authorization", auth)
+	}
+	if ClipIndex.Count() != 0 {
+		t.Errorf("%d clips have been uploaded", ClipIndex.Count())
+	}
+}
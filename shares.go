@@ -0,0 +1,389 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ClipShare - A share of a clip, which can be accessed without password
+type ClipShare struct {
+	Token        string `json:"token"`
+	CreationTime int64  `json:"ctime"`
+	ExpiresAt    int64  `json:"expires,omitempty"`
+	MaxDownloads int64  `json:"max_downloads,omitempty"`
+	Downloads    int64  `json:"downloads"`
+}
+
+// IsAvailable - Checks if share can (still) be used for a download
+func (s ClipShare) IsAvailable(now time.Time) bool {
+	if s.ExpiresAt > 0 && now.Unix() >= s.ExpiresAt {
+		return false
+	}
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		return false
+	}
+
+	return true
+}
+
+type createShareRequest struct {
+	ExpiresAt    int64 `json:"expires"`
+	TTL          int64 `json:"ttl"`
+	MaxDownloads int64 `json:"max_downloads"`
+}
+
+type shareItem struct {
+	Token        string `json:"token"`
+	CreationTime int64  `json:"ctime"`
+	ExpiresAt    int64  `json:"expires,omitempty"`
+	MaxDownloads int64  `json:"max_downloads,omitempty"`
+	Downloads    int64  `json:"downloads"`
+	Available    bool   `json:"available"`
+	Link         string `json:"link"`
+}
+
+// ErrShareNotFound - Is returned, if a share token is unknown
+var ErrShareNotFound = errors.New("Share not found")
+
+// ReadShares - Reads the shares of a clip
+func (c ClipFile) ReadShares() ([]ClipShare, error) {
+	shares := make([]ClipShare, 0)
+
+	bytes, err := ReadObject(c.SharesFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return shares, nil
+		}
+
+		return shares, err
+	}
+
+	err = json.Unmarshal(bytes, &shares)
+	return shares, err
+}
+
+// SharesFile - Returns the key of the object, which stores the shares of the clip
+func (c ClipFile) SharesFile() string {
+	return c.file + ".shares"
+}
+
+// WriteShares - Writes the shares of a clip
+func (c ClipFile) WriteShares(shares []ClipShare) error {
+	var err error
+	if len(shares) == 0 {
+		err = DeleteObjects(c.SharesFile())
+	} else {
+		var bytes []byte
+		bytes, err = json.Marshal(shares)
+		if err == nil {
+			err = WriteObject(c.SharesFile(), bytes)
+		}
+	}
+
+	if err == nil {
+		err = ClipIndex.Refresh(c.id)
+	}
+
+	return err
+}
+
+// FindShare - Searches all clips for a share token
+func FindShare(token string) (ClipFile, ClipShare, error) {
+	id, ok := ClipIndex.FindShare(token)
+	if !ok {
+		return ClipFile{}, ClipShare{}, ErrShareNotFound
+	}
+
+	clip, err := GetActiveClipByID(id)
+	if err != nil {
+		return ClipFile{}, ClipShare{}, ErrShareNotFound
+	}
+
+	shares, err := clip.ReadShares()
+	if err != nil {
+		return ClipFile{}, ClipShare{}, err
+	}
+
+	for _, s := range shares {
+		if s.Token == token {
+			return clip, s, nil
+		}
+	}
+
+	return ClipFile{}, ClipShare{}, ErrShareNotFound
+}
+
+func newShareItem(s ClipShare, now time.Time) shareItem {
+	var item shareItem
+	item.Token = s.Token
+	item.CreationTime = s.CreationTime
+	item.ExpiresAt = s.ExpiresAt
+	item.MaxDownloads = s.MaxDownloads
+	item.Downloads = s.Downloads
+	item.Available = s.IsAvailable(now)
+	item.Link = "/api/v1/shares/" + url.PathEscape(s.Token)
+
+	return item
+}
+
+func newShareToken() (string, error) {
+	buffer := make([]byte, 32)
+
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buffer), nil
+}
+
+func createShare(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	clip, err := GetActiveUserClip(req, vars["id"])
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	var options createShareRequest
+	if req.ContentLength != 0 {
+		err = json.NewDecoder(req.Body).Decode(&options)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	if options.ExpiresAt < 0 || options.TTL < 0 || options.MaxDownloads < 0 {
+		http.Error(w, "Negative share options are not allowed", 400)
+		return
+	}
+
+	now := time.Now()
+
+	token, err := newShareToken()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	var share ClipShare
+	share.Token = token
+	share.CreationTime = now.Unix()
+	share.ExpiresAt = options.ExpiresAt
+	share.MaxDownloads = options.MaxDownloads
+	if options.TTL > 0 {
+		share.ExpiresAt = now.Unix() + options.TTL
+	}
+
+	unlock := LockClip(clip.id)
+	defer unlock()
+
+	clip.refreshKey()
+
+	shares, err := clip.ReadShares()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	err = clip.WriteShares(append(shares, share))
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(newShareItem(share, now))
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	w.WriteHeader(201)
+	w.Write(bytes)
+}
+
+func deleteShare(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	unlock := LockClip(vars["id"])
+	defer unlock()
+
+	clip, err := GetActiveUserClip(req, vars["id"])
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	shares, err := clip.ReadShares()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	remainingShares := make([]ClipShare, 0)
+	for _, s := range shares {
+		if s.Token != vars["token"] {
+			remainingShares = append(remainingShares, s)
+		}
+	}
+
+	if len(remainingShares) == len(shares) {
+		w.WriteHeader(404)
+		return
+	}
+
+	err = clip.WriteShares(remainingShares)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(204)
+}
+
+func getShareData(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	clip, share, err := FindShare(vars["token"])
+	if err != nil {
+		if err == ErrShareNotFound {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	// count download, before sending any data, so the maximum is never exceeded
+	available, err := countShareDownload(clip, share.Token, 1)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+	if !available {
+		w.WriteHeader(410)
+		return
+	}
+
+	counter := &countingResponseWriter{ResponseWriter: w}
+	SendClipData(counter, req, clip)
+
+	// nothing has been downloaded, like for conditional requests
+	if counter.status != 200 && counter.status != 206 {
+		_, err = countShareDownload(clip, share.Token, -1)
+		if err != nil {
+			log.Println("[WARN] Could not uncount download of share of clip", clip.id, err.Error())
+		}
+	}
+}
+
+// countShareDownload - Increments the download counter of a share, if it is still available,
+// or decrements it with a negative delta
+func countShareDownload(clip ClipFile, token string, delta int64) (bool, error) {
+	unlock := LockClip(clip.id)
+	defer unlock()
+
+	clip.refreshKey()
+
+	shares, err := clip.ReadShares()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	for i := range shares {
+		if shares[i].Token != token {
+			continue
+		}
+
+		if delta > 0 && !shares[i].IsAvailable(now) {
+			return false, nil
+		}
+
+		shares[i].Downloads += delta
+		return true, clip.WriteShares(shares)
+	}
+
+	// revoked in the meantime
+	return false, nil
+}
+
+func getShares(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	clip, err := GetActiveUserClip(req, vars["id"])
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	shares, err := clip.ReadShares()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	now := time.Now()
+
+	items := make([]shareItem, 0)
+	for _, s := range shares {
+		items = append(items, newShareItem(s, now))
+	}
+
+	bytes, err := json.Marshal(items)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	w.Write(bytes)
+}
@@ -0,0 +1,63 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestShareDownloadLimit(t *testing.T) {
+	server := newTestServer(t)
+	clip := server.upload("shared")
+	if clip.SharesLink != "/api/v1/clips/"+clip.ID+"/shares" {
+		t.Errorf("unexpected link %s to the shares", clip.SharesLink)
+	}
+
+	var share shareItem
+	data := server.expectStatus(201, "POST", "/clips/"+clip.ID+"/shares", `{"max_downloads":2}`)
+	json.Unmarshal([]byte(data), &share)
+
+	resp, data := server.do("GET", "/shares/"+share.Token, "")
+	if resp.StatusCode != 200 || data != "shared" {
+		t.Fatalf("download returned %d %q", resp.StatusCode, data)
+	}
+
+	// conditional requests do not download anything
+	etag := resp.Header.Get("ETag")
+	for i := 0; i < 3; i++ {
+		server.expectStatus(304, "GET", "/shares/"+share.Token, "", "If-None-Match", etag)
+	}
+
+	server.expectStatus(206, "GET", "/shares/"+share.Token, "", "Range", "bytes=0-1")
+	server.expectStatus(410, "GET", "/shares/"+share.Token, "")
+
+	var shares []shareItem
+	json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/"+clip.ID+"/shares", "")), &shares)
+	if len(shares) != 1 || shares[0].Downloads != 2 || shares[0].Available {
+		t.Errorf("unexpected shares %+v", shares)
+	}
+}
+
+func TestSharesOfMissingClip(t *testing.T) {
+	server := newTestServer(t)
+
+	id := "0123456789abcdef0123456789abcdef"
+	server.expectStatus(404, "GET", "/clips/"+id+"/shares", "")
+	server.expectStatus(404, "POST", "/clips/"+id+"/shares", "")
+	server.expectStatus(404, "DELETE", "/clips/"+id+"/shares/"+id+id, "")
+}
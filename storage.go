@@ -0,0 +1,124 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Storage - A backend, which stores all objects of the clips, like their data,
+// meta data, shares and old versions
+//
+// Keys are slash separated paths, like "<id>", "<id>.meta", "<id>.versions/1"
+// or "ab/cd/<id>" in the sharded layout, s. ClipLayout, and "users/<name>/<id>"
+// for the clips of a user, s. GetUserPrefix().
+// All methods return an error, which satisfies os.IsNotExist(), if an object does not exist.
+type Storage interface {
+	// Delete - Deletes an object
+	Delete(key string) error
+	// Get - Opens an object for reading
+	Get(key string) (StorageObject, error)
+	// List - Returns all objects, whose keys start with a prefix,
+	// but not the ones below a further slash
+	List(prefix string) ([]StorageInfo, error)
+	// ListDirectories - Returns the keys of all directories directly below a prefix,
+	// which contain objects, with a trailing slash, like "ab/"
+	ListDirectories(prefix string) ([]string, error)
+	// Put - Creates or replaces an object atomically
+	Put(key string, data io.Reader) error
+	// PutFile - Moves a local (temporary) file into an object
+	PutFile(key string, file string) error
+	// Rename - Renames an object, replacing the destination
+	Rename(src string, dest string) error
+	// Stat - Returns information about an object
+	Stat(key string) (StorageInfo, error)
+}
+
+// StorageLinker - A storage, which can share the data of an object
+// between several keys, s. DedupMode
+type StorageLinker interface {
+	// Link - Creates a new key, which shares the data of an existing object
+	Link(src string, dest string) error
+}
+
+// StorageInfo - Information about an object of a storage
+type StorageInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// the number of keys, which share the data of the object, 0 if unknown
+	Links int
+}
+
+// StorageObject - An opened object of a storage
+type StorageObject interface {
+	io.ReadSeeker
+	io.Closer
+
+	// Info - Returns information about the opened object
+	Info() StorageInfo
+}
+
+// ClipStorage - The storage of all clips
+var ClipStorage Storage
+
+// CopyObject - Copies an object into a new object with the same data
+func CopyObject(src string, dest string) error {
+	obj, err := ClipStorage.Get(src)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	return ClipStorage.Put(dest, obj)
+}
+
+// DeleteObjects - Deletes objects and ignores the ones, which do not exist
+func DeleteObjects(keys ...string) error {
+	for _, k := range keys {
+		err := ClipStorage.Delete(k)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadObject - Reads the whole data of an object, like meta data
+func ReadObject(key string) ([]byte, error) {
+	obj, err := ClipStorage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return ioutil.ReadAll(obj)
+}
+
+// WriteObject - Creates or replaces an object with data, like meta data
+func WriteObject(key string, data []byte) error {
+	return ClipStorage.Put(key, bytes.NewReader(data))
+}
+
+func notExistError(op string, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+}
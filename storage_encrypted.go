@@ -0,0 +1,343 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EncryptedStorage - A storage, which encrypts all objects of another storage, s. encryption.go
+//
+// Objects, which are not encrypted, like the ones, which have been stored before encryption
+// has been enabled, can only be read without a current key or with AllowUnencrypted, so
+// replaced objects cannot be smuggled in. Without a current key, new objects are stored unencrypted.
+type EncryptedStorage struct {
+	Storage    Storage
+	CurrentKey *EncryptionKey
+	// all keys, which can be used for decryption, including CurrentKey
+	Keys []*EncryptionKey
+	// read unencrypted objects also with a current key, until they are re-encrypted
+	AllowUnencrypted bool
+
+	// decrypted sizes of objects
+	sizeCache     map[string]encryptedStorageSize
+	sizeCacheLock sync.Mutex
+}
+
+// encryptedLinkingStorage - An EncryptedStorage for a storage, which can link objects
+type encryptedLinkingStorage struct {
+	*EncryptedStorage
+}
+
+type encryptedStorageObject struct {
+	io.ReadSeeker
+	src  StorageObject
+	info StorageInfo
+}
+
+type encryptedStorageSize struct {
+	modTime       time.Time
+	size          int64
+	decryptedSize int64
+}
+
+// NewEncryptedStorage - Creates a new storage, which encrypts the objects of another storage
+// with a current key and decrypts them with all keys
+//
+// The new storage implements StorageLinker, if the other one does.
+func NewEncryptedStorage(storage Storage, currentKey *EncryptionKey, oldKeys []*EncryptionKey) Storage {
+	s := &EncryptedStorage{
+		Storage:    storage,
+		CurrentKey: currentKey,
+		Keys:       oldKeys,
+		sizeCache:  map[string]encryptedStorageSize{},
+	}
+	if currentKey != nil {
+		s.Keys = append([]*EncryptionKey{currentKey}, oldKeys...)
+	}
+
+	if _, ok := storage.(StorageLinker); ok {
+		return &encryptedLinkingStorage{EncryptedStorage: s}
+	}
+
+	return s
+}
+
+// GetEncryptedStorage - Returns the EncryptedStorage of a storage, which has been created
+// by NewEncryptedStorage(), or nil
+func GetEncryptedStorage(storage Storage) *EncryptedStorage {
+	switch s := storage.(type) {
+	case *EncryptedStorage:
+		return s
+	case *encryptedLinkingStorage:
+		return s.EncryptedStorage
+	}
+
+	return nil
+}
+
+// Delete - Deletes an object
+func (s *EncryptedStorage) Delete(key string) error {
+	s.forgetSize(key)
+
+	return s.Storage.Delete(key)
+}
+
+// Get - Opens an object and decrypts it, while it is read
+func (s *EncryptedStorage) Get(key string) (StorageObject, error) {
+	src, err := s.Storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := s.open(src)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	s.rememberSize(src.Info(), obj.info.Size)
+
+	return obj, nil
+}
+
+// KeyID - Returns the ID of the key, an object has been encrypted with,
+// or an empty string, if it is not encrypted
+func (s *EncryptedStorage) KeyID(key string) (string, error) {
+	src, err := s.Storage.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	header, err := readEncryptionHeader(src)
+	if err != nil || header == nil {
+		return "", err
+	}
+
+	return (&EncryptionKey{id: header[len(encryptionMagic)+1 : len(encryptionMagic)+9]}).ID(), nil
+}
+
+// List - Returns all objects, whose keys start with a prefix, with their decrypted sizes
+func (s *EncryptedStorage) List(prefix string) ([]StorageInfo, error) {
+	objects, err := s.Storage.List(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	for i, o := range objects {
+		info, err := s.decryptInfo(o)
+		if err != nil {
+			// temporary files may be written in the meantime,
+			// and wrong keys are reported, when the object is read
+			if !os.IsNotExist(err) && !IsEncryptionError(err) && !isTempFileName(path.Base(o.Key)) {
+				log.Println("[WARN] Could not read encrypted object", o.Key, err.Error())
+			}
+
+			continue
+		}
+
+		objects[i] = info
+	}
+
+	return objects, nil
+}
+
+// ListDirectories - Returns all directories directly below a prefix
+func (s *EncryptedStorage) ListDirectories(prefix string) ([]string, error) {
+	return s.Storage.ListDirectories(prefix)
+}
+
+// Put - Encrypts data and stores it as object
+func (s *EncryptedStorage) Put(key string, data io.Reader) error {
+	if s.CurrentKey == nil {
+		return s.Storage.Put(key, data)
+	}
+
+	r, w := io.Pipe()
+
+	go func() {
+		encrypter, err := newEncryptingWriter(w, s.CurrentKey)
+		if err == nil {
+			_, err = io.Copy(encrypter, data)
+			if closeErr := encrypter.Close(); err == nil {
+				err = closeErr
+			}
+		}
+
+		w.CloseWithError(err)
+	}()
+
+	err := s.Storage.Put(key, r)
+
+	// stop the encryption, if the storage failed
+	r.CloseWithError(io.ErrClosedPipe)
+
+	s.forgetSize(key)
+	return err
+}
+
+// PutFile - Encrypts a local file into a temporary file next to it and moves it into an object
+func (s *EncryptedStorage) PutFile(key string, file string) error {
+	if s.CurrentKey == nil {
+		return s.Storage.PutFile(key, file)
+	}
+
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// same device, s. ReceiveClipData()
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), ".upload-")
+	if err != nil {
+		return err
+	}
+
+	encrypter, err := newEncryptingWriter(tmpFile, s.CurrentKey)
+	if err == nil {
+		_, err = io.Copy(encrypter, src)
+		if closeErr := encrypter.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.Storage.PutFile(key, tmpFile.Name())
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	s.forgetSize(key)
+
+	// moved into the storage
+	src.Close()
+	return os.Remove(file)
+}
+
+// Rename - Renames an object
+func (s *EncryptedStorage) Rename(src string, dest string) error {
+	s.forgetSize(src)
+	s.forgetSize(dest)
+
+	return s.Storage.Rename(src, dest)
+}
+
+// Stat - Returns information about an object, with its decrypted size
+func (s *EncryptedStorage) Stat(key string) (StorageInfo, error) {
+	info, err := s.Storage.Stat(key)
+	if err != nil {
+		return info, err
+	}
+
+	return s.decryptInfo(info)
+}
+
+// Link - Creates a new key, which shares the encrypted data of an existing object
+func (s *encryptedLinkingStorage) Link(src string, dest string) error {
+	s.forgetSize(dest)
+
+	return s.Storage.(StorageLinker).Link(src, dest)
+}
+
+// decryptInfo - Replaces the size of an object with its decrypted size,
+// which is read from the header, if it is not known yet
+func (s *EncryptedStorage) decryptInfo(info StorageInfo) (StorageInfo, error) {
+	s.sizeCacheLock.Lock()
+	cached, ok := s.sizeCache[info.Key]
+	s.sizeCacheLock.Unlock()
+
+	if ok && cached.size == info.Size && cached.modTime.Equal(info.ModTime) {
+		info.Size = cached.decryptedSize
+		return info, nil
+	}
+
+	obj, err := s.Get(info.Key)
+	if err != nil {
+		return info, err
+	}
+	obj.Close()
+
+	info.Size = obj.Info().Size
+	return info, nil
+}
+
+func (s *EncryptedStorage) forgetSize(key string) {
+	s.sizeCacheLock.Lock()
+	defer s.sizeCacheLock.Unlock()
+
+	delete(s.sizeCache, key)
+}
+
+func (s *EncryptedStorage) open(src StorageObject) (*encryptedStorageObject, error) {
+	info := src.Info()
+
+	header, err := readEncryptionHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		if s.CurrentKey != nil && !s.AllowUnencrypted {
+			return nil, fmt.Errorf("%s: %w", info.Key, ErrNotEncrypted)
+		}
+
+		return &encryptedStorageObject{ReadSeeker: src, src: src, info: info}, nil
+	}
+
+	reader, err := newDecryptingReader(src, header, info.Size, s.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Size = reader.size
+	return &encryptedStorageObject{ReadSeeker: reader, src: src, info: info}, nil
+}
+
+func (s *EncryptedStorage) rememberSize(info StorageInfo, decryptedSize int64) {
+	s.sizeCacheLock.Lock()
+	defer s.sizeCacheLock.Unlock()
+
+	s.sizeCache[info.Key] = encryptedStorageSize{
+		modTime:       info.ModTime,
+		size:          info.Size,
+		decryptedSize: decryptedSize,
+	}
+}
+
+func (o *encryptedStorageObject) Close() error {
+	return o.src.Close()
+}
+
+func (o *encryptedStorageObject) Info() StorageInfo {
+	return o.info
+}
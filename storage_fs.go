@@ -0,0 +1,221 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileStorage - A storage, which stores each object as file inside a directory
+type FileStorage struct {
+	Root string
+}
+
+type fileStorageObject struct {
+	*os.File
+	info StorageInfo
+}
+
+// NewFileStorage - Creates a new storage for a directory
+func NewFileStorage(root string) *FileStorage {
+	return &FileStorage{Root: root}
+}
+
+// Delete - Deletes an object, and the directories, which become empty
+func (s *FileStorage) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if err == nil {
+		s.removeEmptyDirectories(key)
+	}
+
+	return err
+}
+
+// Get - Opens an object for reading
+func (s *FileStorage) Get(key string) (StorageObject, error) {
+	file, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	fileStat, err := file.Stat()
+	if err == nil && fileStat.IsDir() {
+		err = notExistError("open", key)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &fileStorageObject{File: file, info: newFileStorageInfo(s.path(key), key, fileStat)}, nil
+}
+
+// Link - Creates a hard link to an existing object
+func (s *FileStorage) Link(src string, dest string) error {
+	err := os.MkdirAll(path.Dir(s.path(dest)), 0755)
+	if err == nil {
+		err = os.Link(s.path(src), s.path(dest))
+	}
+	if err == nil {
+		err = SyncDirectory(path.Dir(s.path(dest)))
+	}
+
+	return err
+}
+
+// List - Returns all files, whose keys start with a prefix
+func (s *FileStorage) List(prefix string) ([]StorageInfo, error) {
+	objects := make([]StorageInfo, 0)
+
+	dirKey, namePrefix := path.Split(prefix)
+
+	files, err := ioutil.ReadDir(s.path(dirKey))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return objects, nil
+		}
+
+		return objects, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), namePrefix) {
+			continue
+		}
+
+		objects = append(objects, newFileStorageInfo(s.path(dirKey+f.Name()), dirKey+f.Name(), f))
+	}
+
+	return objects, nil
+}
+
+// ListDirectories - Returns all sub directories of the directory of a prefix,
+// whose names start with the rest of the prefix
+func (s *FileStorage) ListDirectories(prefix string) ([]string, error) {
+	dirs := make([]string, 0)
+
+	dirKey, namePrefix := path.Split(prefix)
+
+	files, err := ioutil.ReadDir(s.path(dirKey))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dirs, nil
+		}
+
+		return dirs, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() && strings.HasPrefix(f.Name(), namePrefix) {
+			dirs = append(dirs, dirKey+f.Name()+"/")
+		}
+	}
+
+	return dirs, nil
+}
+
+// Put - Writes an object to a temporary file and renames it
+func (s *FileStorage) Put(key string, data io.Reader) error {
+	err := os.MkdirAll(path.Dir(s.path(key)), 0755)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(s.path(key), data, 0644)
+}
+
+// PutFile - Renames a local file, or moves it, if it is on another device
+func (s *FileStorage) PutFile(key string, file string) error {
+	err := os.MkdirAll(path.Dir(s.path(key)), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = PublishFile(file, s.path(key))
+	if err == nil {
+		err = SyncDirectory(path.Dir(s.path(key)))
+	}
+
+	return err
+}
+
+// Rename - Renames the file of an object
+func (s *FileStorage) Rename(src string, dest string) error {
+	err := os.MkdirAll(path.Dir(s.path(dest)), 0755)
+	if err == nil {
+		err = os.Rename(s.path(src), s.path(dest))
+	}
+	if err == nil {
+		err = SyncDirectory(path.Dir(s.path(dest)))
+	}
+	if err == nil {
+		s.removeEmptyDirectories(src)
+	}
+
+	return err
+}
+
+// Stat - Returns information about the file of an object
+func (s *FileStorage) Stat(key string) (StorageInfo, error) {
+	fileStat, err := os.Stat(s.path(key))
+	if err == nil && fileStat.IsDir() {
+		err = notExistError("stat", key)
+	}
+	if err != nil {
+		return StorageInfo{}, err
+	}
+
+	return newFileStorageInfo(s.path(key), key, fileStat), nil
+}
+
+func (s *FileStorage) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(key))
+}
+
+// removeEmptyDirectories - Removes the parent directories of a key, as long as they are empty
+func (s *FileStorage) removeEmptyDirectories(key string) {
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		// fails for non-empty directories
+		if os.Remove(s.path(dir)) != nil {
+			break
+		}
+	}
+}
+
+func (o *fileStorageObject) Info() StorageInfo {
+	return o.info
+}
+
+func newFileStorageInfo(file string, key string, fileStat os.FileInfo) StorageInfo {
+	info := StorageInfo{
+		Key:     key,
+		Size:    fileStat.Size(),
+		ModTime: fileStat.ModTime(),
+	}
+
+	links, ok := getLinkCount(file, fileStat)
+	if ok {
+		info.Links = int(links)
+	}
+
+	return info
+}
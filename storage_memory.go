@@ -0,0 +1,238 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage - A storage, which keeps all objects in memory,
+// for tests and ephemeral servers
+type MemoryStorage struct {
+	lock    sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+// memoryObject - The data of an object, which is never changed,
+// so it can be shared by keys and readers
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+	// number of keys, which share the object
+	links int
+}
+
+type memoryStorageObject struct {
+	*bytes.Reader
+	info StorageInfo
+}
+
+// NewMemoryStorage - Creates a new, empty storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: map[string]*memoryObject{}}
+}
+
+// Delete - Deletes an object
+func (s *MemoryStorage) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.objects[key]; !ok {
+		return notExistError("delete", key)
+	}
+
+	s.set(key, nil)
+	return nil
+}
+
+// Get - Opens an object for reading
+func (s *MemoryStorage) Get(key string) (StorageObject, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, notExistError("open", key)
+	}
+
+	return &memoryStorageObject{
+		Reader: bytes.NewReader(obj.data),
+		info:   s.info(key, obj),
+	}, nil
+}
+
+// Link - Creates a new key for the data of an existing object
+func (s *MemoryStorage) Link(src string, dest string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.objects[src]
+	if !ok {
+		return notExistError("link", src)
+	}
+
+	s.set(dest, obj)
+	return nil
+}
+
+// List - Returns all objects, whose keys start with a prefix
+func (s *MemoryStorage) List(prefix string) ([]StorageInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	objects := make([]StorageInfo, 0)
+	for key, obj := range s.objects {
+		if !strings.HasPrefix(key, prefix) || strings.Contains(key[len(prefix):], "/") {
+			continue
+		}
+
+		objects = append(objects, s.info(key, obj))
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+// ListDirectories - Returns the common prefixes of all keys below a prefix, up to the next slash
+func (s *MemoryStorage) ListDirectories(prefix string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	found := map[string]bool{}
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if i := strings.Index(key[len(prefix):], "/"); i > -1 {
+			found[key[:len(prefix)+i+1]] = true
+		}
+	}
+
+	dirs := make([]string, 0, len(found))
+	for dir := range found {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return dirs, nil
+}
+
+// Put - Creates or replaces an object
+func (s *MemoryStorage) Put(key string, data io.Reader) error {
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.set(key, &memoryObject{data: content, modTime: time.Now()})
+	return nil
+}
+
+// PutFile - Reads a local file into an object and deletes it
+func (s *MemoryStorage) PutFile(key string, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	err = s.Put(key, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(file)
+}
+
+// Rename - Renames an object
+func (s *MemoryStorage) Rename(src string, dest string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.objects[src]
+	if !ok {
+		return notExistError("rename", src)
+	}
+	if src == dest {
+		return nil
+	}
+
+	s.set(dest, obj)
+	s.set(src, nil)
+	return nil
+}
+
+// Stat - Returns information about an object
+func (s *MemoryStorage) Stat(key string) (StorageInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return StorageInfo{}, notExistError("stat", key)
+	}
+
+	return s.info(key, obj), nil
+}
+
+// info - Returns information about an object, must be called with read lock
+func (s *MemoryStorage) info(key string, obj *memoryObject) StorageInfo {
+	return StorageInfo{
+		Key:     key,
+		Size:    int64(len(obj.data)),
+		ModTime: obj.modTime,
+		Links:   obj.links,
+	}
+}
+
+// set - Assigns an object to a key, or removes the key for nil,
+// must be called with write lock
+func (s *MemoryStorage) set(key string, obj *memoryObject) {
+	if old, ok := s.objects[key]; ok {
+		old.links--
+	}
+
+	if obj == nil {
+		delete(s.objects, key)
+		return
+	}
+
+	obj.links++
+	s.objects[key] = obj
+}
+
+func (o *memoryStorageObject) Close() error {
+	return nil
+}
+
+func (o *memoryStorageObject) Info() StorageInfo {
+	return o.info
+}
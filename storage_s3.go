@@ -0,0 +1,508 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Storage - A storage, which stores each object in a bucket of an
+// S3 compatible object store, like AWS S3 or MinIO
+//
+// Buckets are addressed by path ("<endpoint>/<bucket>/<key>"),
+// so local stand-ins work without DNS setup.
+type S3Storage struct {
+	AccessKey string
+	Bucket    string
+	Endpoint  *url.URL
+	// prefix for all keys inside the bucket
+	Prefix    string
+	Region    string
+	SecretKey string
+
+	client *http.Client
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3StorageObject struct {
+	body    io.ReadCloser
+	etag    string
+	info    StorageInfo
+	offset  int64
+	storage *S3Storage
+}
+
+// SHA-256 hash of an empty payload
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// NewS3Storage - Creates a new storage for a bucket
+func NewS3Storage(endpoint string, bucket string, region string, accessKey string, secretKey string, prefix string) (*S3Storage, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpointURL.Scheme != "http" && endpointURL.Scheme != "https" || endpointURL.Host == "" {
+		return nil, errors.New("Invalid S3 endpoint " + endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("Missing S3 bucket")
+	}
+
+	return &S3Storage{
+		AccessKey: accessKey,
+		Bucket:    bucket,
+		Endpoint:  endpointURL,
+		Prefix:    prefix,
+		Region:    region,
+		SecretKey: secretKey,
+		client:    &http.Client{},
+	}, nil
+}
+
+// NewS3StorageFromEnv - Creates a new storage from the environment variables
+// CCLIP_S3_ENDPOINT, CCLIP_S3_BUCKET, CCLIP_S3_REGION, CCLIP_S3_ACCESS_KEY,
+// CCLIP_S3_SECRET_KEY and CCLIP_S3_PREFIX
+func NewS3StorageFromEnv() (*S3Storage, error) {
+	region := strings.TrimSpace(os.Getenv("CCLIP_S3_REGION"))
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return NewS3Storage(
+		strings.TrimSpace(os.Getenv("CCLIP_S3_ENDPOINT")),
+		strings.TrimSpace(os.Getenv("CCLIP_S3_BUCKET")),
+		region,
+		strings.TrimSpace(os.Getenv("CCLIP_S3_ACCESS_KEY")),
+		strings.TrimSpace(os.Getenv("CCLIP_S3_SECRET_KEY")),
+		strings.TrimSpace(os.Getenv("CCLIP_S3_PREFIX")),
+	)
+}
+
+// Delete - Deletes an object
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, 0, s3EmptyPayloadHash, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// Get - Opens an object for reading, the data is requested when reading
+//
+// Reading fails, if the object is changed in the meantime.
+func (s *S3Storage) Get(key string) (StorageObject, error) {
+	info, etag, err := s.head(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3StorageObject{
+		etag:    etag,
+		info:    info,
+		storage: s,
+	}, nil
+}
+
+// List - Returns all objects, whose keys start with a prefix
+func (s *S3Storage) List(prefix string) ([]StorageInfo, error) {
+	objects := make([]StorageInfo, 0)
+
+	err := s.list(prefix, func(result s3ListResult) {
+		for _, c := range result.Contents {
+			objects = append(objects, StorageInfo{
+				Key:     strings.TrimPrefix(c.Key, s.Prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+	})
+
+	return objects, err
+}
+
+// ListDirectories - Returns the common prefixes of all objects below a prefix, up to the next slash
+func (s *S3Storage) ListDirectories(prefix string) ([]string, error) {
+	dirs := make([]string, 0)
+
+	err := s.list(prefix, func(result s3ListResult) {
+		for _, p := range result.CommonPrefixes {
+			dirs = append(dirs, strings.TrimPrefix(p.Prefix, s.Prefix))
+		}
+	})
+
+	return dirs, err
+}
+
+// list - Requests all pages of the listing of a prefix
+func (s *S3Storage) list(prefix string, handlePage func(result s3ListResult)) error {
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.Prefix+prefix)
+		query.Set("delimiter", "/")
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := s.do("GET", "", query, nil, 0, s3EmptyPayloadHash, nil)
+		if err != nil {
+			return err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		handlePage(result)
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// Put - Uploads an object, which is completely read into memory first
+func (s *S3Storage) Put(key string, data io.Reader) error {
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(content)
+
+	resp, err := s.do("PUT", key, nil, bytes.NewReader(content), int64(len(content)), hex.EncodeToString(hash[:]), nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// PutFile - Uploads a local file and deletes it
+func (s *S3Storage) PutFile(key string, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	fileStat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// do not read large files twice
+	resp, err := s.do("PUT", key, nil, f, fileStat.Size(), "UNSIGNED-PAYLOAD", nil)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return os.Remove(file)
+}
+
+// Rename - Copies an object inside the bucket and deletes the source
+func (s *S3Storage) Rename(src string, dest string) error {
+	if src == dest {
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+s.Bucket+"/"+s3EscapePath(s.Prefix+src))
+
+	resp, err := s.do("PUT", dest, nil, nil, 0, s3EmptyPayloadHash, header)
+	if err != nil {
+		return err
+	}
+
+	// a copy can fail after the response status has been sent
+	result, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil && bytes.Contains(result, []byte("<Error>")) {
+		err = errors.New("Copying S3 object " + src + " failed: " + string(result))
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.Delete(src)
+}
+
+// Stat - Returns information about an object
+func (s *S3Storage) Stat(key string) (StorageInfo, error) {
+	info, _, err := s.head(key)
+	return info, err
+}
+
+// do - Sends a signed request for an object, or the bucket if key is empty
+//
+// An error is returned for all non-successful responses.
+func (s *S3Storage) do(method string, key string, query url.Values, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	objectPath := "/" + s.Bucket
+	if key != "" {
+		objectPath += "/" + s.Prefix + key
+	}
+
+	u := *s.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = strings.TrimSuffix(s.Endpoint.EscapedPath(), "/") + s3EscapePath(objectPath)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if s.AccessKey != "" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		signAWSRequest(req, payloadHash, s.AccessKey, s.SecretKey, s.Region, "s3", time.Now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, notExistError(strings.ToLower(method), key)
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+
+		return nil, fmt.Errorf("S3 request %s %s failed with status %d: %s", method, objectPath, resp.StatusCode, message)
+	}
+
+	return resp, nil
+}
+
+func (s *S3Storage) head(key string) (StorageInfo, string, error) {
+	resp, err := s.do("HEAD", key, nil, nil, 0, s3EmptyPayloadHash, nil)
+	if err != nil {
+		return StorageInfo{}, "", err
+	}
+	resp.Body.Close()
+
+	info := StorageInfo{
+		Key:  key,
+		Size: resp.ContentLength,
+	}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return info, resp.Header.Get("ETag"), nil
+}
+
+func (o *s3StorageObject) Close() error {
+	if o.body == nil {
+		return nil
+	}
+
+	err := o.body.Close()
+	o.body = nil
+
+	return err
+}
+
+func (o *s3StorageObject) Info() StorageInfo {
+	return o.info
+}
+
+func (o *s3StorageObject) Read(p []byte) (int, error) {
+	if o.offset >= o.info.Size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		// request the rest of the object, beginning at the current offset
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+		if o.etag != "" {
+			header.Set("If-Match", o.etag)
+		}
+
+		resp, err := o.storage.do("GET", o.info.Key, nil, nil, 0, s3EmptyPayloadHash, header)
+		if err != nil {
+			return 0, err
+		}
+
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+
+	return n, err
+}
+
+func (o *s3StorageObject) Seek(offset int64, whence int) (int64, error) {
+	newOffset := offset
+	switch whence {
+	case io.SeekCurrent:
+		newOffset += o.offset
+	case io.SeekEnd:
+		newOffset += o.info.Size
+	}
+
+	if newOffset < 0 {
+		return o.offset, errors.New("Negative position")
+	}
+
+	if newOffset != o.offset {
+		// request again, when reading
+		o.Close()
+		o.offset = newOffset
+	}
+
+	return o.offset, nil
+}
+
+// signAWSRequest - Signs a request with AWS Signature Version 4,
+// including the headers Host, Content-Type and all X-Amz-* headers
+func signAWSRequest(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery - Returns a query string, which is sorted and encoded as required by AWS
+func s3CanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+// s3Escape - URI encodes all characters, except the unreserved ones
+// and optionally the slash
+func s3Escape(s string, escapeSlash bool) string {
+	var result strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !escapeSlash) {
+			result.WriteByte(b)
+		} else {
+			fmt.Fprintf(&result, "%%%02X", b)
+		}
+	}
+
+	return result.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, false)
+}
@@ -0,0 +1,158 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// storageBackends - All implementations of Storage, which are checked by TestStorageConformance
+var storageBackends = map[string]func(t *testing.T) Storage{
+	"fs": func(t *testing.T) Storage {
+		return NewFileStorage(t.TempDir())
+	},
+	"memory": func(t *testing.T) Storage {
+		return NewMemoryStorage()
+	},
+	"s3": func(t *testing.T) Storage {
+		return newFakeS3Server(t).newStorage(t, "prefix/")
+	},
+}
+
+func TestStorageConformance(t *testing.T) {
+	for name, newStorage := range storageBackends {
+		t.Run(name, func(t *testing.T) {
+			storage := newStorage(t)
+
+			readObject := func(key string) string {
+				t.Helper()
+
+				obj, err := storage.Get(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer obj.Close()
+
+				data, err := ioutil.ReadAll(obj)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return string(data)
+			}
+
+			for _, key := range []string{"a", "ab/c", "ab/d", "ab/e/f", "x y"} {
+				if err := storage.Put(key, strings.NewReader("data of "+key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// replaced
+			if err := storage.Put("a", strings.NewReader("new data")); err != nil {
+				t.Fatal(err)
+			}
+			if data := readObject("a"); data != "new data" {
+				t.Errorf("object contains %q", data)
+			}
+
+			// moved
+			tmpFile := filepath.Join(t.TempDir(), "upload")
+			if err := ioutil.WriteFile(tmpFile, []byte("0123456789"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.PutFile("ab/file", tmpFile); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(tmpFile); !os.IsNotExist(err) {
+				t.Errorf("temporary file still exists (%v)", err)
+			}
+
+			info, err := storage.Stat("ab/file")
+			if err != nil || info.Key != "ab/file" || info.Size != 10 {
+				t.Errorf("unexpected info %+v (%v)", info, err)
+			}
+
+			obj, err := storage.Get("ab/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.Info().Size != 10 {
+				t.Errorf("unexpected info %+v", obj.Info())
+			}
+			if _, err := obj.Seek(4, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			part := make([]byte, 3)
+			if _, err := io.ReadFull(obj, part); err != nil || string(part) != "456" {
+				t.Errorf("range contains %q (%v)", part, err)
+			}
+			if pos, err := obj.Seek(-2, io.SeekEnd); err != nil || pos != 8 {
+				t.Errorf("unexpected position %d (%v)", pos, err)
+			}
+			if rest, err := ioutil.ReadAll(obj); err != nil || string(rest) != "89" {
+				t.Errorf("end contains %q (%v)", rest, err)
+			}
+			obj.Close()
+
+			// not below a further slash
+			objects, err := storage.List("ab/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := []string{}
+			for _, o := range objects {
+				keys = append(keys, o.Key)
+			}
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != "ab/c,ab/d,ab/file" {
+				t.Errorf("unexpected objects %v", keys)
+			}
+
+			dirs, err := storage.ListDirectories("")
+			sort.Strings(dirs)
+			if err != nil || strings.Join(dirs, ",") != "ab/" {
+				t.Errorf("unexpected directories %v (%v)", dirs, err)
+			}
+
+			if err := storage.Rename("ab/c", "ab/d"); err != nil {
+				t.Fatal(err)
+			}
+			if data := readObject("ab/d"); data != "data of ab/c" {
+				t.Errorf("renamed object contains %q", data)
+			}
+
+			if err := storage.Delete("x y"); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range []string{"ab/c", "x y", "missing"} {
+				if _, err := storage.Stat(key); !os.IsNotExist(err) {
+					t.Errorf("stat of %s: unexpected error %v", key, err)
+				}
+				if _, err := storage.Get(key); !os.IsNotExist(err) {
+					t.Errorf("get of %s: unexpected error %v", key, err)
+				}
+			}
+		})
+	}
+}
@@ -8,14 +8,81 @@ import (
 // HTTPAction - A http action
 type HTTPAction func(http.ResponseWriter, *http.Request)
 
-var httpLock sync.Mutex
+type clipLock struct {
+	sync.RWMutex
+	refs int
+}
+
+var clipLocks = map[string]*clipLock{}
+var clipLocksLock sync.Mutex
+
+// LockBlob - Locks a shared data file of a SHA-256 hash exclusively, s. StoreClipData()
+//
+// Returns the function, which unlocks the data file again.
+func LockBlob(hash string) func() {
+	return LockClip("blob:" + hash)
+}
+
+// LockClip - Locks a clip exclusively, before its data, meta data or shares are changed
+//
+// The clip is marked as "writing" in the meantime, so "cclip migrate-layout" does not move it,
+// s. beginClipWrite(). The key of the clip must be resolved after locking it, s. findClipKey().
+//
+// Returns the function, which unlocks the clip again, and can be called more than once,
+// so the lock can be released early and by defer.
+func LockClip(id string) func() {
+	l := acquireClipLock(id)
+	l.Lock()
+
+	marker := beginClipWrite(id)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if marker != "" {
+				DeleteObjects(marker)
+			}
+
+			l.Unlock()
+			releaseClipLock(id)
+		})
+	}
+}
+
+// RLockClip - Locks a clip for reading, so no other request can change it in the meantime
+//
+// Returns the function, which unlocks the clip again.
+func RLockClip(id string) func() {
+	l := acquireClipLock(id)
+	l.RLock()
+
+	return func() {
+		l.RUnlock()
+		releaseClipLock(id)
+	}
+}
+
+func acquireClipLock(id string) *clipLock {
+	clipLocksLock.Lock()
+	defer clipLocksLock.Unlock()
+
+	l, ok := clipLocks[id]
+	if !ok {
+		l = &clipLock{}
+		clipLocks[id] = l
+	}
+	l.refs++
+
+	return l
+}
 
-// AsThreadSafeHTTPAction - Makes a http action thread safe
-func AsThreadSafeHTTPAction(a HTTPAction) HTTPAction {
-	return func(w http.ResponseWriter, r *http.Request) {
-		httpLock.Lock()
-		defer httpLock.Unlock()
+func releaseClipLock(id string) {
+	clipLocksLock.Lock()
+	defer clipLocksLock.Unlock()
 
-		a(w, r)
+	l := clipLocks[id]
+	l.refs--
+	if l.refs < 1 {
+		delete(clipLocks, id)
 	}
 }
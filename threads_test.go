@@ -0,0 +1,109 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentClipRequests - Runs uploads, downloads, replacements,
+// renames, listings and deletions in parallel, which should be run
+// with the race detector: go test -race
+func TestConcurrentClipRequests(t *testing.T) {
+	server := newTestServer(t)
+	DedupMode = "link"
+	MaxClipVersions = 3
+
+	const workers = 8
+	const rounds = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*2)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			// every second worker uploads the same data, to share blobs
+			content := func(round int) string {
+				return fmt.Sprintf("worker %d round %d", worker%2, round)
+			}
+
+			resp, body := server.do("POST", "/clips", content(-1), "Content-Type", "text/plain")
+			if resp.StatusCode != 201 {
+				errs <- fmt.Errorf("upload of worker %d failed: %d %s", worker, resp.StatusCode, body)
+				return
+			}
+
+			var clip uploadFileResponse
+			json.Unmarshal([]byte(body), &clip)
+
+			for r := 0; r < rounds; r++ {
+				resp, body = server.do("PUT", "/clips/"+clip.ID, content(r), "Content-Type", "text/plain")
+				if resp.StatusCode != 200 {
+					errs <- fmt.Errorf("replace of worker %d failed: %d %s", worker, resp.StatusCode, body)
+					return
+				}
+
+				resp, body = server.do("GET", "/clips/"+clip.ID, "")
+				if resp.StatusCode != 200 || body != content(r) {
+					errs <- fmt.Errorf("download of worker %d returned %d %q, expected %q", worker, resp.StatusCode, body, content(r))
+					return
+				}
+
+				resp, _ = server.do("PATCH", "/clips/"+clip.ID, fmt.Sprintf(`{"name":"round %d"}`, r))
+				if resp.StatusCode != 200 {
+					errs <- fmt.Errorf("patch of worker %d failed: %d", worker, resp.StatusCode)
+					return
+				}
+
+				resp, _ = server.do("GET", "/clips", "")
+				if resp.StatusCode != 200 {
+					errs <- fmt.Errorf("listing of worker %d failed: %d", worker, resp.StatusCode)
+					return
+				}
+			}
+
+			resp, _ = server.do("DELETE", "/clips/"+clip.ID, "")
+			if resp.StatusCode != 204 {
+				errs <- fmt.Errorf("deletion of worker %d failed: %d", worker, resp.StatusCode)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if count := ClipIndex.Count(); count != 0 {
+		t.Errorf("index still contains %d clips", count)
+	}
+
+	blobs, _ := ioutil.ReadDir(path.Join(ClipDirectory, BlobDirectoryName))
+	if len(blobs) != 0 {
+		t.Errorf("%d blobs have not been released", len(blobs))
+	}
+}
@@ -0,0 +1,377 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APITokenPrefix - The prefix of all API tokens, so they can be told apart from Password
+const APITokenPrefix = "cclip_"
+
+// TokensFileName - The name of the default TokensFile inside CCLIP_DIR
+const TokensFileName = "tokens.json"
+
+// TokenScopes - All scopes of API tokens, s. AddHTTPAction()
+//
+// "admin" allows a token of an admin to access the clips of all users.
+var TokenScopes = []string{"read", "write", "delete", "admin"}
+
+// TokensFile - The JSON file with the hashes of all API tokens, s. ReadAPITokens()
+//
+// The server records, when a token has been used last, in a second file, s. getTokenUsageFile().
+var TokensFile string
+
+// APIToken - A revocable API token of a user, like for one device
+type APIToken struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	// name of the user, an empty string for the shared namespace
+	User   string   `json:"user,omitempty"`
+	Scopes []string `json:"scopes"`
+	// SHA-256 hash of the token
+	Hash string `json:"hash"`
+	// UNIX timestamps
+	CreationTime int64 `json:"ctime"`
+	ExpiresAt    int64 `json:"expires,omitempty"`
+	// UNIX timestamp, s. ReadAPITokenUsage()
+	LastUsed int64 `json:"-"`
+}
+
+// tokensFileContent - The content of TokensFile
+type tokensFileContent struct {
+	Tokens []APIToken `json:"tokens"`
+}
+
+// loadedTokens - The API tokens of TokensFile, which are used by the server
+type loadedTokens struct {
+	lock    sync.Mutex
+	modTime time.Time
+	size    int64
+	// hash => token
+	tokens map[string]APIToken
+	// token ID => UNIX timestamp of the last use, which has been written
+	// into the usage file, s. recordUsage()
+	written map[string]int64
+}
+
+var serverTokens = &loadedTokens{
+	tokens:  map[string]APIToken{},
+	written: map[string]int64{},
+}
+
+// CreateAPIToken - Creates a new API token for a user and returns it with the token,
+// which is only stored as hash
+func CreateAPIToken(userName string, label string, scopes []string, expiresAt int64) (APIToken, string, error) {
+	var token APIToken
+
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+
+	_, err := rand.Read(idBytes)
+	if err == nil {
+		_, err = rand.Read(secretBytes)
+	}
+	if err != nil {
+		return token, "", err
+	}
+
+	secret := APITokenPrefix + hex.EncodeToString(secretBytes)
+
+	token.ID = hex.EncodeToString(idBytes)
+	token.Label = label
+	token.User = userName
+	token.Scopes = scopes
+	token.Hash = hashAPIToken(secret)
+	token.CreationTime = time.Now().Unix()
+	token.ExpiresAt = expiresAt
+
+	return token, secret, nil
+}
+
+// GetTokensFileFromEnv - Returns the path of TokensFile from CCLIP_TOKENS_FILE
+func GetTokensFileFromEnv() string {
+	envTokensFile := strings.TrimSpace(os.Getenv("CCLIP_TOKENS_FILE"))
+	if envTokensFile == "" {
+		// next to the clips
+		return path.Join(GetClipDirectoryFromEnv(), TokensFileName)
+	}
+
+	absTokensFile, err := filepath.Abs(envTokensFile)
+	if err != nil {
+		log.Fatalln("Could not resolve tokens file", err.Error())
+	}
+
+	return absTokensFile
+}
+
+// IsValidTokenScope - Checks if a string is one of TokenScopes
+func IsValidTokenScope(scope string) bool {
+	for _, s := range TokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReadAPITokens - Reads all API tokens from TokensFile, with the time of their last use,
+// sorted by creation time
+func ReadAPITokens() ([]APIToken, error) {
+	tokens := make([]APIToken, 0)
+
+	tokensBytes, err := ioutil.ReadFile(TokensFile)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return tokens, err
+	}
+
+	var content tokensFileContent
+	err = json.Unmarshal(tokensBytes, &content)
+	if err != nil {
+		return tokens, err
+	}
+
+	usage, err := readTokenUsage()
+	if err != nil {
+		return tokens, err
+	}
+
+	for _, t := range content.Tokens {
+		t.LastUsed = usage[t.ID]
+		tokens = append(tokens, t)
+	}
+
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return tokens[i].CreationTime < tokens[j].CreationTime
+	})
+
+	return tokens, nil
+}
+
+// WriteAPITokens - Writes all API tokens into TokensFile, which is only readable by the owner
+func WriteAPITokens(tokens []APIToken) error {
+	tokensBytes, err := json.MarshalIndent(tokensFileContent{Tokens: tokens}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(TokensFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(TokensFile, bytes.NewReader(tokensBytes), 0600)
+}
+
+// HasScope - Checks if the token has a scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsExpired - Checks if the token has been expired
+func (t APIToken) IsExpired(now time.Time) bool {
+	return t.ExpiresAt > 0 && now.Unix() >= t.ExpiresAt
+}
+
+// HasScope - Checks if the user may call routes, which need a scope, s. AddHTTPAction()
+func (u User) HasScope(scope string) bool {
+	if u.token == nil {
+		// password
+		return true
+	}
+
+	return u.token.HasScope(scope)
+}
+
+// isAccountFile - Checks if a key of ClipStorage is the default UsersFile, TokensFile
+// or its usage file, which are not encrypted and not part of the clips
+func isAccountFile(key string) bool {
+	return key == UsersFileName || key == TokensFileName || key == strings.TrimSuffix(TokensFileName, ".json")+".used.json"
+}
+
+// getTokenUsageFile - Returns the file, in which the server records, when the tokens
+// of TokensFile have been used last, so it never changes TokensFile itself
+func getTokenUsageFile() string {
+	return strings.TrimSuffix(TokensFile, ".json") + ".used.json"
+}
+
+// hashAPIToken - Returns the SHA-256 hash of an API token as hex string
+func hashAPIToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// readTokenUsage - Reads the UNIX timestamps of the last use of all API tokens by ID
+func readTokenUsage() (map[string]int64, error) {
+	usage := map[string]int64{}
+
+	usageBytes, err := ioutil.ReadFile(getTokenUsageFile())
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(usageBytes, &usage)
+	}
+
+	return usage, err
+}
+
+// requireScope - Rejects HTTP requests, whose user does not have a scope,
+// with 403, s. AddHTTPAction()
+func requireScope(scope string, action HTTPAction) HTTPAction {
+	if scope == "" {
+		// public
+		return action
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !GetRequestUser(req).HasScope(scope) {
+			http.Error(w, "Token has no "+scope+" scope", 403)
+			return
+		}
+
+		action(w, req)
+	}
+}
+
+// authenticate - Returns the user of an API token of TokensFile, who has only its scopes
+func (l *loadedTokens) authenticate(secret string) (User, bool) {
+	l.load()
+
+	l.lock.Lock()
+	token, ok := l.tokens[hashAPIToken(secret)]
+	l.lock.Unlock()
+
+	now := time.Now()
+	if !ok || token.IsExpired(now) {
+		return User{}, false
+	}
+
+	user := sharedUser
+	if token.User != "" {
+		serverUsers.load()
+
+		serverUsers.lock.Lock()
+		user, ok = serverUsers.users[token.User]
+		serverUsers.lock.Unlock()
+
+		if !ok {
+			// removed user
+			return User{}, false
+		}
+	}
+
+	if !token.HasScope("admin") {
+		user.Role = "user"
+	}
+	user.token = &token
+
+	l.recordUsage(token, now)
+
+	return user, true
+}
+
+// load - Reads TokensFile again, if it has been changed, like by "cclip token create"
+func (l *loadedTokens) load() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if TokensFile == "" {
+		return
+	}
+
+	tokensFileStat, err := os.Stat(TokensFile)
+	if os.IsNotExist(err) {
+		l.tokens = map[string]APIToken{}
+		l.modTime = time.Time{}
+		return
+	}
+	if err != nil || (tokensFileStat.ModTime().Equal(l.modTime) && tokensFileStat.Size() == l.size) {
+		// keep the last known tokens
+		return
+	}
+
+	tokens, err := ReadAPITokens()
+	if err != nil {
+		log.Println("[WARN] Could not read tokens file", TokensFile, err.Error())
+		return
+	}
+
+	l.tokens = map[string]APIToken{}
+	for _, t := range tokens {
+		l.tokens[t.Hash] = t
+
+		if _, ok := l.written[t.ID]; !ok {
+			l.written[t.ID] = t.LastUsed
+		}
+	}
+	l.modTime = tokensFileStat.ModTime()
+	l.size = tokensFileStat.Size()
+}
+
+// recordUsage - Writes the time of the use of an API token into the usage file,
+// at most once per minute per token
+func (l *loadedTokens) recordUsage(token APIToken, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Unix()-l.written[token.ID] < 60 {
+		return
+	}
+
+	l.written[token.ID] = now.Unix()
+
+	// only tokens, which have not been revoked
+	usage := map[string]int64{}
+	for _, t := range l.tokens {
+		if l.written[t.ID] > 0 {
+			usage[t.ID] = l.written[t.ID]
+		}
+	}
+
+	usageBytes, err := json.MarshalIndent(usage, "", "  ")
+	if err == nil {
+		err = WriteFileAtomic(getTokenUsageFile(), bytes.NewReader(usageBytes), 0600)
+	}
+	if err != nil {
+		log.Println("[WARN] Could not record usage of token", token.ID, err.Error())
+	}
+}
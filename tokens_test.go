@@ -0,0 +1,267 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// runTestCommand - Runs an app command with a line of input, like a password,
+// and returns, what it has written to stdout
+func runTestCommand(t *testing.T, input string, args ...string) (string, error) {
+	t.Helper()
+
+	stdinFile := filepath.Join(t.TempDir(), "stdin")
+	if err := ioutil.WriteFile(stdinFile, []byte(input+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(stdinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		output <- string(data)
+	}()
+
+	// the flags keep the parsed values of slices, s. createToken()
+	var resetFlags func(commands []*cli.Command)
+	resetFlags = func(commands []*cli.Command) {
+		for _, c := range commands {
+			for _, f := range c.Flags {
+				if sliceFlag, ok := f.(*cli.StringSliceFlag); ok {
+					sliceFlag.Value = nil
+				}
+			}
+			resetFlags(c.Subcommands)
+		}
+	}
+	resetFlags(AppCommands)
+
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdin, w
+	err = (&cli.App{Commands: AppCommands}).Run(append([]string{"cclip"}, args...))
+	os.Stdin, os.Stdout = oldStdin, oldStdout
+
+	w.Close()
+	return <-output, err
+}
+
+// createTestToken - Creates an API token with "cclip token create" and returns
+// the value of the Authorization header of its requests
+func createTestToken(t *testing.T, args ...string) string {
+	t.Helper()
+
+	output, err := runTestCommand(t, "", append([]string{"token", "create"}, args...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "Bearer " + strings.TrimSpace(output)
+}
+
+func TestCreateAPIToken(t *testing.T) {
+	server := newTestServer(t)
+	t.Setenv("CCLIP_TOKENS_FILE", TokensFile)
+	t.Setenv("CCLIP_USERS_FILE", UsersFile)
+	LockoutThreshold = 0
+
+	addTestUser(t, "root", "admin")
+	addTestUser(t, "alice", "user")
+
+	shared := createTestToken(t, "laptop")
+	if !strings.HasPrefix(shared, "Bearer "+APITokenPrefix) {
+		t.Fatalf("unexpected token %q", shared)
+	}
+	server.upload("shared", "Authorization", shared)
+
+	alice := createTestToken(t, "--user", "alice", "--scope", "read", "--ttl", "1h", "kiosk")
+	server.expectStatus(200, "GET", "/clips", "", "Authorization", alice)
+	server.expectStatus(403, "POST", "/clips", "data", "Authorization", alice)
+
+	// like CCLIP_PASSWORD
+	createTestToken(t, "--scope", "read,admin", "bans")
+	createTestToken(t, "--user", "root", "--scope", "read", "--scope", "admin", "root")
+
+	for _, args := range [][]string{
+		{},
+		{"--scope", "read,everything", "invalid scope"},
+		{"--ttl", "-1h", "invalid ttl"},
+		{"--user", "bob", "unknown user"},
+		{"--user", "alice", "--scope", "admin", "no admin"},
+	} {
+		if _, err := runTestCommand(t, "", append([]string{"token", "create"}, args...)...); err == nil {
+			t.Errorf("token has been created with %v", args)
+		}
+	}
+
+	tokens, err := ReadAPITokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 4 {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+	if scopes := strings.Join(tokens[0].Scopes, ","); scopes != "read,write,delete" {
+		t.Errorf("token has the scopes %s by default", scopes)
+	}
+	if scopes := strings.Join(tokens[3].Scopes, ","); scopes != "read,admin" {
+		t.Errorf("unexpected scopes %s", scopes)
+	}
+
+	kiosk := tokens[1]
+	if kiosk.Label != "kiosk" || kiosk.User != "alice" || len(kiosk.Scopes) != 1 || kiosk.Scopes[0] != "read" {
+		t.Errorf("unexpected token %+v", kiosk)
+	}
+	if expires := time.Unix(kiosk.ExpiresAt, 0); time.Until(expires) < 59*time.Minute || time.Until(expires) > time.Hour {
+		t.Errorf("token expires at %v", expires)
+	}
+	for _, token := range tokens {
+		if strings.Contains(shared+alice, token.Hash) || len(token.Hash) != 64 {
+			t.Errorf("unexpected hash %q", token.Hash)
+		}
+	}
+
+	// revoked while the server is running
+	if _, err := runTestCommand(t, "", "token", "revoke", kiosk.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runTestCommand(t, "", "token", "revoke", kiosk.ID); err == nil {
+		t.Error("token has been revoked twice")
+	}
+	server.expectStatus(401, "GET", "/clips", "", "Authorization", alice)
+	server.expectStatus(200, "GET", "/clips", "", "Authorization", shared)
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	server := newTestServer(t)
+
+	admin := addTestUser(t, "root", "admin")
+	alice := addTestUser(t, "alice", "user")
+
+	bob := addTestUser(t, "bob", "user")
+
+	clip := server.upload("alice", "Authorization", alice)
+	other := server.upload("bob", "Authorization", bob)
+
+	read := addTestToken(t, "alice", "read")
+	write := addTestToken(t, "alice", "write")
+	del := addTestToken(t, "alice", "delete")
+
+	server.expectStatus(200, "GET", "/clips/"+clip.ID, "", "Authorization", read)
+	server.expectStatus(403, "GET", "/clips/"+clip.ID, "", "Authorization", write)
+	server.expectStatus(403, "PUT", "/clips/"+clip.ID, "v2", "Authorization", read)
+	server.expectStatus(200, "PUT", "/clips/"+clip.ID, "v2", "Authorization", write)
+	server.expectStatus(200, "PATCH", "/clips/"+clip.ID, `{"name":"x"}`, "Authorization", write)
+	server.expectStatus(201, "POST", "/clips/"+clip.ID+"/shares", "", "Authorization", write)
+	server.expectStatus(403, "DELETE", "/clips/"+clip.ID, "", "Authorization", write)
+	server.expectStatus(403, "GET", "/clips", "", "Authorization", del)
+
+	// the clips of all users need the scope admin and an admin
+	for _, auth := range []string{
+		addTestToken(t, "root", "read"),
+		addTestToken(t, "alice", "read", "admin"),
+	} {
+		server.expectStatus(404, "GET", "/clips/"+other.ID, "", "Authorization", auth)
+	}
+	server.expectStatus(200, "GET", "/clips/"+other.ID, "", "Authorization", addTestToken(t, "root", "read", "admin"))
+	server.expectStatus(200, "GET", "/clips/"+other.ID, "", "Authorization", admin)
+
+	server.expectStatus(204, "DELETE", "/clips/"+clip.ID, "", "Authorization", del)
+}
+
+func TestAPITokenExpiry(t *testing.T) {
+	server := newTestServer(t)
+	Password = "shared"
+	LockoutThreshold = 0
+
+	now := time.Now()
+	tokens := []APIToken{}
+	secrets := []string{}
+	for _, expiresAt := range []int64{now.Add(-time.Second).Unix(), now.Add(time.Hour).Unix()} {
+		token, secret, err := CreateAPIToken("", "test", []string{"read"}, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tokens = append(tokens, token)
+		secrets = append(secrets, "Bearer "+secret)
+	}
+	if err := WriteAPITokens(tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	server.expectStatus(401, "GET", "/clips", "", "Authorization", secrets[0])
+	server.expectStatus(200, "GET", "/clips", "", "Authorization", secrets[1])
+}
+
+func TestAPITokenLastUsed(t *testing.T) {
+	server := newTestServer(t)
+
+	used := addTestToken(t, "", "read")
+	addTestToken(t, "", "read")
+
+	before := time.Now().Unix()
+	server.expectStatus(200, "GET", "/clips", "", "Authorization", used)
+
+	tokens, err := ReadAPITokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens[0].LastUsed < before || tokens[0].LastUsed > time.Now().Unix() || tokens[1].LastUsed != 0 {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+
+	// TokensFile is never changed by the server
+	var content tokensFileContent
+	tokensBytes, err := ioutil.ReadFile(TokensFile)
+	if err == nil {
+		err = json.Unmarshal(tokensBytes, &content)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content.Tokens) != 2 || tokens[0].ID != content.Tokens[0].ID {
+		t.Errorf("unexpected tokens file %+v", content)
+	}
+
+	// recorded at most once per minute
+	usageStat, err := os.Stat(getTokenUsageFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.expectStatus(200, "GET", "/clips", "", "Authorization", used)
+	if newStat, err := os.Stat(getTokenUsageFile()); err != nil || !newStat.ModTime().Equal(usageStat.ModTime()) {
+		t.Errorf("usage has been written again (%v)", err)
+	}
+}
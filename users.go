@@ -0,0 +1,445 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserDirectoryName - The name of the "directory" inside ClipStorage, which contains the clips of all users
+const UserDirectoryName = "users"
+
+// UsersFileName - The name of the default UsersFile inside CCLIP_DIR
+const UsersFileName = "users.json"
+
+// UsersFile - The JSON file with the users of the server, s. ReadUsers()
+//
+// Without users, all clips are stored in the shared namespace, which is protected by Password.
+var UsersFile string
+
+// User - A user of the server, whose clips are stored in an own namespace, s. GetUserPrefix()
+type User struct {
+	Name string `json:"name"`
+	// bcrypt hash of the password
+	PasswordHash string `json:"password"`
+	// "user" or "admin", who can access the clips of all users
+	Role string `json:"role"`
+
+	// the API token of a request, nil for a password, s. HasScope()
+	token *APIToken
+}
+
+// usersFileContent - The content of UsersFile
+type usersFileContent struct {
+	Users []User `json:"users"`
+}
+
+// loadedUsers - The users of UsersFile, which are used by the server
+type loadedUsers struct {
+	lock    sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string]User
+	// user name => hash and SHA-256 hash of the last checked password,
+	// so bcrypt is not needed for each request
+	verified map[string]verifiedPassword
+}
+
+type verifiedPassword struct {
+	hash     string
+	password [sha256.Size]byte
+}
+
+type requestUserKey struct{}
+
+// clip ID => name of the user, s. findClipKey()
+var clipUsers = map[string]string{}
+var clipUsersLock sync.Mutex
+
+// sharedUser - The user of the shared namespace, which is used with Password
+var sharedUser = User{Role: "user"}
+
+var serverUsers = &loadedUsers{
+	users:    map[string]User{},
+	verified: map[string]verifiedPassword{},
+}
+
+var userNameRegex = regexp.MustCompile("^[a-z0-9][a-z0-9_-]{0,63}$")
+
+// AuthenticateRequest - Returns the user of a HTTP request, with the name and password
+// of a user of UsersFile as basic authentication, or an API token of TokensFile
+// or Password as bearer token, s. checkSharedPassword()
+func AuthenticateRequest(req *http.Request) (User, bool) {
+	usersFileExists := serverUsers.load()
+
+	name, password, ok := req.BasicAuth()
+	if ok {
+		return serverUsers.authenticate(name, password)
+	}
+
+	authorization := req.Header.Get("Authorization")
+	secret := strings.TrimPrefix(authorization, "Bearer ")
+	if strings.HasPrefix(secret, APITokenPrefix) {
+		if user, ok := serverTokens.authenticate(secret); ok {
+			return user, true
+		}
+	}
+
+	if Password == "" && PasswordHash == "" {
+		// also, if all users have been removed
+		return sharedUser, !usersFileExists
+	}
+
+	if secret == authorization || !checkSharedPassword(secret) {
+		return User{}, false
+	}
+
+	return sharedUser, true
+}
+
+// GetActiveUserClip - Returns an active clip by its ID, like GetActiveClipByID(),
+// if the user of a HTTP request can access it
+func GetActiveUserClip(req *http.Request, id string) (ClipFile, error) {
+	clip, err := GetActiveClipByID(id)
+	if err == nil && !GetRequestUser(req).CanAccess(clip) {
+		// do not tell, that the clip exists
+		err = os.ErrNotExist
+	}
+
+	return clip, err
+}
+
+// GetRequestUser - Returns the user of a HTTP request, s. AuthenticateRequest()
+func GetRequestUser(req *http.Request) User {
+	user, ok := req.Context().Value(requestUserKey{}).(User)
+	if !ok {
+		return sharedUser
+	}
+
+	return user
+}
+
+// GetUserClip - Returns a clip by its ID, like GetClipByID(),
+// if the user of a HTTP request can access it
+func GetUserClip(req *http.Request, id string) (ClipFile, error) {
+	clip, err := GetClipByID(id)
+	if err == nil && !GetRequestUser(req).CanAccess(clip) {
+		err = notExistError("stat", id)
+	}
+
+	return clip, err
+}
+
+// GetUserPrefix - Returns the prefix of the keys of the clips of a user in ClipStorage,
+// an empty string for the shared namespace
+func GetUserPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	return UserDirectoryName + "/" + name + "/"
+}
+
+// GetUsersFileFromEnv - Returns the path of UsersFile from CCLIP_USERS_FILE
+func GetUsersFileFromEnv() string {
+	envUsersFile := strings.TrimSpace(os.Getenv("CCLIP_USERS_FILE"))
+	if envUsersFile == "" {
+		// next to the clips
+		return path.Join(GetClipDirectoryFromEnv(), UsersFileName)
+	}
+
+	absUsersFile, err := filepath.Abs(envUsersFile)
+	if err != nil {
+		log.Fatalln("Could not resolve users file", err.Error())
+	}
+
+	return absUsersFile
+}
+
+// HashPassword - Returns the bcrypt hash of a password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// IsValidUserName - Checks if a string can be used as name of a user
+func IsValidUserName(name string) bool {
+	return userNameRegex.MatchString(name)
+}
+
+// ListUserPrefixes - Returns the prefixes of the keys of all users, which have clips in a storage,
+// the shared namespace ("") first
+func ListUserPrefixes(storage Storage) ([]string, error) {
+	prefixes := []string{""}
+
+	dirs, err := storage.ListDirectories(UserDirectoryName + "/")
+	if err != nil {
+		return prefixes, err
+	}
+
+	for _, dir := range dirs {
+		if IsValidUserName(path.Base(dir)) {
+			prefixes = append(prefixes, dir)
+		}
+	}
+
+	return prefixes, nil
+}
+
+// ReadUsers - Reads all users from UsersFile, sorted by name
+func ReadUsers() ([]User, error) {
+	users := make([]User, 0)
+
+	usersBytes, err := ioutil.ReadFile(UsersFile)
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return users, err
+	}
+
+	var content usersFileContent
+	err = json.Unmarshal(usersBytes, &content)
+	if err != nil {
+		return users, err
+	}
+
+	for _, u := range content.Users {
+		if !IsValidUserName(u.Name) {
+			log.Println("[WARN] Ignoring user with invalid name", u.Name, "in", UsersFile)
+			continue
+		}
+
+		users = append(users, u)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+
+	return users, nil
+}
+
+// WriteUsers - Writes all users into UsersFile, which is only readable by the owner
+func WriteUsers(users []User) error {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+
+	usersBytes, err := json.MarshalIndent(usersFileContent{Users: users}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(UsersFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(UsersFile, bytes.NewReader(usersBytes), 0600)
+}
+
+// CanAccess - Checks if the user can read and change a clip
+func (u User) CanAccess(c ClipFile) bool {
+	return u.IsAdmin() || c.User() == u.Name
+}
+
+// CheckPassword - Checks a password against the hash of the password of the user,
+// s. CheckPasswordHash()
+func (u User) CheckPassword(password string) bool {
+	return CheckPasswordHash(u.PasswordHash, password)
+}
+
+// IsAdmin - Checks if the user can access the clips of all users
+func (u User) IsAdmin() bool {
+	return u.Role == "admin"
+}
+
+// Usage - Returns the usage of all clips, which the user can access
+func (u User) Usage() ClipUsage {
+	if u.IsAdmin() {
+		return ClipIndex.Usage()
+	}
+
+	return ClipIndex.UserUsage(u.Name)
+}
+
+// User - Returns the name of the user, who owns the clip, an empty string for the shared namespace
+func (c ClipFile) User() string {
+	prefix, _ := splitUserKey(c.file)
+	return getPrefixUser(prefix)
+}
+
+// checkAuthorization - Rejects all HTTP requests without a known user, s. AuthenticateRequest()
+func checkAuthorization(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := GetClientIP(r)
+		if retryAfter, ok := checkLockout(ip); ok {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+			http.Error(w, "Too many failed authentications", 429)
+			return
+		}
+
+		user, ok := AuthenticateRequest(r)
+		if !ok {
+			// requests without credentials, like the first one of a browser, are no attacks
+			if r.Header.Get("Authorization") != "" {
+				recordAuthFailure(ip)
+			}
+
+			w.WriteHeader(401)
+			return
+		}
+
+		recordAuthSuccess(ip)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestUserKey{}, user)))
+	})
+}
+
+// getClipUser - Returns the name of the user of a clip, which has been found before
+func getClipUser(id string) (string, bool) {
+	clipUsersLock.Lock()
+	defer clipUsersLock.Unlock()
+
+	name, ok := clipUsers[id]
+	return name, ok
+}
+
+// getPrefixUser - Returns the name of the user of a prefix of keys, s. GetUserPrefix()
+func getPrefixUser(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+
+	return path.Base(prefix)
+}
+
+// removeClipUser - Forgets the user of a clip, after it has been deleted
+func removeClipUser(id string) {
+	clipUsersLock.Lock()
+	defer clipUsersLock.Unlock()
+
+	delete(clipUsers, id)
+}
+
+// setClipUser - Remembers the name of the user of a clip, so its key is found faster
+func setClipUser(id string, name string) {
+	clipUsersLock.Lock()
+	defer clipUsersLock.Unlock()
+
+	clipUsers[id] = name
+}
+
+// splitUserKey - Splits a key into the prefix of its user, s. GetUserPrefix(),
+// and the key inside the namespace of the user
+func splitUserKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 3 || parts[0] != UserDirectoryName || !IsValidUserName(parts[1]) {
+		return "", key
+	}
+
+	return parts[0] + "/" + parts[1] + "/", parts[2]
+}
+
+// authenticate - Returns a user of UsersFile, if the password matches
+func (l *loadedUsers) authenticate(name string, password string) (User, bool) {
+	l.lock.Lock()
+	user, ok := l.users[name]
+	verified, wasVerified := l.verified[name]
+	l.lock.Unlock()
+
+	if !ok {
+		return User{}, false
+	}
+
+	passwordHash := sha256.Sum256([]byte(password))
+	if wasVerified && verified.hash == user.PasswordHash &&
+		subtle.ConstantTimeCompare(verified.password[:], passwordHash[:]) == 1 {
+		return user, true
+	}
+
+	if !user.CheckPassword(password) {
+		return User{}, false
+	}
+
+	l.lock.Lock()
+	l.verified[name] = verifiedPassword{hash: user.PasswordHash, password: passwordHash}
+	l.lock.Unlock()
+
+	return user, true
+}
+
+// load - Reads UsersFile again, if it has been changed, like by "cclip user add",
+// and returns, if it exists
+func (l *loadedUsers) load() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if UsersFile == "" {
+		return false
+	}
+
+	usersFileStat, err := os.Stat(UsersFile)
+	if os.IsNotExist(err) {
+		l.users = map[string]User{}
+		l.modTime = time.Time{}
+		return false
+	}
+	if err != nil || (usersFileStat.ModTime().Equal(l.modTime) && usersFileStat.Size() == l.size) {
+		// keep the last known users
+		return true
+	}
+
+	users, err := ReadUsers()
+	if err != nil {
+		log.Println("[WARN] Could not read users file", UsersFile, err.Error())
+		return true
+	}
+
+	l.users = map[string]User{}
+	for _, u := range users {
+		l.users[u.Name] = u
+	}
+	l.modTime = usersFileStat.ModTime()
+	l.size = usersFileStat.Size()
+
+	return true
+}
@@ -17,9 +17,13 @@
 package main
 
 import (
+	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"syscall"
 )
 
 // GetFileContentType - Returns the MIME type of a file
@@ -36,8 +40,78 @@ func GetFileContentType(out *os.File) (string, error) {
 	return http.DetectContentType(buffer), nil
 }
 
-// MoveFile - Moves a file, which works also in Docker containers with mounted volumns
-func MoveFile(src string, dest string) error {
+// PublishFile - Renames a (temporary) file to its final path atomically,
+// or moves it, if both paths are on different devices
+func PublishFile(src string, dest string) error {
+	err := os.Rename(src, dest)
+	if err != nil {
+		err = MoveFile(src, dest)
+	}
+
+	return err
+}
+
+// WriteFileAtomic - Writes data to a temporary file in the same directory and
+// renames it to the target, so readers never see a partially written file
+func WriteFileAtomic(file string, data io.Reader, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmpFile, data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), file)
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return SyncDirectory(filepath.Dir(file))
+}
+
+// SyncDirectory - Flushes a directory to disk, so renamed, linked and
+// created files in it survive a crash
+func SyncDirectory(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil && (os.IsPermission(err) || errors.Is(err, syscall.EINVAL)) {
+		// not supported by all file systems and platforms
+		err = nil
+	}
+
+	return err
+}
+
+// GetContentTypeOfFile - Returns the MIME type of a file by its path
+func GetContentTypeOfFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return GetFileContentType(f)
+}
+
+// CopyFile - Copies a file
+func CopyFile(src string, dest string) error {
 	// open source for read
 	srcFile, err := os.Open(src)
 	if err != nil {
@@ -54,14 +128,30 @@ func MoveFile(src string, dest string) error {
 
 	// copy from source to destination
 	_, err = io.Copy(destFile, srcFile)
+	if err == nil {
+		err = destFile.Sync()
+	}
+	if err != nil {
+		destFile.Close()
+		os.Remove(dest)
+
+		return err
+	}
+
+	return nil
+}
+
+// MoveFile - Moves a file, which works also in Docker containers with mounted volumns
+func MoveFile(src string, dest string) error {
+	err := CopyFile(src, dest)
 	if err != nil {
 		return err
 	}
 
 	// remove source file
-	err = os.Remove(srcFile.Name())
+	err = os.Remove(src)
 	if err != nil {
-		os.Remove(destFile.Name())
+		os.Remove(dest)
 
 		return err
 	}
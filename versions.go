@@ -0,0 +1,587 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MaxClipVersions - Maximum number of old versions per clip, 0 for unlimited
+var MaxClipVersions int64 = 10
+
+type clipVersionItem struct {
+	Version          int64  `json:"version"`
+	Name             string `json:"name"`
+	MIME             string `json:"mime"`
+	ModificationTime int64  `json:"mtime"`
+	Size             int64  `json:"size"`
+	StoredSize       int64  `json:"stored_size"`
+	Encoding         string `json:"encoding,omitempty"`
+	ResourceLink     string `json:"resource"`
+}
+
+// ErrVersionNotFound - Is returned, if a version of a clip does not exist
+var ErrVersionNotFound = errors.New("Version not found")
+
+// ArchiveVersion - Moves the current data and meta of the clip into its version history
+func (c ClipFile) ArchiveVersion() (int64, error) {
+	version, err := c.nextVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	clipMeta, err := c.ReadMeta()
+	if err != nil {
+		return 0, err
+	}
+
+	// old versions are never expired, and the ones of burn-after-read clips
+	// are deleted by ReplaceData() and never read
+	clipMeta.ExpiresAt = 0
+
+	versionFile := c.versionFile(version)
+
+	err = ClipStorage.Rename(c.file, versionFile)
+	if err != nil {
+		return 0, err
+	}
+
+	err = ClipMetaStore.Write(c.id, version, clipMeta)
+	if err != nil {
+		// rollback
+		ClipStorage.Rename(versionFile, c.file)
+
+		return 0, err
+	}
+
+	return version, c.pruneVersions()
+}
+
+// GetVersion - Returns an old version of the clip
+func (c ClipFile) GetVersion(version int64) (ClipFile, error) {
+	var versionClip ClipFile
+
+	versionFile := c.versionFile(version)
+
+	versionFileStat, err := ClipStorage.Stat(versionFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrVersionNotFound
+		}
+
+		return versionClip, err
+	}
+
+	versionMeta, err := ClipMetaStore.Read(c.id, version)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrVersionNotFound
+		}
+
+		return versionClip, err
+	}
+
+	versionClip.file = versionFile
+	versionClip.fileInfo = versionFileStat
+	versionClip.id = c.id
+	versionClip.version = version
+	versionClip.setUploadTime(versionMeta)
+
+	return versionClip, nil
+}
+
+// GetVersions - Returns all old versions of the clip, sorted by version number ascending
+func (c ClipFile) GetVersions() ([]ClipFile, error) {
+	versions := make([]ClipFile, 0)
+
+	objects, err := ClipStorage.List(c.VersionsDirectory() + "/")
+	if err != nil {
+		return versions, err
+	}
+
+	for _, o := range objects {
+		if strings.HasSuffix(o.Key, ".meta") {
+			continue
+		}
+
+		version, err := strconv.ParseInt(path.Base(o.Key), 10, 64)
+		if err != nil || version < 1 {
+			continue
+		}
+
+		versionClip, err := c.GetVersion(version)
+		if err != nil {
+			continue
+		}
+
+		versions = append(versions, versionClip)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].version < versions[j].version
+	})
+
+	return versions, nil
+}
+
+// VersionsDirectory - Returns the key prefix of the "directory", which stores the old versions of the clip
+func (c ClipFile) VersionsDirectory() string {
+	return c.file + ".versions"
+}
+
+// ReplaceData - Archives the current version of the clip and replaces it
+// with a temporary file and new meta data
+//
+// The caller has to hold the lock of the clip, s. LockClip().
+func (c ClipFile) ReplaceData(tmpFile string, clipMeta clipMetaData) error {
+	version, err := c.nextVersion()
+	if err != nil {
+		return err
+	}
+
+	// can be completed or rolled back after a crash, s. RecoverPendingClips()
+	op := clipOperation{Type: "replace", SHA256: clipMeta.SHA256, Encoding: clipMeta.Encoding, Blob: clipMeta.Blob, Version: version}
+	err = c.BeginOperation(op.Type, clipMeta, version)
+	if err != nil {
+		return err
+	}
+
+	archivedVersion, err := c.ArchiveVersion()
+	if archivedVersion == 0 {
+		// nothing has been changed
+		c.FinishOperation()
+
+		return err
+	}
+	if err != nil {
+		log.Println("[WARN] Could not prune old versions of clip", c.id, err.Error())
+	}
+
+	err = StoreClipData(tmpFile, clipMeta.BlobID(), c.file)
+	if err == nil {
+		err = c.WriteMeta(clipMeta)
+	}
+	if err != nil {
+		// restore the archived version, instead of waiting for the next start
+		result, rollbackErr := recoverClipOperation(c, op)
+		if rollbackErr == nil {
+			rollbackErr = ClipIndex.Refresh(c.id)
+		}
+		if rollbackErr != nil {
+			log.Println("[WARN] Could not roll back replacement of clip", c.id, rollbackErr.Error())
+		}
+		if result == "completed" {
+			// only updating the index failed
+			return nil
+		}
+
+		return err
+	}
+
+	// the data of a burn-after-read clip must not be kept
+	versionClip, err := c.GetVersion(archivedVersion)
+	if err == nil {
+		versionMeta, err := versionClip.ReadMeta()
+		if err == nil && versionMeta.Burn {
+			err = versionClip.deleteVersion()
+		}
+		if err != nil {
+			log.Println("[WARN] Could not delete old version of burn-after-read clip", c.id, err.Error())
+		}
+	}
+
+	return c.FinishOperation()
+}
+
+func (c ClipFile) nextVersion() (int64, error) {
+	versions, err := c.GetVersions()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(versions) == 0 {
+		return 1, nil
+	}
+
+	return versions[len(versions)-1].version + 1, nil
+}
+
+func (c ClipFile) pruneVersions() error {
+	if MaxClipVersions < 1 {
+		return nil
+	}
+
+	versions, err := c.GetVersions()
+	if err != nil {
+		return err
+	}
+
+	for int64(len(versions)) > MaxClipVersions {
+		err := versions[0].deleteVersion()
+		if err != nil {
+			return err
+		}
+
+		versions = versions[1:]
+	}
+
+	return nil
+}
+
+func (c ClipFile) deleteVersion() error {
+	clipMeta, _ := c.ReadMeta()
+
+	err := ClipStorage.Delete(c.file)
+	if err == nil {
+		err = ClipMetaStore.Delete(c.id, c.version)
+	}
+	if err == nil {
+		err = ReleaseBlob(clipMeta.BlobID())
+	}
+
+	return err
+}
+
+func (c ClipFile) versionFile(version int64) string {
+	return path.Join(c.VersionsDirectory(), strconv.FormatInt(version, 10))
+}
+
+// GetClipDataFile - Returns the key of the data of a clip version in ClipStorage, s. GetClipKey()
+func GetClipDataFile(id string, version int64) string {
+	if version == 0 {
+		return GetClipKey(id)
+	}
+
+	return path.Join(GetClipKey(id)+".versions", strconv.FormatInt(version, 10))
+}
+
+func getClipAndVersion(w http.ResponseWriter, req *http.Request) (ClipFile, ClipFile, bool) {
+	vars := mux.Vars(req)
+
+	clip, err := GetActiveUserClip(req, vars["id"])
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return clip, ClipFile{}, false
+	}
+
+	version, err := strconv.ParseInt(vars["version"], 10, 64)
+	if err != nil {
+		w.WriteHeader(404)
+		return clip, ClipFile{}, false
+	}
+
+	versionClip, err := clip.GetVersion(version)
+	if err == nil {
+		var versionMeta clipMetaData
+		versionMeta, err = versionClip.ReadMeta()
+		if err == nil && versionMeta.Burn {
+			// left by a crash of ReplaceData()
+			err = ErrVersionNotFound
+		}
+	}
+	if err != nil {
+		if err == ErrVersionNotFound || os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return clip, versionClip, false
+	}
+
+	return clip, versionClip, true
+}
+
+func getClipVersionData(w http.ResponseWriter, req *http.Request) {
+	_, versionClip, ok := getClipAndVersion(w, req)
+	if !ok {
+		return
+	}
+
+	SendClipData(w, req, versionClip)
+}
+
+func getClipVersions(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	unlock := RLockClip(vars["id"])
+	defer unlock()
+
+	clip, err := GetActiveUserClip(req, vars["id"])
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	versions, err := clip.GetVersions()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	// newest first
+	items := make([]clipVersionItem, 0)
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+
+		clipMeta, err := v.ReadMeta()
+		if err != nil || clipMeta.Burn {
+			continue
+		}
+
+		var newItem clipVersionItem
+		newItem.Version = v.version
+		newItem.Name = clipMeta.Name
+		newItem.MIME = clipMeta.MIME
+		newItem.ModificationTime = clipMeta.GetModificationTime(v.fileInfo.ModTime).Unix()
+		newItem.Size = clipMeta.GetSize(v.fileInfo.Size)
+		newItem.StoredSize = v.fileInfo.Size
+		newItem.Encoding = clipMeta.Encoding
+		newItem.ResourceLink = "/api/v1/clips/" + url.PathEscape(clip.id) + "/versions/" + strconv.FormatInt(v.version, 10)
+
+		items = append(items, newItem)
+	}
+
+	bytes, err := json.Marshal(items)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	w.Write(bytes)
+}
+
+func replaceClip(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	clip, err := GetActiveUserClip(req, vars["id"])
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	tmpFile, hash, err := ReceiveClipData(w, req)
+	if err != nil {
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			SendRateLimitError(w, rateLimitErr)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	// try delete, when leave function
+	defer os.Remove(tmpFile)
+
+	// receiving data can take a while,
+	// so lock the clip not before now
+	unlock := LockClip(clip.id)
+	defer unlock()
+
+	clip, err = GetActiveUserClip(req, clip.id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+		} else {
+			SendError(w, err)
+		}
+
+		return
+	}
+
+	clipMeta, err := clip.ReadMeta()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	clipMime := strings.TrimSpace(strings.ToLower(req.Header.Get("Content-Type")))
+	if clipMime == "" {
+		clipMime, err = GetContentTypeOfFile(tmpFile)
+		if err != nil {
+			SendError(w, err)
+			return
+		}
+	}
+
+	clipMeta.MIME = clipMime
+	clipMeta.SHA256 = hash
+	clipMeta.UploadTime = time.Now().UnixNano()
+	clipMeta.ModificationTime = clipMeta.UploadTime
+	if req.Header.Get("X-Cclip-Name") != "" {
+		clipMeta.Name = strings.TrimSpace(req.Header.Get("X-Cclip-Name"))
+	}
+
+	dataFile, err := CompressClipData(tmpFile, &clipMeta)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+	if dataFile != tmpFile {
+		defer os.Remove(dataFile)
+	}
+	clipMeta.Blob = NewBlobID(clipMeta.SHA256, clipMeta.Encoding)
+
+	err = clip.ReplaceData(dataFile, clipMeta)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	// other clips are locked by EnforceRetentionLimits()
+	unlock()
+
+	sendUpdatedClip(w, clip, clipMeta)
+}
+
+func restoreClipVersion(w http.ResponseWriter, req *http.Request) {
+	unlock := LockClip(mux.Vars(req)["id"])
+	defer unlock()
+
+	clip, versionClip, ok := getClipAndVersion(w, req)
+	if !ok {
+		return
+	}
+
+	versionMeta, err := versionClip.ReadMeta()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	clipMeta, err := clip.ReadMeta()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	// copy version data, before current data is archived,
+	// because archiving could prune the version
+	tmpFile, err := ioutil.TempFile(ClipDirectory, ".restore-")
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	defer os.Remove(tmpFile.Name())
+
+	versionFile, err := ClipStorage.Get(versionClip.file)
+	if err == nil {
+		_, err = io.Copy(tmpFile, versionFile)
+		versionFile.Close()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	tmpFile.Close()
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	hash := versionMeta.SHA256
+	if hash == "" {
+		hash, err = HashEncodedFile(tmpFile.Name(), versionMeta.Encoding)
+		if err != nil {
+			SendError(w, err)
+			return
+		}
+	}
+
+	clipMeta.Name = versionMeta.Name
+	clipMeta.MIME = versionMeta.MIME
+	clipMeta.SHA256 = hash
+	// the data is copied as it is
+	clipMeta.Encoding = versionMeta.Encoding
+	clipMeta.Size = versionMeta.Size
+	clipMeta.Blob = NewBlobID(hash, clipMeta.Encoding)
+	clipMeta.UploadTime = time.Now().UnixNano()
+	clipMeta.ModificationTime = clipMeta.UploadTime
+
+	err = clip.ReplaceData(tmpFile.Name(), clipMeta)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	// other clips are locked by EnforceRetentionLimits()
+	unlock()
+
+	sendUpdatedClip(w, clip, clipMeta)
+}
+
+func sendUpdatedClip(w http.ResponseWriter, clip ClipFile, clipMeta clipMetaData) {
+	clip, err := GetClipByID(clip.id)
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	err = IndexClip(clip)
+	if err != nil {
+		log.Println("[WARN] Could not index clip", clip.id, err.Error())
+	}
+
+	// the new data can be larger
+	_, err = EnforceRetentionLimits(clip.id)
+	if err != nil {
+		log.Println("[WARN] Could not enforce retention limits", err.Error())
+	}
+
+	bytes, err := json.Marshal(newClipItem(clip, clipMeta))
+	if err != nil {
+		SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	w.Write(bytes)
+}
@@ -0,0 +1,153 @@
+// Cloud Clip
+// Copyright (C) 2020  Marcel Joachim Kloubert <marcel.kloubert@gmx.net>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingStorage - A storage, which cannot store files
+type failingStorage struct {
+	Storage
+}
+
+func (s *failingStorage) PutFile(key string, file string) error {
+	return errors.New("disk full")
+}
+
+func TestClipVersions(t *testing.T) {
+	server := newTestServer(t)
+	MaxClipVersions = 2
+
+	clip := server.upload("v1", "Content-Type", "text/plain")
+	for _, data := range []string{"v2", "v3", "v4"} {
+		server.expectStatus(200, "PUT", "/clips/"+clip.ID, data, "Content-Type", "text/plain")
+	}
+
+	var versions []clipVersionItem
+	json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions", "")), &versions)
+	// newest first
+	if len(versions) != 2 || versions[0].Version != 3 || versions[1].Version != 2 {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+
+	server.expectStatus(404, "GET", "/clips/"+clip.ID+"/versions/1", "")
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions/2", ""); data != "v2" {
+		t.Errorf("version 2 contains %q", data)
+	}
+
+	server.expectStatus(200, "POST", "/clips/"+clip.ID+"/versions/2/restore", "")
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID, ""); data != "v2" {
+		t.Errorf("restored clip contains %q", data)
+	}
+
+	// the replaced data has become a version as well
+	json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions", "")), &versions)
+	if len(versions) != 2 || versions[0].Version != 4 || versions[1].Version != 3 {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions/4", ""); data != "v4" {
+		t.Errorf("version 4 contains %q", data)
+	}
+}
+
+func TestReplaceDataRollback(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("old", "Content-Type", "text/plain")
+
+	ClipStorage = &failingStorage{Storage: ClipStorage}
+	server.expectStatus(500, "PUT", "/clips/"+clip.ID, "new", "Content-Type", "text/plain")
+	ClipStorage = ClipStorage.(*failingStorage).Storage
+
+	// the archived data is the current data again, without a restart
+	if data := server.expectStatus(200, "GET", "/clips/"+clip.ID, ""); data != "old" {
+		t.Errorf("clip contains %q after failed replacement", data)
+	}
+
+	var versions []clipVersionItem
+	json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions", "")), &versions)
+	if len(versions) != 0 {
+		t.Errorf("unexpected versions %+v", versions)
+	}
+
+	c, _ := GetClipByID(clip.ID)
+	if _, err := ClipStorage.Stat(c.PendingMarkerFile()); err == nil {
+		t.Error("pending operation has not been finished")
+	}
+}
+
+func TestReplaceEnforcesRetentionLimits(t *testing.T) {
+	server := newTestServer(t)
+	MaxClipVersions = 0
+	MaxTotalSize = 10
+
+	old := server.upload("12345")
+	clip := server.upload("123")
+
+	server.expectStatus(200, "PUT", "/clips/"+clip.ID, "12345678")
+
+	server.expectStatus(404, "GET", "/clips/"+old.ID, "")
+	server.expectStatus(200, "GET", "/clips/"+clip.ID, "")
+}
+
+func TestReplaceBurnClip(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("secret", "X-Cclip-Burn", "true")
+	server.expectStatus(200, "PUT", "/clips/"+clip.ID, "new", "Content-Type", "text/plain")
+
+	// the unread data is not kept as a version
+	var versions []clipVersionItem
+	json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions", "")), &versions)
+	if len(versions) != 0 {
+		t.Errorf("unexpected versions %+v", versions)
+	}
+	server.expectStatus(404, "GET", "/clips/"+clip.ID+"/versions/1", "")
+
+	c, _ := GetClipByID(clip.ID)
+	if _, err := ClipStorage.Stat(c.versionFile(1)); err == nil {
+		t.Error("data of burn-after-read clip has been archived")
+	}
+}
+
+func TestHideBurnVersions(t *testing.T) {
+	server := newTestServer(t)
+
+	clip := server.upload("secret", "X-Cclip-Burn", "true")
+
+	// a version left by a crash during the replacement
+	c, _ := GetClipByID(clip.ID)
+	if _, err := c.ArchiveVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClipStorage.Put(c.file, strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.expectStatus(404, "GET", "/clips/"+clip.ID+"/versions/1", "")
+	server.expectStatus(404, "POST", "/clips/"+clip.ID+"/versions/1/restore", "")
+
+	var versions []clipVersionItem
+	json.Unmarshal([]byte(server.expectStatus(200, "GET", "/clips/"+clip.ID+"/versions", "")), &versions)
+	if len(versions) != 0 {
+		t.Errorf("unexpected versions %+v", versions)
+	}
+}